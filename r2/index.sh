@@ -0,0 +1,4 @@
+# Adds the story table index delta sync reads changes from, keyed on resId and
+# lastUpdated. Run once per stage before deploying the stories lambda, e.g.
+# ./index.sh dev sls-deployr2
+aws dynamodb update-table --table-name $1-story --attribute-definitions AttributeName=resId,AttributeType=S AttributeName=lastUpdated,AttributeType=N --global-secondary-index-updates '[{"Create":{"IndexName":"resId-lastUpdated-index","KeySchema":[{"AttributeName":"resId","KeyType":"HASH"},{"AttributeName":"lastUpdated","KeyType":"RANGE"}],"Projection":{"ProjectionType":"ALL"}}}]' --aws-profile $2
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/sowens-csd/folktells-server/app"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// Limits on what the app may send in one request. Bodies may be gzip
+// encoded, the body limit applies after decoding.
+const (
+	maxBodyBytes     = 1024 * 1024
+	maxBatchEvents   = 500
+	maxEventBytes    = 8 * 1024
+	maxProperties    = 50
+	maxPropertyChars = 1024
+)
+
+// The library writes a body without a schema version to the stream as one
+// record, which Firehose limits to 1,000 KiB, so those bodies are held well
+// under that.
+const maxLegacyBodyBytes = 512 * 1024
+
+// Events may be up to maxEventAge old, the app holds them while offline, and
+// no more than maxClockSkew ahead of the server.
+const maxEventAge = 90 * 24 * time.Hour
+const maxClockSkew = 24 * time.Hour
+
+// The outcome of each event in the response. A rejected event failed
+// validation and should not be sent again, a failed one could not be written
+// and may be.
+const (
+	eventAccepted = "accepted"
+	eventRejected = "rejected"
+	eventFailed   = "failed"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var eventNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// eventSchemas validates the events of each schema version the back-end
+// accepts. A new version of the event gets a new entry, older apps keep
+// sending the version they were built with.
+var eventSchemas = map[int]func(json.RawMessage, time.Time) (analyticsEvent, error){
+	1: validateEventV1,
+}
+
+// analyticsBatch is what the app sends, the events all of one schema version.
+type analyticsBatch struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Events        []json.RawMessage `json:"events"`
+}
+
+// analyticsEvent is version 1 of an analytics event. Timestamps are in
+// milliseconds, properties are strings, numbers or booleans.
+type analyticsEvent struct {
+	EventID    string                 `json:"eventId"`
+	Name       string                 `json:"name"`
+	Timestamp  int64                  `json:"timestamp"`
+	SessionID  string                 `json:"sessionId,omitempty"`
+	UserID     string                 `json:"userId,omitempty"`
+	DeviceID   string                 `json:"deviceId,omitempty"`
+	AppVersion string                 `json:"appVersion,omitempty"`
+	Platform   string                 `json:"platform,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// analyticsRecord is what is written to the stream for each event.
+type analyticsRecord struct {
+	analyticsEvent
+	SchemaVersion int   `json:"schemaVersion"`
+	ReceivedAt    int64 `json:"receivedAt"`
+}
+
+type eventResult struct {
+	Index   int    `json:"index"`
+	EventID string `json:"eventId,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type analyticsResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Failed   int           `json:"failed"`
+	Results  []eventResult `json:"results"`
+}
+
+// saveAnalytics validates the events in the request and writes the valid ones
+// to the analytics stream, answering with the outcome of each. Bodies without
+// a schema version come from apps older than the schema and are passed on as
+// they always were, once validateLegacy has checked their size and shape.
+func saveAnalytics(ftCtx awsproxy.FTContext, request awsproxy.Request) awsproxy.Response {
+	body, err := decodeBody(request)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !json.Valid(body) {
+		return awsproxy.HandleError(fmt.Errorf("Analytics body is not valid JSON"), ftCtx.RequestLogger)
+	}
+	var batch analyticsBatch
+	err = json.Unmarshal(body, &batch)
+	if nil != err || batch.SchemaVersion == 0 {
+		err = validateLegacy(body)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+		err = app.SaveAnalyticEvents(ftCtx, string(body))
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+		return awsproxy.NewSuccessResponse(ftCtx)
+	}
+	now := time.Now().UTC()
+	results, records, err := validateBatch(batch, now)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if len(records) > 0 {
+		client, err := newRecordBatcher(ftCtx.Context)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+		data := make([][]byte, len(records))
+		for i, record := range records {
+			data[i] = record.data
+		}
+		errs := putRecords(ftCtx.Context, client, os.Getenv("analyticsStream"), data)
+		for i, err := range errs {
+			if nil != err {
+				ftCtx.RequestLogger.Error().Err(err).Str("event", results[records[i].index].EventID).Msg("analytics event not written")
+				results[records[i].index].Status = eventFailed
+				results[records[i].index].Error = err.Error()
+			}
+		}
+	}
+	return awsproxy.NewJSONResponse(ftCtx, summarize(results))
+}
+
+// pendingRecord is a valid event ready to be written, with its place in the
+// request.
+type pendingRecord struct {
+	index int
+	data  []byte
+}
+
+// validateBatch checks each event against the batch's schema version. Events
+// that pass are accepted and returned as records for the stream, the rest are
+// rejected with the reason. An error means the batch as a whole is not valid.
+func validateBatch(batch analyticsBatch, now time.Time) ([]eventResult, []pendingRecord, error) {
+	validate, found := eventSchemas[batch.SchemaVersion]
+	if !found {
+		return nil, nil, fmt.Errorf("Analytics schema version %d is not supported", batch.SchemaVersion)
+	}
+	if len(batch.Events) == 0 {
+		return nil, nil, errors.New("No analytics events")
+	}
+	if len(batch.Events) > maxBatchEvents {
+		return nil, nil, fmt.Errorf("No more than %d analytics events at a time", maxBatchEvents)
+	}
+	results := make([]eventResult, len(batch.Events))
+	records := []pendingRecord{}
+	for i, raw := range batch.Events {
+		results[i] = eventResult{Index: i, Status: eventAccepted}
+		event, err := validate(raw, now)
+		results[i].EventID = event.EventID
+		if nil == err {
+			var data []byte
+			data, err = json.Marshal(analyticsRecord{analyticsEvent: event, SchemaVersion: batch.SchemaVersion, ReceivedAt: now.UnixNano() / int64(time.Millisecond)})
+			if nil == err {
+				records = append(records, pendingRecord{index: i, data: append(data, '\n')})
+			}
+		}
+		if nil != err {
+			results[i].Status = eventRejected
+			results[i].Error = err.Error()
+		}
+	}
+	return results, records, nil
+}
+
+// validateEventV1 checks a version 1 event, fields outside the schema are not
+// allowed.
+func validateEventV1(raw json.RawMessage, now time.Time) (analyticsEvent, error) {
+	var event analyticsEvent
+	if len(raw) > maxEventBytes {
+		return event, fmt.Errorf("event is over %d bytes", maxEventBytes)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	err := decoder.Decode(&event)
+	if nil != err {
+		return event, fmt.Errorf("event does not match the schema: %v", err)
+	}
+	if len(event.EventID) == 0 || len(event.EventID) > 64 {
+		return event, errors.New("eventId must be 1 to 64 characters")
+	}
+	if !eventNamePattern.MatchString(event.Name) {
+		return event, errors.New("name must be lower case letters, digits and underscores")
+	}
+	timestamp := time.Unix(0, event.Timestamp*int64(time.Millisecond))
+	if timestamp.Before(now.Add(-maxEventAge)) || timestamp.After(now.Add(maxClockSkew)) {
+		return event, errors.New("timestamp is out of range")
+	}
+	for _, field := range []string{event.SessionID, event.UserID, event.DeviceID, event.AppVersion, event.Platform} {
+		if len(field) > 128 {
+			return event, errors.New("identifiers must be at most 128 characters")
+		}
+	}
+	if len(event.Properties) > maxProperties {
+		return event, fmt.Errorf("no more than %d properties", maxProperties)
+	}
+	for name, value := range event.Properties {
+		if len(name) == 0 || len(name) > 64 {
+			return event, errors.New("property names must be 1 to 64 characters")
+		}
+		switch typed := value.(type) {
+		case string:
+			if len(typed) > maxPropertyChars {
+				return event, fmt.Errorf("property %s is over %d characters", name, maxPropertyChars)
+			}
+		case json.Number, bool:
+		default:
+			return event, fmt.Errorf("property %s must be a string, number or boolean", name)
+		}
+	}
+	return event, nil
+}
+
+// validateLegacy checks a body without a schema version, an event or an
+// array of events. Each event must be an object within the event size and
+// property limits, and the body must fit in one stream record.
+func validateLegacy(body []byte) error {
+	if len(body) > maxLegacyBodyBytes {
+		return fmt.Errorf("Analytics body without a schema version is over %d bytes", maxLegacyBodyBytes)
+	}
+	trimmed := bytes.TrimSpace(body)
+	events := []json.RawMessage{trimmed}
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		err := json.Unmarshal(trimmed, &events)
+		if nil != err {
+			return fmt.Errorf("Analytics events are not valid: %v", err)
+		}
+		if len(events) == 0 || len(events) > maxBatchEvents {
+			return fmt.Errorf("Between 1 and %d analytics events at a time", maxBatchEvents)
+		}
+	}
+	for i, raw := range events {
+		if len(raw) > maxEventBytes {
+			return fmt.Errorf("Analytics event %d is over %d bytes", i, maxEventBytes)
+		}
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(raw, &fields)
+		if nil != err || nil == fields {
+			return fmt.Errorf("Analytics event %d is not an object", i)
+		}
+		if len(fields) > maxProperties {
+			return fmt.Errorf("Analytics event %d has more than %d fields", i, maxProperties)
+		}
+	}
+	return nil
+}
+
+// decodeBody undoes the base64 encoding API Gateway uses for binary bodies and
+// the gzip encoding the app may use, enforcing the body limit. The app sends
+// gzip bodies as application/gzip, which API Gateway passes on base64
+// encoded. Whether the body is compressed goes by the gzip header rather than
+// the Content-Encoding header, which proxies may drop.
+func decodeBody(request awsproxy.Request) ([]byte, error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if nil != err {
+			return nil, errors.New("Body is not valid base64")
+		}
+		body = decoded
+	}
+	if bytes.HasPrefix(body, gzipMagic) {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if nil != err {
+			return nil, errors.New("Body is not valid gzip")
+		}
+		defer reader.Close()
+		body, err = io.ReadAll(io.LimitReader(reader, maxBodyBytes+1))
+		if nil != err {
+			return nil, errors.New("Body is not valid gzip")
+		}
+	}
+	if len(body) > maxBodyBytes {
+		return nil, fmt.Errorf("Body is over %d bytes", maxBodyBytes)
+	}
+	return body, nil
+}
+
+func summarize(results []eventResult) analyticsResponse {
+	response := analyticsResponse{Results: results}
+	for _, result := range results {
+		switch result.Status {
+		case eventAccepted:
+			response.Accepted++
+		case eventRejected:
+			response.Rejected++
+		case eventFailed:
+			response.Failed++
+		}
+	}
+	return response
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// Firehose takes at most 500 records and 4 MiB in one PutRecordBatch.
+const maxBatchRecords = 500
+const maxBatchBytes = 4 * 1024 * 1024
+
+// maxPutAttempts is how many times a record is tried before it is reported as
+// failed, waiting retryDelay, doubled each time, between attempts.
+const maxPutAttempts = 3
+
+var retryDelay = 100 * time.Millisecond
+
+// recordBatcher is the part of the Firehose client used to write events.
+type recordBatcher interface {
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+}
+
+func newRecordBatcher(ctx context.Context) (recordBatcher, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if nil != err {
+		return nil, err
+	}
+	return firehose.NewFromConfig(cfg), nil
+}
+
+// putRecords writes the records to the stream in as few batches as it can,
+// trying the records Firehose reports as failed again. The error for each
+// record that could not be written is returned in its place.
+func putRecords(ctx context.Context, client recordBatcher, stream string, records [][]byte) []error {
+	errs := make([]error, len(records))
+	pending := make([]int, len(records))
+	for i := range records {
+		pending[i] = i
+	}
+	for attempt := 0; attempt < maxPutAttempts && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay << (attempt - 1))
+		}
+		var retry []int
+		for _, batch := range splitBatches(records, pending) {
+			retry = append(retry, putBatch(ctx, client, stream, records, batch, errs)...)
+		}
+		pending = retry
+	}
+	return errs
+}
+
+// splitBatches groups the records to put within Firehose's batch limits.
+func splitBatches(records [][]byte, pending []int) [][]int {
+	var batches [][]int
+	var batch []int
+	size := 0
+	for _, index := range pending {
+		if len(batch) == maxBatchRecords || (len(batch) > 0 && size+len(records[index]) > maxBatchBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, index)
+		size += len(records[index])
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// putBatch puts one batch, recording the error of each record that failed and
+// returning those records.
+func putBatch(ctx context.Context, client recordBatcher, stream string, records [][]byte, batch []int, errs []error) []int {
+	input := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(stream),
+		Records:            make([]types.Record, len(batch)),
+	}
+	for i, index := range batch {
+		input.Records[i] = types.Record{Data: records[index]}
+	}
+	output, err := client.PutRecordBatch(ctx, input)
+	if nil != err {
+		for _, index := range batch {
+			errs[index] = err
+		}
+		return batch
+	}
+	var failed []int
+	for i, index := range batch {
+		errs[index] = nil
+		if i >= len(output.RequestResponses) {
+			continue
+		}
+		response := output.RequestResponses[i]
+		if nil != response.ErrorCode {
+			errs[index] = errors.New(aws.ToString(response.ErrorCode) + ": " + aws.ToString(response.ErrorMessage))
+			failed = append(failed, index)
+		}
+	}
+	return failed
+}
@@ -4,6 +4,10 @@ go 1.16
 
 require (
 	github.com/aws/aws-lambda-go v1.32.0
+	github.com/aws/aws-sdk-go-v2 v1.16.7
+	github.com/aws/aws-sdk-go-v2/config v1.15.14
+	github.com/aws/aws-sdk-go-v2/service/firehose v1.14.8
+	github.com/aws/aws-sdk-go-v2/service/ssm v1.27.1
 	github.com/rs/zerolog v1.26.1 // indirect
 	github.com/sowens-csd/folktells-server v1.7.21
 	github.com/sowens-csd/ftlambdas v0.0.0-20220313160211-a7b1abb84b84
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+func TestVersionOrder(t *testing.T) {
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.2", "1.10.0", "5.3.8", "5.10"}
+	for i := 0; i+1 < len(ordered); i++ {
+		before, err := parseVersion(ordered[i])
+		if nil != err {
+			t.Fatal(err)
+		}
+		after, err := parseVersion(ordered[i+1])
+		if nil != err {
+			t.Fatal(err)
+		}
+		if before.compare(after) >= 0 || after.compare(before) <= 0 {
+			t.Errorf("Expected %s to come before %s", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+func TestVersionIgnoresBuild(t *testing.T) {
+	build, _ := parseVersion("5.3.8+42")
+	release, _ := parseVersion("5.3.8")
+	if build.compare(release) != 0 {
+		t.Errorf("Expected build metadata to be ignored")
+	}
+}
+
+func TestVersionRejectsInvalid(t *testing.T) {
+	for _, version := range []string{"", "five", "5.3.8.1", "5.-1", "5.3.8-"} {
+		if _, err := parseVersion(version); nil == err {
+			t.Errorf("Expected %q not to parse", version)
+		}
+	}
+}
+
+func TestCheckVersionPolicy(t *testing.T) {
+	policy := platformPolicy{
+		Minimum:    "5.3.0",
+		Deprecated: "5.5.0",
+		Blocked:    []string{"5.6.1"},
+		Message:    "Please update Folktells",
+		StoreURL:   "https://apps.apple.com/app/folktells",
+	}
+	cases := map[string]string{
+		"5.2.9":       versionBlocked,
+		"5.3.0-beta":  versionBlocked,
+		"5.3.0":       versionDeprecated,
+		"5.4.7":       versionDeprecated,
+		"5.5.0":       versionSupported,
+		"5.6.1":       versionBlocked,
+		"5.6.2":       versionSupported,
+		"5.10.0":      versionSupported,
+		"not-a-build": versionBlocked,
+	}
+	for version, level := range cases {
+		response := checkVersion(policy, version)
+		if response.Level != level {
+			t.Errorf("Expected %s to be %s, was %s", version, level, response.Level)
+		}
+		if (response.Status == 1) != (level == versionBlocked) {
+			t.Errorf("Expected status of %s to be 1 only when blocked, was %d", version, response.Status)
+		}
+		if level != versionSupported && response.StoreURL != policy.StoreURL {
+			t.Errorf("Expected %s to be sent to the store", version)
+		}
+	}
+}
+
+func TestPolicyForPlatform(t *testing.T) {
+	policy := versionPolicy{
+		Default:   platformPolicy{Minimum: "5.3.0"},
+		Platforms: map[string]platformPolicy{"android": {Minimum: "5.4.0"}},
+	}
+	if policy.forPlatform("Android").Minimum != "5.4.0" {
+		t.Errorf("Expected the android policy")
+	}
+	if policy.forPlatform("").Minimum != "5.3.0" {
+		t.Errorf("Expected the default policy")
+	}
+}
+
+func testBatch(events ...string) analyticsBatch {
+	batch := analyticsBatch{SchemaVersion: 1}
+	for _, event := range events {
+		batch.Events = append(batch.Events, json.RawMessage(event))
+	}
+	return batch
+}
+
+func TestValidateBatchEvents(t *testing.T) {
+	now := time.Unix(1656000000, 0)
+	at := strconv.FormatInt(now.Unix()*1000, 10)
+	batch := testBatch(
+		`{"eventId":"e1","name":"story_viewed","timestamp":`+at+`,"properties":{"storyId":"s1","seconds":12,"shared":true}}`,
+		`{"eventId":"e2","name":"Story Viewed","timestamp":`+at+`}`,
+		`{"eventId":"e3","name":"story_viewed","timestamp":`+at+`,"extra":1}`,
+		`{"eventId":"e4","name":"story_viewed","timestamp":1}`,
+		`{"eventId":"e5","name":"story_viewed","timestamp":`+at+`,"properties":{"nested":{"a":1}}}`,
+		`{"name":"story_viewed","timestamp":`+at+`}`,
+	)
+	results, records, err := validateBatch(batch, now)
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := []string{eventAccepted, eventRejected, eventRejected, eventRejected, eventRejected, eventRejected}
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Errorf("Expected event %d to be %s, was %s (%s)", i, status, results[i].Status, results[i].Error)
+		}
+	}
+	if len(records) != 1 || records[0].index != 0 {
+		t.Fatalf("Expected one record for the first event, was %v", records)
+	}
+	var written map[string]interface{}
+	if err := json.Unmarshal(records[0].data, &written); nil != err {
+		t.Fatal(err)
+	}
+	if written["schemaVersion"] != float64(1) || written["receivedAt"] != float64(now.Unix()*1000) {
+		t.Errorf("Expected the record to carry the schema version and time received, was %v", written)
+	}
+}
+
+func TestValidateBatchLimits(t *testing.T) {
+	now := time.Now()
+	if _, _, err := validateBatch(analyticsBatch{SchemaVersion: 2, Events: []json.RawMessage{json.RawMessage(`{}`)}}, now); nil == err {
+		t.Errorf("Expected an unknown schema version to be refused")
+	}
+	if _, _, err := validateBatch(analyticsBatch{SchemaVersion: 1}, now); nil == err {
+		t.Errorf("Expected an empty batch to be refused")
+	}
+	batch := analyticsBatch{SchemaVersion: 1, Events: make([]json.RawMessage, maxBatchEvents+1)}
+	if _, _, err := validateBatch(batch, now); nil == err {
+		t.Errorf("Expected a batch over the limit to be refused")
+	}
+	big := `{"eventId":"e1","name":"big","timestamp":1,"properties":{"text":"` + strings.Repeat("x", maxEventBytes) + `"}}`
+	results, _, _ := validateBatch(testBatch(big), now)
+	if results[0].Status != eventRejected {
+		t.Errorf("Expected an event over the size limit to be rejected")
+	}
+}
+
+func TestValidateLegacyBodies(t *testing.T) {
+	for _, body := range []string{`{"name":"open"}`, `[{"name":"open"},{"name":"close"}]`} {
+		if err := validateLegacy([]byte(body)); nil != err {
+			t.Errorf("Expected %s to be accepted, was %v", body, err)
+		}
+	}
+	big := `{"text":"` + strings.Repeat("x", maxEventBytes) + `"}`
+	huge := "[" + strings.TrimSuffix(strings.Repeat(`{"name":"open"},`, maxLegacyBodyBytes/16+1), ",") + "]"
+	for _, body := range []string{`"text"`, `[]`, `[1]`, `[{"name":"open"},"text"]`, big, huge} {
+		if err := validateLegacy([]byte(body)); nil == err {
+			t.Errorf("Expected %.40s to be refused", body)
+		}
+	}
+}
+
+func TestDecodeGzipBody(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"schemaVersion":1}`))
+	writer.Close()
+	request := awsproxy.Request{
+		Body:            base64.StdEncoding.EncodeToString(compressed.Bytes()),
+		IsBase64Encoded: true,
+	}
+	body, err := decodeBody(request)
+	if nil != err || string(body) != `{"schemaVersion":1}` {
+		t.Errorf("Expected the body to be decoded, was %s %v", body, err)
+	}
+	compressed.Reset()
+	writer = gzip.NewWriter(&compressed)
+	writer.Write(bytes.Repeat([]byte(" "), maxBodyBytes+1))
+	writer.Close()
+	request.Body = base64.StdEncoding.EncodeToString(compressed.Bytes())
+	if _, err = decodeBody(request); nil == err {
+		t.Errorf("Expected a body over the limit once decoded to be refused")
+	}
+}
+
+// fakeBatcher fails each record the number of times set for it.
+type fakeBatcher struct {
+	failures map[string]int
+	calls    int
+	written  []string
+}
+
+func (f *fakeBatcher) PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	f.calls++
+	output := &firehose.PutRecordBatchOutput{}
+	for _, record := range params.Records {
+		entry := types.PutRecordBatchResponseEntry{}
+		if f.failures[string(record.Data)] > 0 {
+			f.failures[string(record.Data)]--
+			entry.ErrorCode = aws.String("ServiceUnavailableException")
+		} else {
+			f.written = append(f.written, string(record.Data))
+		}
+		output.RequestResponses = append(output.RequestResponses, entry)
+	}
+	return output, nil
+}
+
+func TestPutRecordsRetriesFailedRecords(t *testing.T) {
+	retryDelay = 0
+	client := &fakeBatcher{failures: map[string]int{"b": 1, "c": maxPutAttempts}}
+	errs := putRecords(context.Background(), client, "stream", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if nil != errs[0] || nil != errs[1] {
+		t.Errorf("Expected a and b to be written, was %v", errs)
+	}
+	if nil == errs[2] {
+		t.Errorf("Expected c to fail after %d attempts", maxPutAttempts)
+	}
+	if len(client.written) != 2 || client.calls != maxPutAttempts {
+		t.Errorf("Expected two records written in %d calls, was %v in %d", maxPutAttempts, client.written, client.calls)
+	}
+}
+
+func TestSplitBatchesWithinLimits(t *testing.T) {
+	records := make([][]byte, maxBatchRecords+2)
+	pending := make([]int, len(records))
+	for i := range records {
+		records[i] = []byte("x")
+		pending[i] = i
+	}
+	records[0] = make([]byte, maxBatchBytes)
+	batches := splitBatches(records, pending)
+	if len(batches) != 3 || len(batches[0]) != 1 || len(batches[1]) != maxBatchRecords || len(batches[2]) != 1 {
+		t.Errorf("Expected batches of 1, %d and 1 records, was %d batches", maxBatchRecords, len(batches))
+	}
+}
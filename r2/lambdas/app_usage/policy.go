@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// The outcome of a version check. Status stays 0 for a supported version,
+// deprecated ones included, and 1 for one that has to be updated, which is
+// what older apps look at.
+const (
+	versionSupported  = "supported"
+	versionDeprecated = "deprecated"
+	versionBlocked    = "blocked"
+)
+
+// policyCacheTime is how long a warm lambda keeps the policy before reading
+// the parameter again.
+const policyCacheTime = 5 * time.Minute
+
+// platformPolicy is the version policy for one platform. Versions before the
+// minimum, and the blocked versions, have to be updated. Versions before
+// deprecated still work but the app asks the user to update. The message and
+// store URL are shown with either.
+type platformPolicy struct {
+	Minimum    string   `json:"minimum"`
+	Deprecated string   `json:"deprecated"`
+	Blocked    []string `json:"blocked"`
+	Message    string   `json:"message"`
+	StoreURL   string   `json:"storeUrl"`
+}
+
+// versionPolicy holds a policy per platform, ios and android, with the
+// default used for any other platform or when none is given. It is kept as
+// JSON in the parameter named by versionPolicyParameter.
+type versionPolicy struct {
+	Default   platformPolicy            `json:"default"`
+	Platforms map[string]platformPolicy `json:"platforms"`
+}
+
+type versionCheckResponse struct {
+	Status   int    `json:"status"`
+	Level    string `json:"level"`
+	Minimum  string `json:"minimum,omitempty"`
+	Message  string `json:"message,omitempty"`
+	StoreURL string `json:"storeUrl,omitempty"`
+}
+
+// defaultPolicy is used until a policy is configured, it supports the
+// versions the back-end has always accepted and anything newer.
+var defaultPolicy = versionPolicy{
+	Default: platformPolicy{Minimum: "5.3.0"},
+}
+
+var policyCache struct {
+	sync.Mutex
+	policy   versionPolicy
+	loadedAt time.Time
+}
+
+// forPlatform picks the platform's policy.
+func (p versionPolicy) forPlatform(platform string) platformPolicy {
+	if policy, found := p.Platforms[strings.ToLower(platform)]; found {
+		return policy
+	}
+	return p.Default
+}
+
+// checkVersion applies the policy to the app's version. A version that cannot
+// be read is treated as needing an update.
+func checkVersion(policy platformPolicy, appVersion string) versionCheckResponse {
+	response := versionCheckResponse{Status: 0, Level: versionSupported, Minimum: policy.Minimum}
+	version, err := parseVersion(appVersion)
+	if nil != err {
+		return policy.respond(versionBlocked)
+	}
+	for _, blocked := range policy.Blocked {
+		if blockedVersion, err := parseVersion(blocked); nil == err && version.compare(blockedVersion) == 0 {
+			return policy.respond(versionBlocked)
+		}
+	}
+	if minimum, err := parseVersion(policy.Minimum); nil == err && version.compare(minimum) < 0 {
+		return policy.respond(versionBlocked)
+	}
+	if deprecated, err := parseVersion(policy.Deprecated); nil == err && version.compare(deprecated) < 0 {
+		return policy.respond(versionDeprecated)
+	}
+	return response
+}
+
+func (p platformPolicy) respond(level string) versionCheckResponse {
+	response := versionCheckResponse{Level: level, Minimum: p.Minimum, Message: p.Message, StoreURL: p.StoreURL}
+	if level == versionBlocked {
+		response.Status = 1
+	}
+	return response
+}
+
+// loadPolicy reads the policy from the parameter store, keeping it for
+// policyCacheTime. The default policy is used while no parameter is set, and
+// the last policy read, or the default, when it cannot be read.
+func loadPolicy(ftCtx awsproxy.FTContext) versionPolicy {
+	policyCache.Lock()
+	defer policyCache.Unlock()
+	if !policyCache.loadedAt.IsZero() && time.Since(policyCache.loadedAt) < policyCacheTime {
+		return policyCache.policy
+	}
+	if policyCache.loadedAt.IsZero() {
+		policyCache.policy = defaultPolicy
+	}
+	policy, err := readPolicy(ftCtx)
+	var notFound *ssmtypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		policy, err = defaultPolicy, nil
+	}
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Msg("version policy not loaded")
+		return policyCache.policy
+	}
+	policyCache.policy = policy
+	policyCache.loadedAt = time.Now()
+	return policy
+}
+
+func readPolicy(ftCtx awsproxy.FTContext) (versionPolicy, error) {
+	policy := versionPolicy{}
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return policy, err
+	}
+	name := os.Getenv("versionPolicyParameter")
+	if len(name) == 0 {
+		name = "/app/versionPolicy"
+	}
+	result, err := ssm.NewFromConfig(cfg).GetParameter(ftCtx.Context, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if nil != err {
+		return policy, err
+	}
+	if nil == result.Parameter || nil == result.Parameter.Value {
+		return defaultPolicy, nil
+	}
+	err = json.Unmarshal([]byte(*result.Parameter.Value), &policy)
+	return policy, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semanticVersion is a version as major.minor.patch with an optional
+// pre-release. Build metadata is ignored, as it is when comparing.
+type semanticVersion struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease []string
+}
+
+// parseVersion reads a semantic version. The app sends versions such as
+// 5.3.8 or 5.3.8+42, missing minor or patch numbers are taken as 0.
+func parseVersion(text string) (semanticVersion, error) {
+	version := semanticVersion{}
+	text = strings.TrimPrefix(strings.TrimSpace(text), "v")
+	if plus := strings.Index(text, "+"); plus >= 0 {
+		text = text[:plus]
+	}
+	if dash := strings.Index(text, "-"); dash >= 0 {
+		version.PreRelease = strings.Split(text[dash+1:], ".")
+		text = text[:dash]
+	}
+	parts := strings.Split(text, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return version, fmt.Errorf("version %s is not major.minor.patch", text)
+	}
+	numbers := []*int{&version.Major, &version.Minor, &version.Patch}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if nil != err || number < 0 {
+			return version, fmt.Errorf("version %s is not major.minor.patch", text)
+		}
+		*numbers[i] = number
+	}
+	for _, identifier := range version.PreRelease {
+		if len(identifier) == 0 {
+			return version, fmt.Errorf("version %s has an empty pre-release identifier", text)
+		}
+	}
+	return version, nil
+}
+
+// compare orders the versions by semantic version precedence, returning a
+// negative number when v comes before other, 0 when they are equal and a
+// positive number when it comes after.
+func (v semanticVersion) compare(other semanticVersion) int {
+	if v.Major != other.Major {
+		return v.Major - other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor - other.Minor
+	}
+	if v.Patch != other.Patch {
+		return v.Patch - other.Patch
+	}
+	// A pre-release comes before the release itself.
+	if len(v.PreRelease) == 0 || len(other.PreRelease) == 0 {
+		return len(other.PreRelease) - len(v.PreRelease)
+	}
+	for i := 0; i < len(v.PreRelease) && i < len(other.PreRelease); i++ {
+		if order := compareIdentifiers(v.PreRelease[i], other.PreRelease[i]); order != 0 {
+			return order
+		}
+	}
+	return len(v.PreRelease) - len(other.PreRelease)
+}
+
+// compareIdentifiers orders pre-release identifiers, numbers numerically and
+// before any text, text in ASCII order.
+func compareIdentifiers(a, b string) int {
+	aNumber, aErr := strconv.Atoi(a)
+	bNumber, bErr := strconv.Atoi(b)
+	switch {
+	case nil == aErr && nil == bErr:
+		return aNumber - bNumber
+	case nil == aErr:
+		return -1
+	case nil == bErr:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
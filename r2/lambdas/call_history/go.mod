@@ -0,0 +1,15 @@
+module github.com/sowens-csd/folktells-cloud-deploy/lambdas/call_history
+
+go 1.16
+
+require (
+	github.com/aws/aws-lambda-go v1.32.0
+	github.com/aws/aws-sdk-go-v2 v1.16.4
+	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.9.2
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.15.5
+	github.com/rs/zerolog v1.26.1 // indirect
+	github.com/sowens-csd/folktells-cloud-deploy/shared v0.0.0
+	github.com/sowens-csd/folktells-server v1.7.21
+)
+
+replace github.com/sowens-csd/folktells-cloud-deploy/shared => ../../shared
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/calls"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+const defaultHistoryLimit = 25
+const maxHistoryLimit = 100
+
+// historyPage is one page of calls, newest first. The page token is passed
+// back to get the next page and is empty on the last one. The missed count is
+// how many missed calls the user has not yet seen, for the app's badge.
+type historyPage struct {
+	Calls       []calls.HistoryEntry `json:"calls"`
+	MissedCount int                  `json:"missedCount"`
+	PageToken   string               `json:"pageToken,omitempty"`
+}
+
+// Handler lists the user's calls, or marks their missed calls as seen.
+//
+// GET call/history?limit={limit}&pageToken={pageToken}
+// PUT call/history/seen
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	if request.HTTPMethod == "PUT" {
+		seen, err := calls.MarkSeen(ftCtx, ftCtx.UserID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		ftCtx.RequestLogger.Debug().Int("calls", seen).Msg("missed calls seen")
+		return awsproxy.NewSuccessResponse(ftCtx), nil
+	}
+	limit := defaultHistoryLimit
+	if limitParam, found := request.QueryStringParameters["limit"]; found {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if nil != err || limit < 1 {
+			return awsproxy.HandleError(fmt.Errorf("limit must be a positive number, was %s", limitParam), ftCtx.RequestLogger), nil
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+	}
+	pageToken := request.QueryStringParameters["pageToken"]
+	if len(pageToken) > 0 && !strings.HasPrefix(pageToken, calls.HistoryPrefix) {
+		return awsproxy.HandleError(fmt.Errorf("pageToken is not valid"), ftCtx.RequestLogger), nil
+	}
+	page, err := loadHistory(ftCtx, limit, pageToken)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	unseen, err := calls.Unseen(ftCtx, ftCtx.UserID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	page.MissedCount = len(unseen)
+	return awsproxy.NewJSONResponse(ftCtx, page), nil
+}
+
+// loadHistory reads a page of calls after the one the page token names. The
+// token is the key of the last call on the previous page.
+func loadHistory(ftCtx awsproxy.FTContext, limit int, pageToken string) (historyPage, error) {
+	page := historyPage{Calls: []calls.HistoryEntry{}}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ftdb.GetTableName()),
+		KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :history)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId": ftdb.ResourceIDField,
+			"#refId": ftdb.ReferenceIDField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":resId":   &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ftCtx.UserID)},
+			":history": &types.AttributeValueMemberS{Value: calls.HistoryPrefix},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	}
+	if len(pageToken) > 0 {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ftCtx.UserID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: pageToken},
+		}
+	}
+	result, err := ftCtx.DBSvc.Query(ftCtx.Context, input)
+	if nil != err {
+		return page, err
+	}
+	err = attributevalue.UnmarshalListOfMaps(result.Items, &page.Calls)
+	if nil != err {
+		return page, err
+	}
+	if refID, ok := result.LastEvaluatedKey[ftdb.ReferenceIDField].(*types.AttributeValueMemberS); ok {
+		page.PageToken = refID.Value
+	}
+	return page, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
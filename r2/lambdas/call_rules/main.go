@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/calls"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+type callRule struct {
+	UserID    string `json:"userId"`
+	Rule      string `json:"rule"`
+	UpdatedAt int    `json:"updatedAt"`
+}
+
+// Handler lists and sets who may call the user beyond the people they share
+// a group with, the rules calls.CanCall checks. Allowing someone lets them look up and call the user without
+// sharing a group, blocking them stops them even if they do.
+//
+// GET call/rules
+// PUT call/rules/{userID} with {"rule": "allow"} or {"rule": "block"}
+// DELETE call/rules/{userID}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	rawUserID, found := request.PathParameters["userID"]
+	if !found {
+		rules, err := loadRules(ftCtx)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, rules), nil
+	}
+	userID, err := url.QueryUnescape(rawUserID)
+	if nil != err || len(userID) == 0 || userID == ftCtx.UserID {
+		return awsproxy.HandleError(fmt.Errorf("userID must be another user"), ftCtx.RequestLogger), nil
+	}
+	if request.HTTPMethod == "DELETE" {
+		err = removeRule(ftCtx, userID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewSuccessResponse(ftCtx), nil
+	}
+	var rule callRule
+	err = json.Unmarshal([]byte(request.Body), &rule)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if rule.Rule != calls.RuleAllow && rule.Rule != calls.RuleBlock {
+		return awsproxy.HandleError(fmt.Errorf("rule must be allow or block"), ftCtx.RequestLogger), nil
+	}
+	other, err := records.LoadItem(ftCtx, ftdb.ResourceIDFromUserID(userID), ftdb.ResourceIDFromUserID(userID))
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if len(other) == 0 {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such user"), nil
+	}
+	rule.UserID = userID
+	rule.UpdatedAt = int(time.Now().UTC().Unix() * 1000)
+	err = setRule(ftCtx, rule)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewJSONResponse(ftCtx, rule), nil
+}
+
+func loadRules(ftCtx awsproxy.FTContext) ([]callRule, error) {
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), calls.RuleReferencePrefix)
+	if nil != err {
+		return nil, err
+	}
+	rules := []callRule{}
+	for _, item := range items {
+		rules = append(rules, callRule{
+			UserID:    strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), calls.RuleReferencePrefix),
+			Rule:      records.StringAttribute(item, calls.RuleField),
+			UpdatedAt: records.NumberAttribute(item, "updatedAt"),
+		})
+	}
+	return rules, nil
+}
+
+func setRule(ftCtx awsproxy.FTContext, rule callRule) error {
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ftCtx.UserID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: calls.RuleReferencePrefix + rule.UserID},
+			calls.RuleField:       &types.AttributeValueMemberS{Value: rule.Rule},
+			"updatedAt":           &types.AttributeValueMemberN{Value: strconv.Itoa(rule.UpdatedAt)},
+		},
+	})
+	return err
+}
+
+func removeRule(ftCtx awsproxy.FTContext, userID string) error {
+	return records.DeleteItem(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), calls.RuleReferencePrefix+userID)
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/calls"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/quiet"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// callRequest places a call. The call type is audio or video.
+type callRequest struct {
+	CalleeID string `json:"calleeId"`
+	CallType string `json:"callType"`
+}
+
+// placedCall is the new call along with the callee's peer ID to connect to,
+// and whether the callee's devices were rung. A callee in their quiet hours is
+// not rung unless the caller is one of their emergency contacts, the call
+// still reaches their connected devices.
+type placedCall struct {
+	calls.Session
+	CalleePeerID string `json:"calleePeerId"`
+	Alert        string `json:"alert"`
+}
+
+// Handler places calls and moves them on. Placing a call rings the callee by
+// push, and both parties' connected devices hear about every change of state
+// over the websocket. This replaces the call flag of p2p/lookup. Only users
+// calls.CanCall allows can be called, and callers are limited by
+// calls.TakeAlert.
+//
+// POST call
+// GET call lists the calls ringing the user
+// GET call/{sessionID}
+// PUT call/{sessionID}/{action} where the action is accept, decline, cancel or end
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	sessionID, found := request.PathParameters["sessionID"]
+	if !found {
+		if request.HTTPMethod == http.MethodGet {
+			return listRinging(ftCtx), nil
+		}
+		return placeCall(ftCtx, request.Body), nil
+	}
+	session, err := calls.Load(ftCtx, sessionID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if nil == session || (ftCtx.UserID != session.CallerID && ftCtx.UserID != session.CalleeID) {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such call"), nil
+	}
+	action, found := request.PathParameters["action"]
+	if !found {
+		return awsproxy.NewJSONResponse(ftCtx, session), nil
+	}
+	return takeAction(ftCtx, session, action), nil
+}
+
+func placeCall(ftCtx awsproxy.FTContext, body string) awsproxy.Response {
+	var call callRequest
+	err := json.Unmarshal([]byte(body), &call)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if len(call.CalleeID) == 0 || call.CalleeID == ftCtx.UserID {
+		return awsproxy.HandleError(fmt.Errorf("calleeId must be another user"), ftCtx.RequestLogger)
+	}
+	call.CallType = strings.ToLower(call.CallType)
+	if call.CallType != "audio" && call.CallType != "video" {
+		return awsproxy.HandleError(fmt.Errorf("callType must be audio or video"), ftCtx.RequestLogger)
+	}
+	allowed, err := calls.CanCall(ftCtx, call.CalleeID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !allowed {
+		return awsproxy.NewForbiddenResponse(ftCtx, "You cannot call this user")
+	}
+	err = calls.TakeAlert(ftCtx)
+	if calls.ErrRateLimited == err {
+		return calls.NewRateLimitedResponse(ftCtx)
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	callee, err := sharing.LoadOnlineUser(ftCtx, call.CalleeID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	now := int(time.Now().UTC().Unix() * 1000)
+	session := calls.Session{
+		SessionID:  uuid.NewV4().String(),
+		CallerID:   ftCtx.UserID,
+		CallerName: userName(ftCtx, ftCtx.UserID),
+		CalleeID:   call.CalleeID,
+		CalleeName: userName(ftCtx, call.CalleeID),
+		CallType:   call.CallType,
+		State:      calls.StateRinging,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	err = calls.Save(ftCtx, session)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	alert, err := ring(ftCtx, session, callee)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("session", session.SessionID).Msg("ring not pushed")
+	}
+	err = calls.NotifyParticipants(ftCtx, session)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("session", session.SessionID).Msg("call state not sent")
+	}
+	return awsproxy.NewJSONResponse(ftCtx, placedCall{Session: session, CalleePeerID: callee.CallPeerId, Alert: alert})
+}
+
+// ring pushes the call to the callee's devices. The alert only has a title
+// and body, so the session ID goes at the end of the title as
+// [call:{sessionID}] for the app to read when the alert is opened. A ring
+// cannot wait, so in the callee's quiet hours it is suppressed.
+func ring(ftCtx awsproxy.FTContext, session calls.Session, callee *sharing.OnlineUser) (string, error) {
+	callerName := session.CallerName
+	if len(callerName) == 0 {
+		callerName = "someone"
+	}
+	title := fmt.Sprintf("Folktells %s%s Call", strings.ToUpper(session.CallType[:1]), session.CallType[1:]) + " " + ringTag(session.SessionID)
+	body := fmt.Sprintf("Call from %s", callerName)
+	return quiet.SendAlert(ftCtx, session.CalleeID, callee, title, body, false, &http.Client{Timeout: 30 * time.Second})
+}
+
+// ringTag marks the call's session in a ring alert.
+func ringTag(sessionID string) string {
+	return "[call:" + sessionID + "]"
+}
+
+// listRinging lists the calls still ringing the user, newest first.
+func listRinging(ftCtx awsproxy.FTContext) awsproxy.Response {
+	items, err := records.QueryPrefix(ftCtx, calls.CalleeRingingResourceID(ftCtx.UserID), calls.SessionPrefix)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	sessions := []calls.Session{}
+	for _, item := range items {
+		session, err := calls.Load(ftCtx, strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), calls.SessionPrefix))
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+		if nil != session && session.State == calls.StateRinging {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt > sessions[j].CreatedAt })
+	return awsproxy.NewJSONResponse(ftCtx, sessions)
+}
+
+// takeAction moves the call on. If someone else moved it first the call is
+// returned as it now is, with a conflict.
+func takeAction(ftCtx awsproxy.FTContext, session *calls.Session, action string) awsproxy.Response {
+	now := int(time.Now().UTC().Unix() * 1000)
+	state, err := calls.NextState(*session, ftCtx.UserID, action, now)
+	if calls.ErrNotParticipant == err {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Only the other party can do that")
+	}
+	if nil != err {
+		return awsproxy.HandleError(fmt.Errorf("call is %s, cannot %s", session.State, action), ftCtx.RequestLogger)
+	}
+	err = calls.ChangeState(ftCtx, session, state, now)
+	if calls.ErrStateChanged == err {
+		current, err := calls.Load(ftCtx, session.SessionID)
+		if nil != err || nil == current {
+			return awsproxy.HandleError(fmt.Errorf("call changed state before it could %s", action), ftCtx.RequestLogger)
+		}
+		return newConflictResponse(ftCtx, *current)
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	err = calls.NotifyParticipants(ftCtx, *session)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("session", session.SessionID).Msg("call state not sent")
+	}
+	return awsproxy.NewJSONResponse(ftCtx, session)
+}
+
+func newConflictResponse(ftCtx awsproxy.FTContext, current calls.Session) awsproxy.Response {
+	body, err := json.Marshal(current)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.Response{
+		StatusCode:      http.StatusConflict,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+func userName(ftCtx awsproxy.FTContext, userID string) string {
+	resID := ftdb.ResourceIDFromUserID(userID)
+	item, err := records.LoadItem(ftCtx, resID, resID)
+	if nil != err {
+		return ""
+	}
+	return records.StringAttribute(item, ftdb.NameField)
+}
+
+func main() {
+	lambda.Start(Handler)
+}
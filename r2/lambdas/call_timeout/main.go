@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/calls"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs every minute and marks the calls that have rung for longer
+// than calls.RingTimeout as missed, telling both parties. A call that cannot be
+// updated is logged and tried again on the next run.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	now := int(time.Now().UTC().Unix() * 1000)
+	cutoff := now - int(calls.RingTimeout/time.Millisecond)
+	items, err := records.QueryPrefix(ftCtx, calls.RingingResourceID, calls.SessionPrefix)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Msg("ringing calls query failed")
+		return err
+	}
+	missed := 0
+	for _, item := range items {
+		if records.NumberAttribute(item, "createdAt") > cutoff {
+			continue
+		}
+		sessionID := strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), calls.SessionPrefix)
+		session, err := timeOut(ftCtx, sessionID, records.StringAttribute(item, "calleeId"), now)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("session", sessionID).Msg("call not timed out")
+			continue
+		}
+		if nil == session {
+			continue
+		}
+		missed++
+		err = calls.NotifyParticipants(ftCtx, *session)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("session", session.SessionID).Msg("call state not sent")
+		}
+	}
+	ftCtx.RequestLogger.Info().Int("missed", missed).Msg("unanswered calls timed out")
+	return nil
+}
+
+// timeOut marks the call missed. No call is returned when it had already
+// stopped ringing, it is just taken off the ringing list.
+func timeOut(ftCtx awsproxy.FTContext, sessionID, calleeID string, now int) (*calls.Session, error) {
+	session, err := calls.Load(ftCtx, sessionID)
+	if nil != err {
+		return nil, err
+	}
+	if nil == session || session.State != calls.StateRinging {
+		return nil, calls.ForgetRinging(ftCtx, sessionID, calleeID)
+	}
+	state, err := calls.NextState(*session, "", calls.ActionTimeout, now)
+	if nil != err {
+		return nil, err
+	}
+	err = calls.ChangeState(ftCtx, session, state, now)
+	if calls.ErrStateChanged == err {
+		return nil, calls.ForgetRinging(ftCtx, sessionID, calleeID)
+	}
+	if nil != err {
+		return nil, err
+	}
+	return session, nil
+}
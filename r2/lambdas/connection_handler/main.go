@@ -5,8 +5,8 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
 	"github.com/sowens-csd/folktells-server/awsproxy"
-	"github.com/sowens-csd/folktells-server/messaging"
 	"github.com/sowens-csd/folktells-server/notification"
 )
 
@@ -15,7 +15,8 @@ func main() {
 }
 
 // handler receives a synchronous invocation from API Gateway when a WebSocket connection is opened for the
-// application's API.
+// application's API. The app passes its device ID as the deviceId query parameter so that broadcasts reach
+// each device once however many times it has reconnected.
 func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (awsproxy.Response, error) {
 
 	ftCtx, errResp := awsproxy.NewFromWebsocketContextAndJWT(ctx, request)
@@ -27,9 +28,27 @@ func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
 	ftCtx.RequestLogger.Debug().Str("user", ftCtx.UserID).Str("domain", request.RequestContext.DomainName).Str("connection", request.RequestContext.ConnectionID).Msg("Connection handler called")
-	err = messaging.RecordConnection(ftCtx, request.RequestContext.ConnectionID)
+	err = sockets.Record(ftCtx, request.RequestContext.ConnectionID, request.QueryStringParameters["deviceId"], request.RequestContext.DomainName, request.RequestContext.Stage)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
+	presence, changed, err := sockets.SetOnline(ftCtx, ftCtx.UserID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if changed {
+		err = notifyPresence(ftCtx, presence)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Msg("presence change not sent")
+		}
+	}
 	return awsproxy.NewSuccessResponse(ftCtx), nil
 }
+
+func notifyPresence(ftCtx awsproxy.FTContext, presence sockets.Presence) error {
+	poster, err := sockets.NewPoster(ftCtx)
+	if nil != err {
+		return err
+	}
+	return sockets.NotifyPresence(ftCtx, poster, presence)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/quiet"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/notification"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs every five minutes and sends the alerts that were held until
+// their recipient's quiet hours ended. An alert that cannot be sent is logged
+// and dropped, it is already late.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	// The reference IDs sort by the time each alert is due, everything before
+	// the next millisecond is due now.
+	due := fmt.Sprintf("%s%013d", quiet.DelayedPrefix, int(time.Now().UTC().Unix()*1000)+1)
+	client := &http.Client{Timeout: 30 * time.Second}
+	sent := 0
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+			TableName:              aws.String(ftdb.GetTableName()),
+			KeyConditionExpression: aws.String("#resId = :resId AND #refId < :due"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":resId": &types.AttributeValueMemberS{Value: quiet.DelayedResourceID},
+				":due":   &types.AttributeValueMemberS{Value: due},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Msg("delayed alerts query failed")
+			return err
+		}
+		for _, item := range result.Items {
+			referenceID, _ := item[ftdb.ReferenceIDField].(*types.AttributeValueMemberS)
+			if nil == referenceID {
+				continue
+			}
+			var alert quiet.DelayedAlert
+			err = attributevalue.UnmarshalMap(item, &alert)
+			if nil == err {
+				err = sendAlert(ftCtx, alert, client)
+			}
+			if nil != err {
+				ftCtx.RequestLogger.Error().Err(err).Str("alert", referenceID.Value).Msg("delayed alert not sent")
+			} else {
+				sent++
+			}
+			err = deleteItem(ftCtx, quiet.DelayedResourceID, referenceID.Value)
+			if nil != err {
+				ftCtx.RequestLogger.Error().Err(err).Str("alert", referenceID.Value).Msg("delayed alert not removed")
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	ftCtx.RequestLogger.Info().Int("sent", sent).Msg("delayed alerts sent")
+	return nil
+}
+
+// sendAlert sends the alert as its sender, the same as it would have been
+// without the delay.
+func sendAlert(ftCtx awsproxy.FTContext, alert quiet.DelayedAlert, client *http.Client) error {
+	senderCtx := awsproxy.NewFromContext(ftCtx.Context, alert.SenderID)
+	user, err := sharing.LoadOnlineUser(senderCtx, alert.RecipientID)
+	if nil != err {
+		return err
+	}
+	return notification.SendAlert(senderCtx, alert.Title, alert.Body, user, client)
+}
+
+func deleteItem(ftCtx awsproxy.FTContext, resourceID, referenceID string) error {
+	_, err := ftCtx.DBSvc.DeleteItem(ftCtx.Context, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: referenceID},
+		},
+	})
+	return err
+}
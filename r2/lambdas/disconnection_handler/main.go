@@ -5,8 +5,8 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
 	"github.com/sowens-csd/folktells-server/awsproxy"
-	"github.com/sowens-csd/folktells-server/messaging"
 	"github.com/sowens-csd/folktells-server/notification"
 )
 
@@ -28,7 +28,11 @@ func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 	}
 	// err := redis.Client.Do(radix.Cmd(&result, "SADD", "connections", req.RequestContext.ConnectionID))
 	ftCtx.RequestLogger.Debug().Str("user", ftCtx.UserID).Str("connection", request.RequestContext.ConnectionID).Msg("Disconnection handler called")
-	err = messaging.RemoveConnection(ftCtx, ftCtx.UserID, request.RequestContext.ConnectionID)
+	poster, err := sockets.NewPoster(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	err = sockets.Drop(ftCtx, poster, ftCtx.UserID, request.RequestContext.ConnectionID)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/broadcast"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// broadcastRequest is the event to send to the group. The event is passed on
+// to the app as is. The alert is what is pushed to the other members, reaching
+// their devices without a connection, without one they are not pushed to.
+// Sending again with the same event ID only reaches the devices that did not
+// get it the first time.
+type broadcastRequest struct {
+	EventID string           `json:"eventId"`
+	Event   json.RawMessage  `json:"event"`
+	Alert   *broadcast.Alert `json:"alert,omitempty"`
+}
+
+// broadcastEvent is what each connected device receives.
+type broadcastEvent struct {
+	Action string             `json:"action"`
+	Data   broadcastEventData `json:"data"`
+}
+
+type broadcastEventData struct {
+	EventID string          `json:"eventId"`
+	GroupID string          `json:"groupId"`
+	From    string          `json:"from"`
+	SentAt  int             `json:"sentAt"`
+	Event   json.RawMessage `json:"event"`
+}
+
+// Handler sends an event to every device of every member of the group, over
+// the websocket to each connected device and by push to each other member.
+// The response reports what happened for each member.
+//
+// POST group/{groupID}/broadcast
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	groupID, err := url.QueryUnescape(request.PathParameters["groupID"])
+	if nil != err || len(groupID) == 0 {
+		return awsproxy.HandleError(fmt.Errorf("groupID path parameter missing"), ftCtx.RequestLogger), nil
+	}
+	var sent broadcastRequest
+	err = json.Unmarshal([]byte(request.Body), &sent)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if len(sent.Event) == 0 {
+		return awsproxy.HandleError(fmt.Errorf("event missing"), ftCtx.RequestLogger), nil
+	}
+	if len(sent.EventID) == 0 {
+		sent.EventID = uuid.NewV4().String()
+	}
+	member, err := records.IsGroupMember(ftCtx, groupID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if !member {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Not a member of the group"), nil
+	}
+	data, err := json.Marshal(broadcastEvent{
+		Action: "broadcast",
+		Data: broadcastEventData{
+			EventID: sent.EventID,
+			GroupID: groupID,
+			From:    ftCtx.UserID,
+			SentAt:  int(time.Now().UTC().Unix() * 1000),
+			Event:   sent.Event,
+		},
+	})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	report, err := broadcast.Send(ftCtx, broadcast.Event{
+		ID:      sent.EventID,
+		GroupID: groupID,
+		Data:    data,
+		Alert:   sent.Alert,
+	}, &http.Client{Timeout: 30 * time.Second})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewJSONResponse(ftCtx, report), nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -2,25 +2,107 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	ftlambdas "github.com/sowens-csd/folktells-server"
 	"github.com/sowens-csd/folktells-server/awsproxy"
 )
 
-// Handler is our lambda handler invoked by the `lambda.Start` function call
+// storyUpdate is a story update request, the story and the group it is
+// shared with.
+type storyUpdate struct {
+	GroupID     string      `json:"groupId"`
+	SharedStory sharedStory `json:"sharedStory"`
+}
+
+// conflictResponse is returned with a 409 when the update was based on a
+// version of the story that is no longer current. The client should merge its
+// changes into Current and resubmit with Current.Version as the baseVersion.
+type conflictResponse struct {
+	Message string      `json:"message"`
+	Current sharedStory `json:"current"`
+}
+
+// Handler updates a story and notifies the group it is shared with, or with a
+// storyID path parameter lists or restores the earlier revisions of a story.
+//
+// An update is rejected with a 409 if its baseVersion is not the version
+// currently stored, and with a 404 if the story is in the trash. The version
+// being replaced is kept as a revision. Every
+// saved version is added to the search index.
+//
+// The story is written conditionally on its version so that of two updates
+// based on the same version only one is saved, the group is then told about
+// the saved version, see notifyStory. The response is the story as saved.
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
 	if nil != errResp {
 		return *errResp, nil
 	}
-	updateResult, err := ftlambdas.UpdateStoryAndNotify(ftCtx, request.Body, &http.Client{Timeout: 30 * time.Second})
+	if _, found := request.PathParameters["storyID"]; found {
+		return handleRevisions(ftCtx, request), nil
+	}
+	var update storyUpdate
+	err := json.Unmarshal([]byte(request.Body), &update)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	story := update.SharedStory
+	story.GroupID = update.GroupID
+	replaced, err := writeStory(ftCtx, story)
+	if errStoryDeleted == err {
+		return newDeletedResponse(ftCtx, story.StoryID), nil
+	}
+	if errVersionConflict == err {
+		current, _, err := loadStory(ftCtx, story.GroupID, story.StoryID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		ftCtx.RequestLogger.Info().Str("story", current.StoryID).Str("version", current.Version).Str("baseVersion", story.BaseVersion).Msg("story version conflict")
+		return newConflictResponse(ftCtx, current), nil
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if nil != replaced {
+		story.CreatedBy = replaced.CreatedBy
+	}
+	if nil != replaced && replaced.Version != story.Version {
+		err = saveRevision(ftCtx, *replaced)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+	}
+	err = notifyStory(ftCtx, story)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
-	return awsproxy.NewJSONResponse(ftCtx, updateResult), nil
+	indexStory(ftCtx, story)
+	return awsproxy.NewJSONResponse(ftCtx, story), nil
+}
+
+func newConflictResponse(ftCtx awsproxy.FTContext, current sharedStory) awsproxy.Response {
+	body, err := json.Marshal(conflictResponse{
+		Message: fmt.Sprintf("Story %s has been changed, current version is %s", current.StoryID, current.Version),
+		Current: current,
+	})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.Response{
+		StatusCode:      http.StatusConflict,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+func newDeletedResponse(ftCtx awsproxy.FTContext, storyID string) awsproxy.Response {
+	return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("Story %s is in the trash", storyID))
 }
 
 func main() {
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/broadcast"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+const storyAlertTitle = "Folktells"
+const storyUpdatedAction = "storyUpdated"
+
+// storyEvent tells the devices of the group's members that a story was
+// saved, with the story as saved.
+type storyEvent struct {
+	Action string      `json:"action"`
+	Data   sharedStory `json:"data"`
+}
+
+// notifyStory tells the group about a story version already saved by
+// writeStory, the story itself is not written again. The members' connected
+// devices get the story and the other members are pushed to, each according
+// to their quiet hours. Telling the group about the same version
+// again only reaches the devices that missed it, so a retried update does not
+// notify twice.
+func notifyStory(ftCtx awsproxy.FTContext, story sharedStory) error {
+	data, err := json.Marshal(storyEvent{Action: storyUpdatedAction, Data: story})
+	if nil != err {
+		return err
+	}
+	_, err = broadcast.Send(ftCtx, broadcast.Event{
+		ID:      storyReferenceID(story.StoryID) + "#" + story.Version,
+		GroupID: story.GroupID,
+		Data:    data,
+		Alert: &broadcast.Alert{
+			Title: storyAlertTitle,
+			Body:  fmt.Sprintf("%s shared a story", broadcast.SenderName(ftCtx)),
+		},
+	}, &http.Client{Timeout: 30 * time.Second})
+	return err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/search"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// maxStoryRevisions is how many earlier versions of a story are kept, older
+// revisions are removed as new ones are saved.
+const maxStoryRevisions = 20
+
+// revisionReferencePrefix marks a revision within a story,
+// R#{lastUpdated}#{version} with lastUpdated zero padded so that revisions
+// sort oldest first. The version keeps two revisions saved in the same
+// millisecond apart.
+const revisionReferencePrefix = "R#"
+
+// deletedAtField marks a story moved to the trash, it cannot be edited until
+// it is restored.
+const deletedAtField = "deletedAt"
+
+var errVersionConflict = errors.New("story has been changed")
+var errStoryDeleted = errors.New("story is in the trash")
+
+// sharedStory is a story as stored in a group, S#{storyID} under G#{groupID}.
+type sharedStory struct {
+	GroupID       string `json:"groupId" dynamodbav:"groupId"`
+	StoryID       string `json:"id" dynamodbav:"storyId"`
+	Content       string `json:"content" dynamodbav:"content"`
+	Version       string `json:"version" dynamodbav:"version"`
+	BaseVersion   string `json:"baseVersion" dynamodbav:"baseVersion"`
+	LastUpdated   int    `json:"lastUpdated" dynamodbav:"lastUpdated"`
+	LastUpdatedBy string `json:"lastUpdatedBy" dynamodbav:"lastUpdatedBy"`
+	StorySource   string `json:"storySource" dynamodbav:"storySource"`
+	CreatedBy     string `json:"createdBy,omitempty" dynamodbav:"createdBy,omitempty"`
+	DeletedAt     int    `json:"deletedAt,omitempty" dynamodbav:"-"`
+	ReferenceID   string `json:"-" dynamodbav:"-"`
+}
+
+// storyRevisions lists the saved revisions of a story, oldest first.
+type storyRevisions struct {
+	StoryID   string        `json:"id"`
+	Revisions []sharedStory `json:"revisions"`
+}
+
+// handleRevisions lists the revisions of a story, or with a version path
+// parameter restores that revision as the current story.
+//
+// GET story/{storyID}/revisions?groupId={groupID}
+// POST story/{storyID}/revisions/{version}?groupId={groupID}
+func handleRevisions(ftCtx awsproxy.FTContext, request awsproxy.Request) awsproxy.Response {
+	storyID, err := url.PathUnescape(request.PathParameters["storyID"])
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	groupID := request.QueryStringParameters["groupId"]
+	if len(groupID) == 0 {
+		return awsproxy.HandleError(fmt.Errorf("groupId is required"), ftCtx.RequestLogger)
+	}
+	member, err := records.IsGroupMember(ftCtx, groupID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !member {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Only group members can see story revisions.")
+	}
+	revisions, err := loadRevisions(ftCtx, groupID, storyID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	version, found := request.PathParameters["version"]
+	if !found {
+		return awsproxy.NewJSONResponse(ftCtx, storyRevisions{StoryID: storyID, Revisions: revisions})
+	}
+	for _, revision := range revisions {
+		if revision.Version == version {
+			restored, err := restoreRevision(ftCtx, revision)
+			if errStoryDeleted == err {
+				return newDeletedResponse(ftCtx, storyID)
+			}
+			if errVersionConflict == err {
+				current, _, err := loadStory(ftCtx, groupID, storyID)
+				if nil != err {
+					return awsproxy.HandleError(err, ftCtx.RequestLogger)
+				}
+				return newConflictResponse(ftCtx, current)
+			}
+			if nil != err {
+				return awsproxy.HandleError(err, ftCtx.RequestLogger)
+			}
+			return awsproxy.NewJSONResponse(ftCtx, restored)
+		}
+	}
+	return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("No revision %s for story %s", version, storyID))
+}
+
+// loadStory reads the story as currently stored, found is false if the story
+// has not been saved yet.
+func loadStory(ftCtx awsproxy.FTContext, groupID, storyID string) (sharedStory, bool, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(groupID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: storyReferenceID(storyID)},
+		},
+	})
+	if nil != err {
+		return sharedStory{}, false, err
+	}
+	if len(result.Item) == 0 {
+		return sharedStory{}, false, nil
+	}
+	return storyFromItem(groupID, storyID, result.Item), true, nil
+}
+
+func storyFromItem(groupID, storyID string, item map[string]types.AttributeValue) sharedStory {
+	return sharedStory{
+		GroupID:       groupID,
+		StoryID:       storyID,
+		Content:       stringAttribute(item, ftdb.ContentField),
+		Version:       stringAttribute(item, ftdb.VersionField),
+		BaseVersion:   stringAttribute(item, ftdb.BaseVersionField),
+		LastUpdated:   numberAttribute(item, ftdb.LastUpdatedField),
+		LastUpdatedBy: stringAttribute(item, ftdb.LastUpdatedByField),
+		StorySource:   stringAttribute(item, ftdb.StorySourceField),
+		CreatedBy:     stringAttribute(item, search.AuthorField),
+		DeletedAt:     numberAttribute(item, deletedAtField),
+	}
+}
+
+// writeStory saves the story if it is new, or if the stored version is its
+// base version, failing with errVersionConflict otherwise. Saving the version
+// already stored again is a retry and succeeds. A story in the trash is not
+// saved, failing with errStoryDeleted. The story it replaced is returned, nil
+// for a new story. Whoever first saves the story is kept as its author.
+func writeStory(ftCtx awsproxy.FTContext, story sharedStory) (*sharedStory, error) {
+	result, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(story.GroupID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: storyReferenceID(story.StoryID)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#deletedAt) AND (attribute_not_exists(#version) OR #version = :baseVersion OR #version = :version)"),
+		UpdateExpression:    aws.String("SET #id = :id, #content = :content, #version = :version, #baseVersion = :baseVersion, #lastUpdated = :lastUpdated, #lastUpdatedBy = :lastUpdatedBy, #storySource = :storySource, #createdBy = if_not_exists(#createdBy, :lastUpdatedBy)"),
+		ExpressionAttributeNames: map[string]string{
+			"#id":            ftdb.IDField,
+			"#content":       ftdb.ContentField,
+			"#version":       ftdb.VersionField,
+			"#baseVersion":   ftdb.BaseVersionField,
+			"#lastUpdated":   ftdb.LastUpdatedField,
+			"#lastUpdatedBy": ftdb.LastUpdatedByField,
+			"#storySource":   ftdb.StorySourceField,
+			"#createdBy":     search.AuthorField,
+			"#deletedAt":     deletedAtField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":            &types.AttributeValueMemberS{Value: story.StoryID},
+			":content":       &types.AttributeValueMemberS{Value: story.Content},
+			":version":       &types.AttributeValueMemberS{Value: story.Version},
+			":baseVersion":   &types.AttributeValueMemberS{Value: story.BaseVersion},
+			":lastUpdated":   &types.AttributeValueMemberN{Value: strconv.Itoa(story.LastUpdated)},
+			":lastUpdatedBy": &types.AttributeValueMemberS{Value: story.LastUpdatedBy},
+			":storySource":   &types.AttributeValueMemberS{Value: story.StorySource},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		current, _, err := loadStory(ftCtx, story.GroupID, story.StoryID)
+		if nil != err {
+			return nil, err
+		}
+		if current.DeletedAt > 0 {
+			return nil, errStoryDeleted
+		}
+		return nil, errVersionConflict
+	}
+	if nil != err {
+		return nil, err
+	}
+	if len(result.Attributes) == 0 {
+		return nil, nil
+	}
+	replaced := storyFromItem(story.GroupID, story.StoryID, result.Attributes)
+	return &replaced, nil
+}
+
+// saveRevision keeps a copy of a story version that is about to be replaced
+// and removes the oldest revisions beyond maxStoryRevisions.
+func saveRevision(ftCtx awsproxy.FTContext, story sharedStory) error {
+	err := ftdb.PutItem(ftCtx, storyResourceID(story.StoryID), revisionReferenceID(story.LastUpdated, story.Version), story)
+	if nil != err {
+		return err
+	}
+	revisions, err := loadRevisions(ftCtx, story.GroupID, story.StoryID)
+	if nil != err {
+		return err
+	}
+	for len(revisions) > maxStoryRevisions {
+		_, err := ftCtx.DBSvc.DeleteItem(ftCtx.Context, &dynamodb.DeleteItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Key: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: storyResourceID(story.StoryID)},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: revisions[0].ReferenceID},
+			},
+		})
+		if nil != err {
+			return err
+		}
+		revisions = revisions[1:]
+	}
+	return nil
+}
+
+// loadRevisions lists the revisions of the story saved in the group, a story
+// shared with several groups has revisions in each.
+func loadRevisions(ftCtx awsproxy.FTContext, groupID, storyID string) ([]sharedStory, error) {
+	result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+		TableName:              aws.String(ftdb.GetTableName()),
+		KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :revision)"),
+		FilterExpression:       aws.String("#groupId = :groupId"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId":   ftdb.ResourceIDField,
+			"#refId":   ftdb.ReferenceIDField,
+			"#groupId": "groupId",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":resId":    &types.AttributeValueMemberS{Value: storyResourceID(storyID)},
+			":revision": &types.AttributeValueMemberS{Value: revisionReferencePrefix},
+			":groupId":  &types.AttributeValueMemberS{Value: groupID},
+		},
+	})
+	if nil != err {
+		return nil, err
+	}
+	revisions := []sharedStory{}
+	err = attributevalue.UnmarshalListOfMaps(result.Items, &revisions)
+	if nil != err {
+		return nil, err
+	}
+	for i, item := range result.Items {
+		revisions[i].ReferenceID = stringAttribute(item, ftdb.ReferenceIDField)
+	}
+	return revisions, nil
+}
+
+// restoreRevision makes the content of an earlier revision the current story.
+// The restore is a new version based on the current one, saved and notified
+// to the group like any other edit, and the version it replaces becomes a
+// revision.
+func restoreRevision(ftCtx awsproxy.FTContext, revision sharedStory) (*sharedStory, error) {
+	current, found, err := loadStory(ftCtx, revision.GroupID, revision.StoryID)
+	if nil != err {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("Story %s no longer exists", revision.StoryID)
+	}
+	restored := revision
+	restored.ReferenceID = ""
+	restored.Version = uuid.NewV4().String()
+	restored.BaseVersion = current.Version
+	restored.LastUpdated = int(time.Now().UTC().Unix() * 1000)
+	restored.LastUpdatedBy = ftCtx.UserID
+	restored.CreatedBy = current.CreatedBy
+	replaced, err := writeStory(ftCtx, restored)
+	if nil != err {
+		return nil, err
+	}
+	if nil != replaced {
+		err = saveRevision(ftCtx, *replaced)
+		if nil != err {
+			return nil, err
+		}
+	}
+	err = notifyStory(ftCtx, restored)
+	if nil != err {
+		return nil, err
+	}
+	indexStory(ftCtx, restored)
+	ftCtx.RequestLogger.Info().Str("story", revision.StoryID).Str("from", revision.Version).Str("version", restored.Version).Msg("restored story revision")
+	return &restored, nil
+}
+
+// indexStory brings the search postings for a story up to date with its
+// content. Failing to index is logged rather than failing the story update,
+// the story is indexed again on its next edit.
+func indexStory(ftCtx awsproxy.FTContext, story sharedStory) {
+	author := story.CreatedBy
+	if len(author) == 0 {
+		author = story.LastUpdatedBy
+	}
+	err := search.Index(ftCtx, search.Story{
+		GroupID:       story.GroupID,
+		StoryID:       story.StoryID,
+		Content:       story.Content,
+		LastUpdated:   story.LastUpdated,
+		LastUpdatedBy: story.LastUpdatedBy,
+		Author:        author,
+	})
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("story", story.StoryID).Msg("story index update failed")
+	}
+}
+
+func storyReferenceID(storyID string) string {
+	return "S#" + storyID
+}
+
+func storyResourceID(storyID string) string {
+	return "S#" + storyID
+}
+
+func revisionReferenceID(lastUpdated int, version string) string {
+	return fmt.Sprintf("%s%013d#%s", revisionReferencePrefix, lastUpdated, version)
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func numberAttribute(item map[string]types.AttributeValue, name string) int {
+	if value, ok := item[name].(*types.AttributeValueMemberN); ok {
+		number, err := strconv.Atoi(value.Value)
+		if nil == err {
+			return number
+		}
+	}
+	return 0
+}
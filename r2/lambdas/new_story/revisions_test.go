@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRevisionsInSameMillisecondHaveDifferentKeys(t *testing.T) {
+	first := revisionReferenceID(1583440478299, "v1")
+	second := revisionReferenceID(1583440478299, "v2")
+	if first == second {
+		t.Errorf("Expected different keys, both were %s", first)
+	}
+	if revisionReferenceID(999, "v3") >= first {
+		t.Errorf("Expected older revisions to sort first")
+	}
+}
@@ -9,9 +9,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/calls"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/quiet"
 	"github.com/sowens-csd/folktells-server/awsproxy"
-	"github.com/sowens-csd/folktells-server/notification"
-	"github.com/sowens-csd/folktells-server/sharing"
 )
 
 // Handler is responsible for taking a signup request from a client that contains
@@ -20,6 +20,15 @@ import (
 // Client devices generate a token then use it to create an authentication record for
 // the external P2P service to use againt the p2p_authorizer endpoint. There is always
 // only one token active for a given client at a time.
+//
+// Only users calls.CanCall allows can be looked up, anyone else is reported as not
+// found so that lookups do not reveal who has an account.
+//
+// The call parameter, which rings the user as a side effect of the lookup, is
+// only kept for older versions of the app. Calls are placed through the call
+// session API, POST call, which also tracks them. A callee in their quiet
+// hours is not rung, the X-Alert-Outcome header on the response says whether
+// the ring was sent or suppressed.
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
 	if nil != errResp {
@@ -31,11 +40,15 @@ func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response,
 		if err != nil {
 			return awsproxy.HandleError(fmt.Errorf("Bad email encoding"), ftCtx.RequestLogger), nil
 		}
-		ou, err := sharing.LoadOnlineUserByEmail(ftCtx, email)
-		if err != nil {
+		ou, err := calls.FindCallableByEmail(ftCtx, email)
+		if nil != err {
 			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 		}
+		if nil == ou {
+			return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("No user with email %s", email)), nil
+		}
 		ftCtx.RequestLogger.Debug().Msg("Found the user")
+		alert := ""
 		callItParam, found := request.QueryStringParameters["call"]
 		if found {
 			ftCtx.RequestLogger.Debug().Msg("Call parameter found")
@@ -52,15 +65,32 @@ func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response,
 				if found {
 					callerName = nameParam
 				}
-				ftCtx.RequestLogger.Debug().Msg("sending alert")
-				notification.SendAlert(ftCtx, title, fmt.Sprintf("Call from %s", callerName), ou, &http.Client{Timeout: 30 * time.Second})
+				err = calls.TakeAlert(ftCtx)
+				if calls.ErrRateLimited == err {
+					return calls.NewRateLimitedResponse(ftCtx), nil
+				}
+				if nil != err {
+					return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+				}
+				body := fmt.Sprintf("Call from %s", callerName)
+				alert, err = quiet.SendAlert(ftCtx, ou.ID, ou, title, body, false, &http.Client{Timeout: 30 * time.Second})
+				if nil != err {
+					ftCtx.RequestLogger.Error().Err(err).Str("alert", alert).Msg("call alert not sent")
+				}
 			} else {
 				ftCtx.RequestLogger.Debug().Str("email", email).Bool("callIt", callIt).Msg("not valid request")
 			}
 		} else {
 			ftCtx.RequestLogger.Debug().Msg("Call parameter not found")
 		}
-		return awsproxy.NewTextResponse(ftCtx, ou.CallPeerId), nil
+		response := awsproxy.NewTextResponse(ftCtx, ou.CallPeerId)
+		if len(alert) > 0 {
+			if nil == response.Headers {
+				response.Headers = map[string]string{}
+			}
+			response.Headers["X-Alert-Outcome"] = alert
+		}
+		return response, nil
 	}
 	return awsproxy.HandleError(fmt.Errorf("Email path parameter missing"), ftCtx.RequestLogger), nil
 
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// maxPresenceUsers limits how many users one request can ask about.
+const maxPresenceUsers = 100
+
+// Handler reports whether each of the users is online, and when they were
+// last seen. Only users who share a group with the caller are reported, the
+// rest are left out of the response.
+//
+// GET presence?users={userID},{userID}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	userIDs := parseUserIDs(request.QueryStringParameters["users"])
+	if len(userIDs) == 0 {
+		return awsproxy.HandleError(fmt.Errorf("users parameter missing"), ftCtx.RequestLogger), nil
+	}
+	if len(userIDs) > maxPresenceUsers {
+		return awsproxy.HandleError(fmt.Errorf("at most %d users can be asked about", maxPresenceUsers), ftCtx.RequestLogger), nil
+	}
+	visible, err := visibleUserIDs(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	presences := []sockets.Presence{}
+	for _, userID := range userIDs {
+		if !visible[userID] {
+			continue
+		}
+		presence, err := sockets.LoadPresence(ftCtx, userID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		presences = append(presences, presence)
+	}
+	return awsproxy.NewJSONResponse(ftCtx, presences), nil
+}
+
+// parseUserIDs splits the comma separated list, dropping blanks and repeats.
+func parseUserIDs(param string) []string {
+	seen := map[string]bool{}
+	var userIDs []string
+	for _, userID := range strings.Split(param, ",") {
+		userID = strings.TrimSpace(userID)
+		if len(userID) > 0 && !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// visibleUserIDs is everyone in the caller's groups, including the caller.
+func visibleUserIDs(ftCtx awsproxy.FTContext) (map[string]bool, error) {
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	members, err := sockets.GroupMemberIDs(ftCtx, groups)
+	if nil != err {
+		return nil, err
+	}
+	visible := map[string]bool{ftCtx.UserID: true}
+	for _, memberID := range members {
+		visible[memberID] = true
+	}
+	return visible, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseUserIDsDropsBlanksAndRepeats(t *testing.T) {
+	userIDs := parseUserIDs(" a,b,,a , c")
+	if len(userIDs) != 3 || userIDs[0] != "a" || userIDs[1] != "b" || userIDs[2] != "c" {
+		t.Errorf("Expected [a b c], was %v", userIDs)
+	}
+}
+
+func TestParseUserIDsEmpty(t *testing.T) {
+	if userIDs := parseUserIDs(""); len(userIDs) != 0 {
+		t.Errorf("Expected no users, was %v", userIDs)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/quiet"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// maxEmergencyContacts keeps the list to the few people who really need to
+// get through.
+const maxEmergencyContacts = 20
+
+// Handler reads and sets the user's quiet hours. During them calls do not
+// ring the user's devices and other alerts are held back, delayed to the end
+// of the quiet hours when delay is set. The emergency contacts, user IDs, are
+// always let through. Calls still reach devices that are connected.
+//
+// Every alert is held through the shared quiet package: calls, group
+// broadcasts and the pushes for new and changed stories.
+// Events that only go to connected devices, such as a story moved to the
+// trash, do not wake anyone and are not held.
+//
+// GET user/quiet
+// PUT user/quiet with {"enabled": true, "timeZone": "America/Toronto",
+// "start": "22:00", "end": "07:00", "delay": true, "emergencyContacts": []}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	if request.HTTPMethod == "GET" {
+		settings, err := loadQuietHours(ftCtx)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, settings), nil
+	}
+	var settings quiet.Settings
+	err := json.Unmarshal([]byte(request.Body), &settings)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	err = validateQuietHours(&settings)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	for _, contactID := range settings.EmergencyContacts {
+		resID := ftdb.ResourceIDFromUserID(contactID)
+		contact, err := loadItem(ftCtx, resID, resID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		if len(contact) == 0 {
+			return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("No user %s", contactID)), nil
+		}
+	}
+	err = saveQuietHours(ftCtx, settings)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewJSONResponse(ftCtx, settings), nil
+}
+
+// validateQuietHours checks the settings and drops repeated emergency
+// contacts. Disabled settings are still checked so they can be turned on
+// as they are.
+func validateQuietHours(settings *quiet.Settings) error {
+	if _, err := time.LoadLocation(settings.TimeZone); nil != err || len(settings.TimeZone) == 0 {
+		return fmt.Errorf("Unknown time zone %s", settings.TimeZone)
+	}
+	start, err := quiet.MinuteOfDay(settings.Start)
+	if nil != err {
+		return err
+	}
+	end, err := quiet.MinuteOfDay(settings.End)
+	if nil != err {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("start and end must differ")
+	}
+	contacts := []string{}
+	seen := map[string]bool{}
+	for _, contactID := range settings.EmergencyContacts {
+		if len(contactID) == 0 || seen[contactID] {
+			continue
+		}
+		seen[contactID] = true
+		contacts = append(contacts, contactID)
+	}
+	if len(contacts) > maxEmergencyContacts {
+		return fmt.Errorf("No more than %d emergency contacts", maxEmergencyContacts)
+	}
+	settings.EmergencyContacts = contacts
+	return nil
+}
+
+// loadQuietHours returns the user's settings, disabled when they have none.
+func loadQuietHours(ftCtx awsproxy.FTContext) (quiet.Settings, error) {
+	settings := quiet.Settings{TimeZone: "UTC", Start: "22:00", End: "07:00", EmergencyContacts: []string{}}
+	item, err := loadItem(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), quiet.SettingsReferenceID)
+	if nil != err || len(item) == 0 {
+		return settings, err
+	}
+	err = attributevalue.UnmarshalMap(item, &settings)
+	if nil == settings.EmergencyContacts {
+		settings.EmergencyContacts = []string{}
+	}
+	return settings, err
+}
+
+func saveQuietHours(ftCtx awsproxy.FTContext, settings quiet.Settings) error {
+	item, err := attributevalue.MarshalMap(settings)
+	if nil != err {
+		return err
+	}
+	item[ftdb.ResourceIDField] = &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ftCtx.UserID)}
+	item[ftdb.ReferenceIDField] = &types.AttributeValueMemberS{Value: quiet.SettingsReferenceID}
+	_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item:      item,
+	})
+	return err
+}
+
+func loadItem(ftCtx awsproxy.FTContext, resourceID, referenceID string) (map[string]types.AttributeValue, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: referenceID},
+		},
+	})
+	if nil != err {
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -2,27 +2,147 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
 	"github.com/sowens-csd/folktells-server/awsproxy"
 	"github.com/sowens-csd/folktells-server/sharing"
 )
 
-// Handler is our lambda handler invoked by the `lambda.Start` function call
+// assignRequest is the number to assign. A swap also names the user's
+// number it replaces.
+type assignRequest struct {
+	Number   string `json:"number"`
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// Handler assigns a number to the user, or for the assigned path lists,
+// swaps or releases the user's numbers.
+//
+// POST sms/number {"number": "..."}
+// GET sms/number/assigned
+// PUT sms/number/assigned {"number": "...", "replaces": "..."}
+// DELETE sms/number/assigned?number={number}
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	awsproxy.SetupAccessParameters(ctx)
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
 	if nil != errResp {
 		return *errResp, nil
 	}
-	err := sharing.AssignNumber(ftCtx, request.Body, &http.Client{Timeout: 30 * time.Second})
+	client := &http.Client{Timeout: 30 * time.Second}
+	if !strings.HasSuffix(request.Resource, "/assigned") {
+		return assignNumber(ftCtx, request.Body, client), nil
+	}
+	numbers, err := sms.UserNumbers(ftCtx, ftCtx.UserID)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
+	switch request.HTTPMethod {
+	case http.MethodGet:
+		return awsproxy.NewJSONResponse(ftCtx, numbers), nil
+	case http.MethodPut:
+		var assignReq assignRequest
+		err = json.Unmarshal([]byte(request.Body), &assignReq)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		number := sms.NormalizeNumber(assignReq.Number)
+		replaced := sms.NormalizeNumber(assignReq.Replaces)
+		if len(number) == 0 || len(replaced) == 0 {
+			return newBadRequestResponse("The number to assign and the number it replaces are required"), nil
+		}
+		if !hasNumber(numbers, replaced) {
+			return newBadRequestResponse("Only your own number can be replaced"), nil
+		}
+		if number == replaced {
+			return awsproxy.NewSuccessResponse(ftCtx), nil
+		}
+		resp := assignNumber(ftCtx, request.Body, client)
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+		return releaseNumbers(ftCtx, numbers, func(assigned string) bool {
+			return assigned == replaced
+		}, client), nil
+	case http.MethodDelete:
+		toRelease := sms.NormalizeNumber(request.QueryStringParameters["number"])
+		if len(toRelease) == 0 {
+			return newBadRequestResponse("The number to release is required"), nil
+		}
+		return releaseNumbers(ftCtx, numbers, func(number string) bool {
+			return number == toRelease
+		}, client), nil
+	}
+	return awsproxy.HandleError(fmt.Errorf("Unsupported method %s", request.HTTPMethod), ftCtx.RequestLogger), nil
+}
+
+func assignNumber(ftCtx awsproxy.FTContext, body string, client *http.Client) awsproxy.Response {
+	err := sharing.AssignNumber(ftCtx, body, client)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	err = recordAssignment(ftCtx, body)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.NewSuccessResponse(ftCtx)
+}
 
-	return awsproxy.NewSuccessResponse(ftCtx), nil
+// releaseNumbers releases each of the user's numbers that is selected.
+func releaseNumbers(ftCtx awsproxy.FTContext, numbers []sms.AssignedNumber, selected func(string) bool, client *http.Client) awsproxy.Response {
+	for _, number := range numbers {
+		if !selected(number.Number) {
+			continue
+		}
+		err := sms.Release(ftCtx, number, client)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+	}
+	return awsproxy.NewSuccessResponse(ftCtx)
+}
+
+func hasNumber(numbers []sms.AssignedNumber, number string) bool {
+	for _, assigned := range numbers {
+		if assigned.Number == number {
+			return true
+		}
+	}
+	return false
+}
+
+func recordAssignment(ftCtx awsproxy.FTContext, body string) error {
+	var assignReq assignRequest
+	err := json.Unmarshal([]byte(body), &assignReq)
+	if nil != err {
+		return err
+	}
+	number := sms.NormalizeNumber(assignReq.Number)
+	if len(number) == 0 {
+		ftCtx.RequestLogger.Info().Msg("assigned number not in request, not recorded")
+		return nil
+	}
+	return sms.RecordAssignment(ftCtx, sms.AssignedNumber{
+		Number:     number,
+		OwnerID:    ftCtx.UserID,
+		AssignedAt: int(time.Now().UTC().Unix() * 1000),
+	})
+}
+
+func newBadRequestResponse(message string) awsproxy.Response {
+	return awsproxy.Response{
+		StatusCode:      http.StatusBadRequest,
+		IsBase64Encoded: false,
+		Body:            message,
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
 }
 
 func main() {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// smsContact is a phone number that has texted one of the user's numbers.
+// Consent is set by the sender texting STOP or START and cannot be changed
+// here, the user can name or block a sender.
+type smsContact struct {
+	Number           string `json:"number"`
+	Sender           string `json:"sender"`
+	Name             string `json:"name,omitempty"`
+	Consent          string `json:"consent"`
+	ConsentUpdatedAt int    `json:"consentUpdatedAt"`
+	Blocked          bool   `json:"blocked"`
+	LastMessageAt    int    `json:"lastMessageAt"`
+	MessageCount     int    `json:"messageCount"`
+}
+
+type contactUpdate struct {
+	Number  string `json:"number"`
+	Name    string `json:"name"`
+	Blocked bool   `json:"blocked"`
+}
+
+// Handler lists the numbers that have texted the user's assigned numbers, or
+// with a sender path parameter names or blocks one of them.
+//
+// GET sms/contacts
+// PUT sms/contacts/{sender} {"number": "...", "name": "...", "blocked": true}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	numbers, err := findUserNumbers(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	senderEnc, found := request.PathParameters["sender"]
+	if !found {
+		contacts := []smsContact{}
+		for _, number := range numbers {
+			numberContacts, err := loadContacts(ftCtx, number)
+			if nil != err {
+				return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+			}
+			contacts = append(contacts, numberContacts...)
+		}
+		return awsproxy.NewJSONResponse(ftCtx, contacts), nil
+	}
+	sender, err := url.PathUnescape(senderEnc)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	var update contactUpdate
+	err = json.Unmarshal([]byte(request.Body), &update)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	number := sms.NormalizeNumber(update.Number)
+	if !contains(numbers, number) {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Senders can only be managed for your own numbers."), nil
+	}
+	_, err = ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: sms.NumberResourcePrefix + number},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: sms.ContactReferencePrefix + sms.NormalizeNumber(sender)},
+		},
+		ConditionExpression: aws.String("attribute_exists(#resId)"),
+		UpdateExpression:    aws.String("SET #name = :name, #blocked = :blocked"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId":   ftdb.ResourceIDField,
+			"#name":    ftdb.NameField,
+			"#blocked": sms.BlockedField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name":    &types.AttributeValueMemberS{Value: update.Name},
+			":blocked": &types.AttributeValueMemberBOOL{Value: update.Blocked},
+		},
+	})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	ftCtx.RequestLogger.Info().Str("number", number).Bool("blocked", update.Blocked).Msg("SMS sender updated")
+	return awsproxy.NewSuccessResponse(ftCtx), nil
+}
+
+func findUserNumbers(ftCtx awsproxy.FTContext) ([]string, error) {
+	assigned, err := sms.UserNumbers(ftCtx, ftCtx.UserID)
+	if nil != err {
+		return nil, err
+	}
+	numbers := []string{}
+	for _, number := range assigned {
+		numbers = append(numbers, number.Number)
+	}
+	return numbers, nil
+}
+
+// loadContacts lists the senders recorded by sms_receive, C#{sender} under
+// the P#{number} they texted.
+func loadContacts(ftCtx awsproxy.FTContext, number string) ([]smsContact, error) {
+	items, err := records.QueryPrefix(ftCtx, sms.NumberResourcePrefix+number, sms.ContactReferencePrefix)
+	if nil != err {
+		return nil, err
+	}
+	contacts := []smsContact{}
+	for _, item := range items {
+		contact := sms.ContactFromItem(item)
+		contacts = append(contacts, smsContact{
+			Number:           number,
+			Sender:           strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), sms.ContactReferencePrefix),
+			Name:             records.StringAttribute(item, ftdb.NameField),
+			Consent:          contact.Consent,
+			ConsentUpdatedAt: records.NumberAttribute(item, sms.ConsentUpdatedAtField),
+			Blocked:          contact.Blocked,
+			LastMessageAt:    records.NumberAttribute(item, "lastMessageAt"),
+			MessageCount:     records.NumberAttribute(item, "messageCount"),
+		})
+	}
+	return contacts, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	lambda.Start(Handler)
+}
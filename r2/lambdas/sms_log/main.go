@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+const defaultLogLimit = 50
+const maxLogLimit = 200
+
+// The statuses reported in the log, after sms.StatusQueued. Plivo's
+// undelivered and rejected are reported as failed.
+const (
+	statusSent      = "sent"
+	statusDelivered = "delivered"
+	statusFailed    = "failed"
+)
+
+// statusRank orders statuses so that a late callback for an earlier status
+// does not move a message backwards.
+var statusRank = map[string]int{
+	sms.StatusQueued: 1,
+	statusSent:       2,
+	statusDelivered:  3,
+	statusFailed:     3,
+}
+
+type statusChange struct {
+	Status    string `json:"status" dynamodbav:"status"`
+	At        int    `json:"at" dynamodbav:"at"`
+	ErrorCode string `json:"errorCode,omitempty" dynamodbav:"errorCode"`
+}
+
+type loggedMessage struct {
+	MessageID string         `json:"messageId" dynamodbav:"messageId"`
+	From      string         `json:"from" dynamodbav:"from"`
+	To        string         `json:"to" dynamodbav:"to"`
+	Status    string         `json:"status" dynamodbav:"-"`
+	CreatedAt int            `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt int            `json:"updatedAt" dynamodbav:"updatedAt"`
+	History   []statusChange `json:"history" dynamodbav:"history"`
+}
+
+// Handler lists the user's outbound text messages, newest first, with where
+// each one got to. The to parameter limits the list to messages sent to one
+// number.
+//
+// GET sms/log?to={number}&limit={limit}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	limit := defaultLogLimit
+	if limitParam, found := request.QueryStringParameters["limit"]; found {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if nil != err || limit < 1 {
+			return awsproxy.HandleError(fmt.Errorf("limit must be a positive number, was %s", limitParam), ftCtx.RequestLogger), nil
+		}
+		if limit > maxLogLimit {
+			limit = maxLogLimit
+		}
+	}
+	messages, err := loadLog(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewJSONResponse(ftCtx, filterLog(messages, sms.NormalizeNumber(request.QueryStringParameters["to"]), limit)), nil
+}
+
+// loadLog reads the messages logged by sms.Send and sms_status, L#{messageUUID}
+// under the user's U#{userID}.
+func loadLog(ftCtx awsproxy.FTContext) ([]loggedMessage, error) {
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), sms.LogReferencePrefix)
+	if nil != err {
+		return nil, err
+	}
+	messages := []loggedMessage{}
+	err = attributevalue.UnmarshalListOfMaps(items, &messages)
+	return messages, err
+}
+
+// filterLog keeps the newest messages, to the number when one is given, and
+// works out the current status of each.
+func filterLog(messages []loggedMessage, to string, limit int) []loggedMessage {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt > messages[j].CreatedAt
+	})
+	filtered := []loggedMessage{}
+	for _, message := range messages {
+		if len(filtered) >= limit {
+			break
+		}
+		if len(to) > 0 && message.To != to {
+			continue
+		}
+		message.Status = currentStatus(message.History)
+		filtered = append(filtered, message)
+	}
+	return filtered
+}
+
+// currentStatus is the furthest status reached, the latest one if a message
+// is reported both delivered and failed.
+func currentStatus(history []statusChange) string {
+	current := statusChange{}
+	for _, change := range history {
+		status := reportedStatus(change.Status)
+		if statusRank[status] > statusRank[current.Status] ||
+			(statusRank[status] == statusRank[current.Status] && change.At >= current.At) {
+			current = statusChange{Status: status, At: change.At}
+		}
+	}
+	return current.Status
+}
+
+func reportedStatus(status string) string {
+	switch strings.ToLower(status) {
+	case "undelivered", "rejected", statusFailed:
+		return statusFailed
+	}
+	return strings.ToLower(status)
+}
+
+func main() {
+	lambda.Start(Handler)
+}
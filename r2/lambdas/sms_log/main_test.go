@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLateQueuedDoesNotMoveBackwards(t *testing.T) {
+	history := []statusChange{
+		{Status: "sent", At: 2},
+		{Status: "delivered", At: 3},
+		{Status: "queued", At: 4},
+	}
+	if status := currentStatus(history); status != statusDelivered {
+		t.Errorf("Expected delivered, was %s", status)
+	}
+}
+
+func TestUndeliveredIsFailed(t *testing.T) {
+	history := []statusChange{
+		{Status: "queued", At: 1},
+		{Status: "undelivered", At: 2, ErrorCode: "200"},
+	}
+	if status := currentStatus(history); status != statusFailed {
+		t.Errorf("Expected failed, was %s", status)
+	}
+}
+
+func TestLogNewestFirstFilteredByRecipient(t *testing.T) {
+	messages := []loggedMessage{
+		{MessageID: "a", To: "15551230000", CreatedAt: 1},
+		{MessageID: "b", To: "15559870000", CreatedAt: 2},
+		{MessageID: "c", To: "15551230000", CreatedAt: 3},
+	}
+	filtered := filterLog(messages, "15551230000", 10)
+	if 2 != len(filtered) || filtered[0].MessageID != "c" || filtered[1].MessageID != "a" {
+		t.Errorf("Unexpected log %v", filtered)
+	}
+	if 1 != len(filterLog(messages, "", 1)) {
+		t.Errorf("Expected the limit to apply")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// backfillRequest gives the owners of numbers that cannot be told from the
+// provider, number to user ID.
+type backfillRequest struct {
+	Owners map[string]string `json:"owners,omitempty"`
+}
+
+// backfillResult lists the numbers recorded and those still without an owner.
+type backfillResult struct {
+	Recorded     []string `json:"recorded"`
+	Unattributed []string `json:"unattributed"`
+}
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler records the owner of every number the Plivo account rents that was
+// assigned before numbers were recorded, so that replies, delivery logs and
+// release can find it. The owner is taken from the request, or else from the
+// number's Plivo alias when that is the ID of a user. It is invoked by hand,
+// numbers it cannot attribute are returned to be given in the next request.
+// Numbers already recorded are left alone, so running it again is harmless.
+func handler(ctx context.Context, request backfillRequest) (backfillResult, error) {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	client := &http.Client{Timeout: 30 * time.Second}
+	result := backfillResult{Recorded: []string{}, Unattributed: []string{}}
+	numbers, err := sms.ProviderNumbers(ftCtx, client)
+	if nil != err {
+		return result, err
+	}
+	now := int(time.Now().UTC().Unix() * 1000)
+	for _, number := range numbers {
+		ownerID, err := sms.NumberOwner(ftCtx, number.Number)
+		if nil != err {
+			return result, err
+		}
+		if len(ownerID) > 0 {
+			continue
+		}
+		ownerID, err = findOwner(ftCtx, number, request.Owners)
+		if nil != err {
+			return result, err
+		}
+		if len(ownerID) == 0 {
+			result.Unattributed = append(result.Unattributed, number.Number)
+			continue
+		}
+		err = sms.RecordAssignment(ftCtx, sms.AssignedNumber{Number: number.Number, OwnerID: ownerID, AssignedAt: now})
+		if nil != err {
+			return result, err
+		}
+		result.Recorded = append(result.Recorded, number.Number)
+	}
+	ftCtx.RequestLogger.Info().Int("recorded", len(result.Recorded)).Int("unattributed", len(result.Unattributed)).Msg("number backfill complete")
+	return result, nil
+}
+
+// findOwner is the user the number belongs to, empty if that is not known or
+// the user no longer exists.
+func findOwner(ftCtx awsproxy.FTContext, number sms.ProviderNumber, owners map[string]string) (string, error) {
+	ownerID := owners[number.Number]
+	if len(ownerID) == 0 {
+		ownerID = number.Alias
+	}
+	if len(ownerID) == 0 {
+		return "", nil
+	}
+	resID := ftdb.ResourceIDFromUserID(ownerID)
+	user, err := records.LoadItem(ftCtx, resID, resID)
+	if nil != err || len(user) == 0 {
+		return "", err
+	}
+	return ownerID, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// Senders are recorded as sms contacts, with these counts of their messages.
+const (
+	lastMessageAtField = "lastMessageAt"
+	messageCountField  = "messageCount"
+)
+
+// recordContact notes a message from the sender to the assigned number. STOP
+// and START keywords change the sender's consent, a sender is opted in when
+// first seen.
+func recordContact(ftCtx awsproxy.FTContext, message inboundSMS, kind string) (sms.Contact, error) {
+	now := strconv.Itoa(int(time.Now().UTC().Unix() * 1000))
+	update := "SET #lastMessageAt = :now, #consent = if_not_exists(#consent, :optedIn), #consentUpdatedAt = if_not_exists(#consentUpdatedAt, :now) ADD #messageCount :one"
+	values := map[string]types.AttributeValue{
+		":now":     &types.AttributeValueMemberN{Value: now},
+		":optedIn": &types.AttributeValueMemberS{Value: sms.ConsentOptedIn},
+		":one":     &types.AttributeValueMemberN{Value: "1"},
+	}
+	if kind == replyStop || kind == replyStart {
+		update = "SET #lastMessageAt = :now, #consent = :consent, #consentUpdatedAt = :now ADD #messageCount :one"
+		values = map[string]types.AttributeValue{
+			":now":     values[":now"],
+			":one":     values[":one"],
+			":consent": &types.AttributeValueMemberS{Value: consentForKeyword(kind)},
+		}
+	}
+	result, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: sms.NumberResourcePrefix + message.To},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: sms.ContactReferencePrefix + message.From},
+		},
+		UpdateExpression: aws.String(update),
+		ExpressionAttributeNames: map[string]string{
+			"#lastMessageAt":    lastMessageAtField,
+			"#consent":          sms.ConsentField,
+			"#consentUpdatedAt": sms.ConsentUpdatedAtField,
+			"#messageCount":     messageCountField,
+		},
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if nil != err {
+		return sms.Contact{}, err
+	}
+	return sms.ContactFromItem(result.Attributes), nil
+}
+
+func consentForKeyword(kind string) string {
+	if kind == replyStop {
+		return sms.ConsentOptedOut
+	}
+	return sms.ConsentOptedIn
+}
+
+// canReply decides whether a reply may be texted to the sender. A sender who
+// has opted out only gets the confirmation of their STOP and answers to HELP,
+// and a blocked sender gets nothing.
+func canReply(contact sms.Contact, kind string) bool {
+	if contact.Blocked {
+		return false
+	}
+	return contact.MayText() || kind == replyStop || kind == replyHelp
+}
@@ -2,21 +2,67 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"net/http"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
 	"github.com/sowens-csd/folktells-server/awsproxy"
-	"github.com/sowens-csd/folktells-server/notification"
 )
 
-// Handler is our lambda handler invoked by the `lambda.Start` function call
+// Handler is our lambda handler invoked by the `lambda.Start` function call.
+// Requests that are not signed by the SMS provider, or that repeat an earlier
+// request, are rejected before the message is looked at. Keywords are answered
+// directly, anything else is shared as a story with the groups of the number's
+// owner and answered with the number's reply template. Photos sent by MMS are copied to the media bucket and referenced
+// from the message text. Senders who have texted STOP get no further replies,
+// and blocked senders are dropped.
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
-	responseBody := `<?xml version="1.0" encoding="UTF-8"?>
-	<Response><Message><Body>Hello world! -Lambda</Body></Message></Response>
-	`
 	ftCtx := awsproxy.NewFromContext(ctx, "unknown")
-	err := notification.SendFromSMS(ftCtx, request.Body, &http.Client{Timeout: 30 * time.Second})
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		body = string(decoded)
+	}
+	err := sms.VerifyRequest(ftCtx, request, body, "smsReceiveURL")
+	if sms.ErrInvalidSignature == err || sms.ErrReplayedRequest == err || sms.ErrStaleRequest == err {
+		ftCtx.RequestLogger.Info().Err(err).Msg("rejected SMS request")
+		return awsproxy.NewForbiddenResponse(ftCtx, err.Error()), nil
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	message := parseInboundSMS(body)
+	kind, isKeyword := keywordReply(message.Text)
+	contact, err := recordContact(ftCtx, message, kind)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if contact.Blocked {
+		ftCtx.RequestLogger.Info().Str("number", message.To).Msg("SMS from blocked sender dropped")
+	} else if !isKeyword {
+		kind = replyDelivered
+		client := &http.Client{Timeout: 30 * time.Second}
+		delivered, err := attachMedia(ftCtx, body, client)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("number", message.To).Msg("MMS media not attached")
+			delivered = body
+		}
+		err = shareFromSMS(ctx, ftCtx, delivered, client)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("number", message.To).Msg("SMS not delivered")
+			kind = replyFailed
+		}
+	}
+	reply := ""
+	if canReply(contact, kind) {
+		reply = buildReply(ctx, ftCtx, message, kind)
+	}
+	responseBody, err := replyXML(message, reply)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+)
+
+func TestKeywordsIgnoreCaseAndSpace(t *testing.T) {
+	kind, found := keywordReply(" stop\n")
+	if !found || kind != replyStop {
+		t.Errorf("Expected stop, was %s", kind)
+	}
+	kind, found = keywordReply("Info")
+	if !found || kind != replyHelp {
+		t.Errorf("Expected help, was %s", kind)
+	}
+	_, found = keywordReply("stop by for dinner")
+	if found {
+		t.Errorf("Expected a message containing a keyword not to be a keyword")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	rendered := renderTemplate("Thanks {{ sender }}, shared with {{groups}}{{unknown}}.", map[string]string{
+		"sender": "15559870000",
+		"groups": "Smiths",
+	})
+	expected := "Thanks 15559870000, shared with Smiths."
+	if rendered != expected {
+		t.Errorf("Expected %s, was %s", expected, rendered)
+	}
+}
+
+func TestReplyXML(t *testing.T) {
+	message := parseInboundSMS("From=%2B15559870000&To=15551230000&Text=hi")
+	body, err := replyXML(message, "Got it <3")
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := `<Response><Message src="15551230000" dst="15559870000" type="sms">Got it &lt;3</Message></Response>`
+	if !strings.HasSuffix(body, expected) {
+		t.Errorf("Expected %s, was %s", expected, body)
+	}
+}
+
+func TestEmptyReplyHasNoMessage(t *testing.T) {
+	body, err := replyXML(inboundSMS{From: "1", To: "2"}, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "<Message") {
+		t.Errorf("Expected no message, was %s", body)
+	}
+}
+
+func TestOptedOutSenderOnlyGetsStopAndHelp(t *testing.T) {
+	contact := sms.Contact{Consent: sms.ConsentOptedOut}
+	if canReply(contact, replyDelivered) || canReply(contact, replyFailed) || canReply(contact, replyStart) {
+		t.Errorf("Expected no reply to an opted out sender")
+	}
+	if !canReply(contact, replyStop) || !canReply(contact, replyHelp) {
+		t.Errorf("Expected STOP and HELP to be answered")
+	}
+}
+
+func TestBlockedSenderGetsNoReply(t *testing.T) {
+	if canReply(sms.Contact{Consent: sms.ConsentOptedIn, Blocked: true}, replyHelp) {
+		t.Errorf("Expected no reply to a blocked sender")
+	}
+}
+
+func TestMediaURLsInOrder(t *testing.T) {
+	params, _ := url.ParseQuery("Type=mms&Media1=https%3A%2F%2Fmedia%2Fb&MediaCount=2&Media0=https%3A%2F%2Fmedia%2Fa&Text=hi")
+	urls := mediaURLs(params)
+	if 2 != len(urls) || urls[0] != "https://media/a" || urls[1] != "https://media/b" {
+		t.Errorf("Unexpected media %v", urls)
+	}
+}
+
+func TestSMSHasNoMedia(t *testing.T) {
+	params, _ := url.ParseQuery("From=1&To=2&Text=hello")
+	if 0 != len(mediaURLs(params)) {
+		t.Errorf("Expected no media")
+	}
+}
+
+func TestMediaExtension(t *testing.T) {
+	if mediaExtension("image/jpeg") != ".jpg" || mediaExtension("video/mp4") != ".mp4" {
+		t.Errorf("Unexpected extensions")
+	}
+}
+
+func TestTemplateNamesIgnoreSpaces(t *testing.T) {
+	names := templateNames("Shared with {{ owner }} in {{groups}}, {{sender")
+	if !names["owner"] || !names["groups"] || names["sender"] {
+		t.Errorf("Expected owner and groups, was %v", names)
+	}
+}
+
+func TestDefaultRepliesNameNobody(t *testing.T) {
+	for kind, template := range defaultReplies {
+		if names := templateNames(template); names["owner"] || names["groups"] {
+			t.Errorf("Expected the default %s reply not to name the owner or groups, was %s", kind, template)
+		}
+	}
+}
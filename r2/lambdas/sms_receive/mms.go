@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/media"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// maxMediaBytes is the largest attachment copied, carriers limit MMS to well
+// under this.
+const maxMediaBytes = 10 * 1024 * 1024
+
+// mediaParam matches the Media0, Media1, ... parameters holding the URL of
+// each MMS attachment.
+var mediaParam = regexp.MustCompile(`^Media(\d+)$`)
+
+// mediaURLs lists the attachment URLs of an MMS in the order they were sent.
+func mediaURLs(params url.Values) []string {
+	type indexedURL struct {
+		index int
+		url   string
+	}
+	var found []indexedURL
+	for name, values := range params {
+		match := mediaParam.FindStringSubmatch(name)
+		if nil == match || len(values) == 0 || len(values[0]) == 0 {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		found = append(found, indexedURL{index, values[0]})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].index < found[j].index })
+	urls := make([]string, 0, len(found))
+	for _, media := range found {
+		urls = append(urls, media.url)
+	}
+	return urls
+}
+
+// attachMedia copies each MMS attachment into the media bucket, records a
+// media reference for it owned by the number's owner and adds the reference
+// to the message text as markdown, so the photo shows up in the story the
+// message creates and is served like any other media. The body passed on is
+// the original with the text replaced. Attachments that cannot be copied are
+// logged and left out.
+func attachMedia(ftCtx awsproxy.FTContext, body string, client *http.Client) (string, error) {
+	params, err := url.ParseQuery(body)
+	if nil != err {
+		return body, err
+	}
+	urls := mediaURLs(params)
+	if len(urls) == 0 {
+		return body, nil
+	}
+	bucket := os.Getenv("mediaBucket")
+	if len(bucket) == 0 {
+		return body, fmt.Errorf("mediaBucket is not configured")
+	}
+	number := sms.NormalizeNumber(params.Get("To"))
+	ownerID, err := sms.NumberOwner(ftCtx, number)
+	if nil != err {
+		return body, err
+	}
+	if len(ownerID) == 0 {
+		return body, fmt.Errorf("number %s has no owner for its media", number)
+	}
+	authID, err := sms.AuthID(ftCtx)
+	if nil != err {
+		return body, err
+	}
+	authToken, err := sms.AuthToken(ftCtx)
+	if nil != err {
+		return body, err
+	}
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return body, err
+	}
+	s3Client := s3.NewFromConfig(cfg)
+	messageID := params.Get("MessageUUID")
+	var references []string
+	for i, mediaURL := range urls {
+		reference, err := copyMedia(ftCtx, s3Client, client, bucket, ownerID, mediaURL, authID, authToken)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("message", messageID).Int("media", i).Msg("MMS media not copied")
+			continue
+		}
+		references = append(references, fmt.Sprintf("![photo %d](%s)", i+1, reference))
+	}
+	if len(references) == 0 {
+		return body, nil
+	}
+	params.Set("Text", strings.TrimSpace(params.Get("Text")+"\n\n"+strings.Join(references, "\n")))
+	ftCtx.RequestLogger.Info().Str("message", messageID).Int("media", len(references)).Msg("MMS media attached")
+	return params.Encode(), nil
+}
+
+// copyMedia downloads one attachment from Plivo, which needs the account
+// credentials, stores it in the bucket named like the files mediaAccess
+// creates and returns the media reference recorded for it. Only images and
+// video are kept.
+func copyMedia(ftCtx awsproxy.FTContext, s3Client *s3.Client, client *http.Client, bucket, ownerID, mediaURL, authID, authToken string) (string, error) {
+	request, err := http.NewRequestWithContext(ftCtx.Context, http.MethodGet, mediaURL, nil)
+	if nil != err {
+		return "", err
+	}
+	if host := request.URL.Hostname(); host == "plivo.com" || strings.HasSuffix(host, ".plivo.com") {
+		request.SetBasicAuth(authID, authToken)
+	}
+	response, err := client.Do(request)
+	if nil != err {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("media download failed with status %d", response.StatusCode)
+	}
+	contentType := response.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if nil != err || !(strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/")) {
+		return "", fmt.Errorf("media type %s is not supported", contentType)
+	}
+	if response.ContentLength > maxMediaBytes {
+		return "", fmt.Errorf("media is %d bytes, over the limit", response.ContentLength)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxMediaBytes+1))
+	if nil != err {
+		return "", err
+	}
+	if len(content) > maxMediaBytes {
+		return "", fmt.Errorf("media is over the %d byte limit", maxMediaBytes)
+	}
+	key := fmt.Sprintf("%s_%s%s", ftdb.NewUUID(), "mms", mediaExtension(mediaType))
+	_, err = s3Client.PutObject(ftCtx.Context, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String(mediaType),
+	})
+	if nil != err {
+		return "", err
+	}
+	reference := ftdb.NewUUID()
+	err = media.Save(ftCtx, reference, media.Reference{
+		MediaFile:   key,
+		ContentType: mediaType,
+		CreatedAt:   ftdb.NowMillisecondsSinceEpoch(),
+		CreatedBy:   ownerID,
+	})
+	if nil != err {
+		return "", err
+	}
+	return reference, nil
+}
+
+// mediaExtension picks a file extension for the media type, the common types
+// are fixed so that keys do not depend on the system's mime tables.
+func mediaExtension(mediaType string) string {
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/heic":
+		return ".heic"
+	case "video/mp4":
+		return ".mp4"
+	case "video/3gpp":
+		return ".3gp"
+	}
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if nil == err && len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
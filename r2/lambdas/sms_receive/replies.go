@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// Reply templates are kept under the number's P#{number}, or under the
+// owner's U#{userID} to apply to all their numbers, as A#{kind}.
+const replyReferencePrefix = "A#"
+const templateField = "template"
+
+// The kinds of automatic reply. A reply is sent after a message is delivered,
+// failed when it could not be, and the rest answer the keywords.
+const (
+	replyDelivered = "reply"
+	replyFailed    = "failed"
+	replyHelp      = "help"
+	replyStop      = "stop"
+	replyStart     = "start"
+)
+
+// keywords maps the standard carrier keywords to the reply that answers them.
+var keywords = map[string]string{
+	"HELP":        replyHelp,
+	"INFO":        replyHelp,
+	"STOP":        replyStop,
+	"STOPALL":     replyStop,
+	"UNSUBSCRIBE": replyStop,
+	"CANCEL":      replyStop,
+	"END":         replyStop,
+	"QUIT":        replyStop,
+	"START":       replyStart,
+	"YES":         replyStart,
+	"UNSTOP":      replyStart,
+}
+
+// defaultReplies are used when neither the number nor its owner has a
+// template. An empty template means no reply is sent. They never name anyone,
+// anybody can text HELP to the number, so the owner's name and their groups
+// are only sent when the owner puts {{owner}} or {{groups}} in a template of
+// their own.
+var defaultReplies = map[string]string{
+	replyDelivered: "",
+	replyFailed:    "Sorry, your message could not be delivered. Reply HELP for help.",
+	replyHelp:      "Folktells: texts to this number are shared as stories with a Folktells family. Reply STOP to stop, START to resume.",
+	replyStop:      "Folktells: you will no longer receive texts from this number. Reply START to resume.",
+	replyStart:     "Folktells: you will receive texts from this number again. Reply STOP to stop.",
+}
+
+// inboundSMS holds the parts of the provider's request used to reply.
+type inboundSMS struct {
+	From string
+	To   string
+	Text string
+}
+
+// plivoMessage and plivoResponse are the Plivo XML answer to a message. A
+// response with no message sends no reply. With a callback URL Plivo reports
+// the delivery of the reply to sms_status.
+type plivoMessage struct {
+	Source      string `xml:"src,attr"`
+	Destination string `xml:"dst,attr"`
+	Type        string `xml:"type,attr"`
+	CallbackURL string `xml:"callbackUrl,attr,omitempty"`
+	Text        string `xml:",chardata"`
+}
+
+type plivoResponse struct {
+	XMLName  xml.Name       `xml:"Response"`
+	Messages []plivoMessage `xml:"Message"`
+}
+
+func parseInboundSMS(body string) inboundSMS {
+	params, err := url.ParseQuery(body)
+	if nil != err {
+		return inboundSMS{}
+	}
+	return inboundSMS{
+		From: sms.NormalizeNumber(params.Get("From")),
+		To:   sms.NormalizeNumber(params.Get("To")),
+		Text: params.Get("Text"),
+	}
+}
+
+// keywordReply finds the reply for a message that is only a keyword, found is
+// false for anything else.
+func keywordReply(text string) (string, bool) {
+	kind, found := keywords[strings.ToUpper(strings.TrimSpace(text))]
+	return kind, found
+}
+
+// buildReply renders the reply template of the kind for the message.
+func buildReply(ctx context.Context, ftCtx awsproxy.FTContext, message inboundSMS, kind string) string {
+	ownerID, err := sms.NumberOwner(ftCtx, message.To)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("number", message.To).Msg("number owner lookup failed")
+	}
+	template, found, err := loadTemplate(ftCtx, sms.NumberResourcePrefix+message.To, kind)
+	if nil == err && !found && len(ownerID) > 0 {
+		template, found, err = loadTemplate(ftCtx, ftdb.ResourceIDFromUserID(ownerID), kind)
+	}
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("kind", kind).Msg("reply template lookup failed")
+	}
+	if !found {
+		template = defaultReplies[kind]
+	}
+	if len(template) == 0 {
+		return ""
+	}
+	values := map[string]string{
+		"sender": message.From,
+		"number": message.To,
+		"owner":  "the family",
+		"groups": "Folktells",
+	}
+	if len(ownerID) > 0 {
+		ownerCtx := awsproxy.NewFromContext(ctx, ownerID)
+		used := templateNames(template)
+		if used["owner"] {
+			resID := ftdb.ResourceIDFromUserID(ownerID)
+			owner, err := getItem(ftCtx, resID, resID)
+			if name := stringAttribute(owner, ftdb.NameField); nil == err && len(name) > 0 {
+				values["owner"] = name
+			}
+		}
+		if used["groups"] {
+			names, err := findGroupNames(ownerCtx)
+			if nil == err && len(names) > 0 {
+				values["groups"] = strings.Join(names, ", ")
+			}
+		}
+	}
+	return renderTemplate(template, values)
+}
+
+// renderTemplate replaces each {{name}} with its value, names without a value
+// are left empty.
+func renderTemplate(template string, values map[string]string) string {
+	var rendered strings.Builder
+	parseTemplate(template, func(text string) {
+		rendered.WriteString(text)
+	}, func(name string) {
+		rendered.WriteString(values[name])
+	})
+	return rendered.String()
+}
+
+// templateNames is the set of names the template uses, as renderTemplate
+// reads them.
+func templateNames(template string) map[string]bool {
+	names := map[string]bool{}
+	parseTemplate(template, func(string) {}, func(name string) {
+		names[name] = true
+	})
+	return names
+}
+
+// parseTemplate calls text with each run of plain text in the template and
+// name with the name in each {{name}}, spaces inside the braces are ignored.
+func parseTemplate(template string, text func(string), name func(string)) {
+	for {
+		start := strings.Index(template, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}}")
+		if end < 0 {
+			break
+		}
+		text(template[:start])
+		name(strings.TrimSpace(template[start+2 : start+end]))
+		template = template[start+end+2:]
+	}
+	text(template)
+}
+
+// replyXML answers the message with the reply, or with no message at all when
+// the reply is empty.
+func replyXML(message inboundSMS, reply string) (string, error) {
+	response := plivoResponse{}
+	if len(reply) > 0 {
+		response.Messages = []plivoMessage{{
+			Source:      message.To,
+			Destination: message.From,
+			Type:        "sms",
+			CallbackURL: os.Getenv("smsStatusURL"),
+			Text:        reply,
+		}}
+	}
+	body, err := xml.Marshal(response)
+	if nil != err {
+		return "", err
+	}
+	return xml.Header + string(body), nil
+}
+
+func loadTemplate(ftCtx awsproxy.FTContext, resourceID, kind string) (string, bool, error) {
+	item, err := getItem(ftCtx, resourceID, replyReferencePrefix+kind)
+	if nil != err || len(item) == 0 {
+		return "", false, err
+	}
+	return stringAttribute(item, templateField), true, nil
+}
+
+func findGroupNames(ftCtx awsproxy.FTContext) ([]string, error) {
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	var names []string
+	for _, groupID := range groups {
+		resID := ftdb.ResourceIDFromGroupID(groupID)
+		item, err := getItem(ftCtx, resID, resID)
+		if nil != err {
+			return nil, err
+		}
+		if name := stringAttribute(item, ftdb.NameField); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getItem(ftCtx awsproxy.FTContext, resourceID, referenceID string) (map[string]types.AttributeValue, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: referenceID},
+		},
+	})
+	if nil != err {
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
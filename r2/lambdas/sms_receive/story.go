@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/broadcast"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/search"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// smsStorySource marks a story that was created from a text.
+const smsStorySource = "sms"
+
+const storyAlertTitle = "Folktells"
+const storyUpdatedAction = "storyUpdated"
+
+// smsStory is a story created from a text, stored like any other story as
+// S#{storyID} under G#{groupID}.
+type smsStory struct {
+	GroupID       string `json:"groupId"`
+	StoryID       string `json:"id"`
+	Content       string `json:"content"`
+	Version       string `json:"version"`
+	LastUpdated   int    `json:"lastUpdated"`
+	LastUpdatedBy string `json:"lastUpdatedBy"`
+	StorySource   string `json:"storySource"`
+	CreatedBy     string `json:"createdBy"`
+}
+
+// storyEvent tells the devices of the group's members about the new story,
+// the same way as a story saved from the app.
+type storyEvent struct {
+	Action string   `json:"action"`
+	Data   smsStory `json:"data"`
+}
+
+// shareFromSMS shares the text of the message as a new story, by the number's
+// owner, with each of the owner's groups. Each story is added to the search
+// index and the group told about it like a story saved from the app, members
+// in their quiet hours have the push held back.
+func shareFromSMS(ctx context.Context, ftCtx awsproxy.FTContext, body string, client *http.Client) error {
+	params, err := url.ParseQuery(body)
+	if nil != err {
+		return err
+	}
+	number := sms.NormalizeNumber(params.Get("To"))
+	content := strings.TrimSpace(params.Get("Text"))
+	if len(content) == 0 {
+		return fmt.Errorf("message to %s has no text", number)
+	}
+	ownerID, err := sms.NumberOwner(ftCtx, number)
+	if nil != err {
+		return err
+	}
+	if len(ownerID) == 0 {
+		return fmt.Errorf("number %s has no owner", number)
+	}
+	ownerCtx := awsproxy.NewFromContext(ctx, ownerID)
+	groups, err := sharing.FindGroupsForUser(ownerCtx)
+	if nil != err {
+		return err
+	}
+	storyID := ftdb.NewUUID()
+	for _, groupID := range groups {
+		story := smsStory{
+			GroupID:       groupID,
+			StoryID:       storyID,
+			Content:       content,
+			Version:       ftdb.NewUUID(),
+			LastUpdated:   ftdb.NowMillisecondsSinceEpoch(),
+			LastUpdatedBy: ownerID,
+			StorySource:   smsStorySource,
+			CreatedBy:     ownerID,
+		}
+		err = saveStory(ownerCtx, story)
+		if nil != err {
+			return err
+		}
+		err = search.Index(ownerCtx, search.Story{
+			GroupID:       story.GroupID,
+			StoryID:       story.StoryID,
+			Content:       story.Content,
+			LastUpdated:   story.LastUpdated,
+			LastUpdatedBy: story.LastUpdatedBy,
+			Author:        story.CreatedBy,
+		})
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("story", story.StoryID).Msg("story index update failed")
+		}
+		data, err := json.Marshal(storyEvent{Action: storyUpdatedAction, Data: story})
+		if nil == err {
+			_, err = broadcast.Send(ownerCtx, broadcast.Event{
+				ID:      "S#" + story.StoryID + "#" + story.Version,
+				GroupID: story.GroupID,
+				Data:    data,
+				Alert: &broadcast.Alert{
+					Title: storyAlertTitle,
+					Body:  fmt.Sprintf("%s shared a story", broadcast.SenderName(ownerCtx)),
+				},
+			}, client)
+		}
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("group", groupID).Str("story", story.StoryID).Msg("story from SMS not notified")
+		}
+	}
+	ftCtx.RequestLogger.Info().Str("number", number).Str("story", storyID).Int("groups", len(groups)).Msg("SMS shared as story")
+	return nil
+}
+
+// saveStory writes the new story with the same attributes as a story saved
+// from the app.
+func saveStory(ftCtx awsproxy.FTContext, story smsStory) error {
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:    &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(story.GroupID)},
+			ftdb.ReferenceIDField:   &types.AttributeValueMemberS{Value: "S#" + story.StoryID},
+			ftdb.IDField:            &types.AttributeValueMemberS{Value: story.StoryID},
+			ftdb.ContentField:       &types.AttributeValueMemberS{Value: story.Content},
+			ftdb.VersionField:       &types.AttributeValueMemberS{Value: story.Version},
+			ftdb.LastUpdatedField:   &types.AttributeValueMemberN{Value: strconv.Itoa(story.LastUpdated)},
+			ftdb.LastUpdatedByField: &types.AttributeValueMemberS{Value: story.LastUpdatedBy},
+			ftdb.StorySourceField:   &types.AttributeValueMemberS{Value: story.StorySource},
+			search.AuthorField:      &types.AttributeValueMemberS{Value: story.CreatedBy},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#refId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#refId": ftdb.ReferenceIDField,
+		},
+	})
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// expiredGraceDays is how long a number is kept after the owner's
+// subscription expires, giving them time to renew before losing the number.
+const expiredGraceDays = 60
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs on a schedule and releases the numbers of users who have been
+// deleted or whose subscription ended more than expiredGraceDays ago, so we
+// stop paying Plivo for them. A failure is logged and the number tried again
+// on the next run. Numbers the Plivo account rents that have no owner record
+// cannot be released and are logged to be attributed with
+// sms_number_backfill.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	client := &http.Client{Timeout: 30 * time.Second}
+	cutoff := int(time.Now().Add(-expiredGraceDays*24*time.Hour).UTC().Unix() * 1000)
+	released := 0
+	recorded := map[string]bool{}
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Scan(ftCtx.Context, &dynamodb.ScanInput{
+			TableName:        aws.String(ftdb.GetTableName()),
+			FilterExpression: aws.String("begins_with(#resId, :number) AND #resId = #refId"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":number": &types.AttributeValueMemberS{Value: sms.NumberResourcePrefix},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Msg("number scan failed")
+			return err
+		}
+		for _, item := range result.Items {
+			number := sms.AssignedNumber{
+				Number:  records.StringAttribute(item, "number"),
+				OwnerID: records.StringAttribute(item, "ownerId"),
+			}
+			recorded[number.Number] = true
+			release, err := shouldRelease(ftCtx, number.OwnerID, cutoff)
+			if nil == err && release {
+				err = sms.Release(ftCtx, number, client)
+				if nil == err {
+					released++
+				}
+			}
+			if nil != err {
+				ftCtx.RequestLogger.Error().Err(err).Str("number", number.Number).Msg("number release failed")
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	ftCtx.RequestLogger.Info().Int("released", released).Msg("number release complete")
+	logUnrecordedNumbers(ftCtx, recorded, client)
+	return nil
+}
+
+// logUnrecordedNumbers reports the numbers Plivo has that are not recorded as
+// assigned to anyone.
+func logUnrecordedNumbers(ftCtx awsproxy.FTContext, recorded map[string]bool, client *http.Client) {
+	numbers, err := sms.ProviderNumbers(ftCtx, client)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Msg("provider number list failed")
+		return
+	}
+	for _, number := range numbers {
+		if !recorded[number.Number] {
+			ftCtx.RequestLogger.Warn().Str("number", number.Number).Msg("SMS number has no owner record")
+		}
+	}
+}
+
+// shouldRelease is true when the owner no longer exists or their subscription
+// expired, or was revoked, before the cutoff. An owner with no recorded
+// subscription keeps their numbers.
+func shouldRelease(ftCtx awsproxy.FTContext, ownerID string, cutoff int) (bool, error) {
+	resID := ftdb.ResourceIDFromUserID(ownerID)
+	user, err := records.LoadItem(ftCtx, resID, resID)
+	if nil != err {
+		return false, err
+	}
+	if len(user) == 0 {
+		return true, nil
+	}
+	owned, err := entitlements.Load(ftCtx, ownerID)
+	if nil != err || nil == owned {
+		return false, err
+	}
+	return subscriptionEnded(*owned, cutoff), nil
+}
+
+func subscriptionEnded(owned entitlements.Entitlement, cutoff int) bool {
+	if owned.Revoked {
+		return owned.UpdatedAt < cutoff
+	}
+	return !owned.Active && owned.ExpiresAt > 0 && owned.ExpiresAt < cutoff
+}
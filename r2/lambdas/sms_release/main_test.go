@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+)
+
+func TestSubscriptionEnded(t *testing.T) {
+	cutoff := 1000
+	if subscriptionEnded(entitlements.Entitlement{Active: true, ExpiresAt: 500}, cutoff) {
+		t.Errorf("Expected an active subscription to be kept")
+	}
+	if subscriptionEnded(entitlements.Entitlement{ExpiresAt: 1500}, cutoff) || subscriptionEnded(entitlements.Entitlement{}, cutoff) {
+		t.Errorf("Expected a subscription inside the grace period or without expiry to be kept")
+	}
+	if !subscriptionEnded(entitlements.Entitlement{ExpiresAt: 500}, cutoff) {
+		t.Errorf("Expected a subscription that expired before the cutoff to end")
+	}
+	if !subscriptionEnded(entitlements.Entitlement{Active: true, Revoked: true, UpdatedAt: 500}, cutoff) {
+		t.Errorf("Expected a subscription revoked before the cutoff to end")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// Reply templates are kept as A#{kind} under P#{number} for one number, or
+// under the user's U#{userID} for all their numbers. The user's assigned
+// numbers are recorded as P#{number} under U#{userID} by sms_assignnumber.
+const numberResourcePrefix = "P#"
+const replyReferencePrefix = "A#"
+const templateField = "template"
+
+// maxTemplateLength keeps a reply to a single SMS segment or two.
+const maxTemplateLength = 300
+
+// replyKinds are the replies sms_receive sends, see sms_receive for when.
+var replyKinds = map[string]bool{
+	"reply":  true,
+	"failed": true,
+	"help":   true,
+	"stop":   true,
+	"start":  true,
+}
+
+type replyTemplate struct {
+	Kind     string `json:"kind"`
+	Number   string `json:"number,omitempty"`
+	Template string `json:"template"`
+}
+
+type replyTemplates struct {
+	Numbers   []string        `json:"numbers"`
+	Templates []replyTemplate `json:"templates"`
+}
+
+// Handler lists the user's SMS reply templates, or with a kind path parameter
+// sets or removes one. A template applies to all the user's numbers unless a
+// number is given. Templates can use {{sender}}, {{number}}, {{owner}} and
+// {{groups}}.
+//
+// GET sms/replies
+// PUT sms/replies/{kind} {"template": "...", "number": "..."}
+// DELETE sms/replies/{kind}?number={number}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	numbers, err := findUserNumbers(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	kind, found := request.PathParameters["kind"]
+	if !found {
+		templates, err := loadTemplates(ftCtx, numbers)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, replyTemplates{Numbers: numbers, Templates: templates}), nil
+	}
+	if !replyKinds[kind] {
+		return awsproxy.HandleError(fmt.Errorf("Unknown reply kind %s", kind), ftCtx.RequestLogger), nil
+	}
+	var template replyTemplate
+	if request.HTTPMethod == "DELETE" {
+		template.Number = request.QueryStringParameters["number"]
+	} else {
+		err = json.Unmarshal([]byte(request.Body), &template)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		if len(template.Template) > maxTemplateLength {
+			return awsproxy.HandleError(fmt.Errorf("Template is longer than %d characters", maxTemplateLength), ftCtx.RequestLogger), nil
+		}
+	}
+	template.Kind = kind
+	template.Number = normalizeNumber(template.Number)
+	resourceID := ftdb.ResourceIDFromUserID(ftCtx.UserID)
+	if len(template.Number) > 0 {
+		if !contains(numbers, template.Number) {
+			return awsproxy.NewForbiddenResponse(ftCtx, "Replies can only be set for your own numbers."), nil
+		}
+		resourceID = numberResourcePrefix + template.Number
+	}
+	if request.HTTPMethod == "DELETE" {
+		_, err = ftCtx.DBSvc.DeleteItem(ftCtx.Context, &dynamodb.DeleteItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Key: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: replyReferencePrefix + kind},
+			},
+		})
+	} else {
+		_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Item: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: replyReferencePrefix + kind},
+				templateField:         &types.AttributeValueMemberS{Value: template.Template},
+			},
+		})
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewSuccessResponse(ftCtx), nil
+}
+
+func findUserNumbers(ftCtx awsproxy.FTContext) ([]string, error) {
+	items, err := queryPrefix(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), numberResourcePrefix)
+	if nil != err {
+		return nil, err
+	}
+	numbers := []string{}
+	for _, item := range items {
+		numbers = append(numbers, strings.TrimPrefix(stringAttribute(item, ftdb.ReferenceIDField), numberResourcePrefix))
+	}
+	return numbers, nil
+}
+
+// loadTemplates finds the user's templates followed by those for each of
+// their numbers.
+func loadTemplates(ftCtx awsproxy.FTContext, numbers []string) ([]replyTemplate, error) {
+	templates := []replyTemplate{}
+	resourceIDs := []string{ftdb.ResourceIDFromUserID(ftCtx.UserID)}
+	for _, number := range numbers {
+		resourceIDs = append(resourceIDs, numberResourcePrefix+number)
+	}
+	for i, resourceID := range resourceIDs {
+		items, err := queryPrefix(ftCtx, resourceID, replyReferencePrefix)
+		if nil != err {
+			return nil, err
+		}
+		for _, item := range items {
+			template := replyTemplate{
+				Kind:     strings.TrimPrefix(stringAttribute(item, ftdb.ReferenceIDField), replyReferencePrefix),
+				Template: stringAttribute(item, templateField),
+			}
+			if i > 0 {
+				template.Number = numbers[i-1]
+			}
+			templates = append(templates, template)
+		}
+	}
+	return templates, nil
+}
+
+func queryPrefix(ftCtx awsproxy.FTContext, resourceID, prefix string) ([]map[string]types.AttributeValue, error) {
+	result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+		TableName:              aws.String(ftdb.GetTableName()),
+		KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId": ftdb.ResourceIDField,
+			"#refId": ftdb.ReferenceIDField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":resId":  &types.AttributeValueMemberS{Value: resourceID},
+			":prefix": &types.AttributeValueMemberS{Value: prefix},
+		},
+	})
+	if nil != err {
+		return nil, err
+	}
+	return result.Items, nil
+}
+
+// normalizeNumber keeps only the digits, matching the numbers Plivo sends.
+func normalizeNumber(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func main() {
+	lambda.Start(Handler)
+}
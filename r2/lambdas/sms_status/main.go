@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sms"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// Handler receives Plivo's message status callbacks. Plivo calls it as an
+// outbound message moves through queued, sent and delivered, or undelivered
+// or failed, for messages sent with this lambda as their callback URL.
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx := awsproxy.NewFromContext(ctx, "unknown")
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		body = string(decoded)
+	}
+	err := sms.VerifyRequest(ftCtx, request, body, "smsStatusURL")
+	if sms.ErrInvalidSignature == err || sms.ErrReplayedRequest == err || sms.ErrStaleRequest == err {
+		ftCtx.RequestLogger.Info().Err(err).Msg("rejected SMS status request")
+		return awsproxy.NewForbiddenResponse(ftCtx, err.Error()), nil
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	update := parseStatusUpdate(body)
+	if len(update.MessageID) == 0 {
+		ftCtx.RequestLogger.Info().Msg("SMS status without a message ID ignored")
+		return awsproxy.NewSuccessResponse(ftCtx), nil
+	}
+	ownerID, err := sms.NumberOwner(ftCtx, update.From)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if len(ownerID) == 0 {
+		ftCtx.RequestLogger.Info().Str("number", update.From).Str("message", update.MessageID).Msg("SMS status for unassigned number ignored")
+		return awsproxy.NewSuccessResponse(ftCtx), nil
+	}
+	err = sms.LogStatus(ftCtx, ownerID, update, int(time.Now().UTC().Unix()*1000))
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	ftCtx.RequestLogger.Info().Str("message", update.MessageID).Str("status", update.Status).Msg("SMS status logged")
+	return awsproxy.NewSuccessResponse(ftCtx), nil
+}
+
+func parseStatusUpdate(body string) sms.StatusUpdate {
+	params, err := url.ParseQuery(body)
+	if nil != err {
+		return sms.StatusUpdate{}
+	}
+	return sms.StatusUpdate{
+		MessageID: params.Get("MessageUUID"),
+		From:      sms.NormalizeNumber(params.Get("From")),
+		To:        sms.NormalizeNumber(params.Get("To")),
+		Status:    strings.ToLower(params.Get("Status")),
+		ErrorCode: params.Get("ErrorCode"),
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
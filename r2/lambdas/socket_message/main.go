@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// envelope is every message sent over the websocket. The action picks the
+// handler, the request ID is returned in the reply so the app can match them
+// up, and the data is specific to the action.
+type envelope struct {
+	Action    string          `json:"action"`
+	RequestID string          `json:"requestId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// reply answers an envelope on the connection it came in on.
+type reply struct {
+	Action    string      `json:"action"`
+	RequestID string      `json:"requestId,omitempty"`
+	OK        bool        `json:"ok"`
+	Error     string      `json:"error,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// socketRequest is what an action handler gets to work with.
+type socketRequest struct {
+	ftCtx      awsproxy.FTContext
+	connection sockets.Connection
+	data       json.RawMessage
+	poster     *sockets.Poster
+}
+
+type actionHandler func(request socketRequest) (interface{}, error)
+
+// actions maps each action to its handler, an action not found here is
+// answered with an error.
+var actions = map[string]actionHandler{
+	"ping":      handlePing,
+	"subscribe": handleSubscribe,
+	"send":      handleSend,
+}
+
+var errNotMember = errors.New("not a member of the group")
+var errNoSharedGroup = errors.New("no group shared with the user")
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler receives every message sent over the websocket that has no route of
+// its own, which is all of them, and dispatches it on its action. The answer
+// is posted back to the sender's connection.
+func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromWebsocketContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	connection := sockets.Connection{
+		UserID:       ftCtx.UserID,
+		ConnectionID: request.RequestContext.ConnectionID,
+		Endpoint:     sockets.Endpoint(request.RequestContext.DomainName, request.RequestContext.Stage),
+	}
+	poster, err := sockets.NewPoster(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	answer := dispatch(socketRequest{ftCtx: ftCtx, connection: connection, poster: poster}, request.Body)
+	body, err := json.Marshal(answer)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	err = poster.Deliver(ftCtx, connection, body)
+	if nil != err && sockets.ErrGone != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewSuccessResponse(ftCtx), nil
+}
+
+// dispatch parses the envelope and runs the handler for its action.
+func dispatch(request socketRequest, body string) reply {
+	var message envelope
+	err := json.Unmarshal([]byte(body), &message)
+	if nil != err {
+		return reply{Action: "error", Error: "message is not a valid envelope"}
+	}
+	answer := reply{Action: message.Action, RequestID: message.RequestID}
+	handle, found := actions[message.Action]
+	if !found {
+		answer.Error = fmt.Sprintf("unknown action %q", message.Action)
+		return answer
+	}
+	request.data = message.Data
+	data, err := handle(request)
+	if nil != err {
+		request.ftCtx.RequestLogger.Info().Err(err).Str("action", message.Action).Str("connection", request.connection.ConnectionID).Msg("socket action failed")
+		answer.Error = err.Error()
+		return answer
+	}
+	answer.OK = true
+	answer.Data = data
+	return answer
+}
+
+type pongData struct {
+	Time int `json:"time"`
+}
+
+func handlePing(request socketRequest) (interface{}, error) {
+	return pongData{Time: int(time.Now().UTC().Unix() * 1000)}, nil
+}
+
+type subscribeData struct {
+	GroupID string `json:"groupId"`
+}
+
+// handleSubscribe has messages sent to the group delivered to this
+// connection, as long as the user is a member.
+func handleSubscribe(request socketRequest) (interface{}, error) {
+	var data subscribeData
+	err := json.Unmarshal(request.data, &data)
+	if nil != err || len(data.GroupID) == 0 {
+		return nil, errors.New("subscribe needs a groupId")
+	}
+	member, err := records.IsGroupMember(request.ftCtx, data.GroupID)
+	if nil != err {
+		return nil, err
+	}
+	if !member {
+		return nil, errNotMember
+	}
+	return data, sockets.Subscribe(request.ftCtx, request.connection, data.GroupID)
+}
+
+type sendData struct {
+	UserID  string          `json:"userId,omitempty"`
+	GroupID string          `json:"groupId,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+// deliveredMessage is posted to each recipient connection.
+type deliveredMessage struct {
+	Action string          `json:"action"`
+	From   string          `json:"from"`
+	UserID string          `json:"userId,omitempty"`
+	Group  string          `json:"groupId,omitempty"`
+	SentAt int             `json:"sentAt"`
+	Body   json.RawMessage `json:"message"`
+}
+
+type sendResult struct {
+	Delivered int `json:"delivered"`
+}
+
+// handleSend passes the message on to every connection of a user who shares a
+// group with the sender, or to every connection subscribed to a group the
+// sender is a member of. The sender's own connection is skipped.
+func handleSend(request socketRequest) (interface{}, error) {
+	var data sendData
+	err := json.Unmarshal(request.data, &data)
+	if nil != err || len(data.Message) == 0 || (len(data.UserID) == 0) == (len(data.GroupID) == 0) {
+		return nil, errors.New("send needs a message and either a userId or a groupId")
+	}
+	var connections []sockets.Connection
+	if len(data.GroupID) > 0 {
+		member, err := records.IsGroupMember(request.ftCtx, data.GroupID)
+		if nil != err {
+			return nil, err
+		}
+		if !member {
+			return nil, errNotMember
+		}
+		connections, err = sockets.GroupConnections(request.ftCtx, data.GroupID)
+		if nil != err {
+			return nil, err
+		}
+	} else {
+		shared, err := records.SharesGroup(request.ftCtx, data.UserID)
+		if nil != err {
+			return nil, err
+		}
+		if !shared {
+			return nil, errNoSharedGroup
+		}
+		connections, err = sockets.UserConnections(request.ftCtx, data.UserID)
+		if nil != err {
+			return nil, err
+		}
+	}
+	body, err := json.Marshal(deliveredMessage{
+		Action: "message",
+		From:   request.ftCtx.UserID,
+		UserID: data.UserID,
+		Group:  data.GroupID,
+		SentAt: int(time.Now().UTC().Unix() * 1000),
+		Body:   data.Message,
+	})
+	if nil != err {
+		return nil, err
+	}
+	delivered := 0
+	for _, connection := range connections {
+		if connection.ConnectionID == request.connection.ConnectionID {
+			continue
+		}
+		err = request.poster.Deliver(request.ftCtx, connection, body)
+		if sockets.ErrGone == err {
+			continue
+		}
+		if nil != err {
+			request.ftCtx.RequestLogger.Info().Err(err).Str("connection", connection.ConnectionID).Msg("socket message not delivered")
+			continue
+		}
+		delivered++
+	}
+	request.ftCtx.RequestLogger.Debug().Str("user", data.UserID).Str("group", data.GroupID).Int("delivered", delivered).Msg("socket message sent")
+	return sendResult{Delivered: delivered}, nil
+}
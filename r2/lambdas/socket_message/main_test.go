@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPingIsAnsweredWithRequestID(t *testing.T) {
+	answer := dispatch(socketRequest{}, `{"action":"ping","requestId":"r1"}`)
+	if !answer.OK || answer.Action != "ping" || answer.RequestID != "r1" {
+		t.Errorf("Expected ok ping reply for r1, was %+v", answer)
+	}
+	if _, isPong := answer.Data.(pongData); !isPong {
+		t.Errorf("Expected pong data, was %T", answer.Data)
+	}
+}
+
+func TestUnknownActionIsAnError(t *testing.T) {
+	answer := dispatch(socketRequest{}, `{"action":"dance","requestId":"r2"}`)
+	if answer.OK || len(answer.Error) == 0 || answer.RequestID != "r2" {
+		t.Errorf("Expected error reply for r2, was %+v", answer)
+	}
+}
+
+func TestInvalidEnvelopeIsAnError(t *testing.T) {
+	answer := dispatch(socketRequest{}, `not json`)
+	if answer.OK || answer.Action != "error" {
+		t.Errorf("Expected error reply, was %+v", answer)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs on a schedule and removes the connections API Gateway closed
+// without calling $disconnect. Each K# connection record is looked up through
+// the management API of the endpoint it was opened on, and the ones reported
+// gone are dropped as if they had disconnected, which removes messaging's
+// record of the connection along with ours and tells the user's groups if
+// that leaves the user offline. A connection that cannot be checked is logged
+// and tried again on the next run.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	poster, err := sockets.NewPoster(ftCtx)
+	if nil != err {
+		return err
+	}
+	checked, reaped := 0, 0
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Scan(ftCtx.Context, &dynamodb.ScanInput{
+			TableName:        aws.String(ftdb.GetTableName()),
+			FilterExpression: aws.String("begins_with(#resId, :connection) AND #resId = #refId"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":connection": &types.AttributeValueMemberS{Value: sockets.ConnectionPrefix},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Msg("connection scan failed")
+			return err
+		}
+		for _, connection := range sockets.ConnectionsFromItems(result.Items) {
+			checked++
+			if reap(ftCtx, poster, connection) {
+				reaped++
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	ftCtx.RequestLogger.Info().Int("checked", checked).Int("reaped", reaped).Msg("stale connections removed")
+	return nil
+}
+
+// reap drops the connection if API Gateway reports it gone.
+func reap(ftCtx awsproxy.FTContext, poster *sockets.Poster, connection sockets.Connection) bool {
+	err := poster.Check(ftCtx, connection)
+	if sockets.ErrGone != err {
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("connection", connection.ConnectionID).Msg("connection check failed")
+		}
+		return false
+	}
+	err = sockets.Drop(ftCtx, poster, connection.UserID, connection.ConnectionID)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("connection", connection.ConnectionID).Msg("connection removal failed")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Apple marks the certificates it signs App Store payloads with. The leaf
+// carries the receipt signing extension and the intermediate the Apple
+// Worldwide Developer Relations extension.
+var (
+	appleLeafOID         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	appleIntermediateOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+var errInvalidSignature = errors.New("App Store payload signature is not valid")
+
+type jwsHeader struct {
+	Algorithm string   `json:"alg"`
+	X5C       []string `json:"x5c"`
+}
+
+// verifyAppleJWS checks that the compact JWS was signed with ES256 by a
+// certificate chain that leads to the Apple root, and decodes its payload
+// into claims.
+func verifyAppleJWS(token string, root *x509.Certificate, now time.Time, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidSignature
+	}
+	var header jwsHeader
+	err := decodeSegment(parts[0], &header)
+	if nil != err || header.Algorithm != "ES256" || len(header.X5C) < 2 {
+		return errInvalidSignature
+	}
+	certificates := make([]*x509.Certificate, len(header.X5C))
+	for i, encoded := range header.X5C {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if nil != err {
+			return errInvalidSignature
+		}
+		certificates[i], err = x509.ParseCertificate(der)
+		if nil != err {
+			return errInvalidSignature
+		}
+	}
+	leaf := certificates[0]
+	if !hasExtension(leaf, appleLeafOID) || !hasExtension(certificates[1], appleIntermediateOID) {
+		return errInvalidSignature
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if nil != err {
+		return errInvalidSignature
+	}
+	key, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errInvalidSignature
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if nil != err || len(signature) != 64 {
+		return errInvalidSignature
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return errInvalidSignature
+	}
+	if nil != decodeSegment(parts[1], claims) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func hasExtension(certificate *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if nil != err {
+		return err
+	}
+	return json.Unmarshal(decoded, value)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/sharing"
+	"github.com/sowens-csd/folktells-server/store"
+)
+
+// Handler receives App Store Server Notifications v2. The signed payload and
+// the transaction and renewal information in it must be signed by a chain
+// leading to the Apple root certificate, kept in the parameter named by
+// appleRootCertificateParameter. Notifications for another app or
+// environment are ignored.
+//
+// The subscription's user is the one who last had it verified, or the user
+// whose ID the app set as the purchase's app account token. Their entitlement
+// is updated right away and their online user refreshed from the App Store.
+// Every notification is added to the subscription's history, and one that
+// has been received before is acknowledged without being applied again. One
+// signed before the latest applied to the subscription is stale and only
+// added to the history.
+//
+// POST store/apple/notifications with {"signedPayload": ...}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx := awsproxy.NewFromContext(ctx, "unknown")
+	var body struct {
+		SignedPayload string `json:"signedPayload"`
+	}
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if nil != err || len(body.SignedPayload) == 0 {
+		return awsproxy.HandleError(fmt.Errorf("No signed payload"), ftCtx.RequestLogger), nil
+	}
+	root, err := loadRootCertificate(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	now := time.Now().UTC()
+	notification, err := decodeNotification(body.SignedPayload, root, now)
+	if errInvalidSignature == err {
+		ftCtx.RequestLogger.Info().Err(err).Msg("rejected App Store notification")
+		return awsproxy.NewForbiddenResponse(ftCtx, err.Error()), nil
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	payload := notification.Payload
+	logger := ftCtx.RequestLogger.With().Str("type", payload.NotificationType).Str("subtype", payload.Subtype).Str("notification", payload.NotificationUUID).Logger()
+	received, err := alreadyReceived(ftCtx, notification)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if received {
+		logger.Info().Msg("App Store notification already received")
+		return awsproxy.NewSuccessResponse(ftCtx), nil
+	}
+	userID, outcome, err := applyNotification(ctx, ftCtx, notification, now)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	err = recordNotification(ftCtx, notification, userID, outcome, now)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	logger.Info().Str("user", userID).Str("outcome", outcome).Msg("App Store notification received")
+	return awsproxy.NewSuccessResponse(ftCtx), nil
+}
+
+// applyNotification updates the entitlement of the subscription's user,
+// returning the user and the outcome for the history.
+func applyNotification(ctx context.Context, ftCtx awsproxy.FTContext, notification appStoreNotification, now time.Time) (string, string, error) {
+	data := notification.Payload.Data
+	bundleID := os.Getenv("appleBundleId")
+	environment := os.Getenv("appStoreEnvironment")
+	if (len(bundleID) > 0 && data.BundleID != bundleID) || (len(environment) > 0 && data.Environment != environment) {
+		return "", outcomeIgnored, nil
+	}
+	transaction := notification.Transaction
+	if len(transaction.OriginalTransactionID) == 0 {
+		return "", outcomeIgnored, nil
+	}
+	userID, err := findSubscriptionUser(ftCtx, transaction)
+	if nil != err || len(userID) == 0 {
+		return "", outcomeUnmatched, err
+	}
+	latest, err := entitlements.Advance(ftCtx, entitlements.StoreApple, transaction.OriginalTransactionID, notification.Payload.SignedDate)
+	if nil != err {
+		return userID, "", err
+	}
+	if !latest {
+		return userID, outcomeStale, nil
+	}
+	err = entitlements.Save(ftCtx, userID, notificationEntitlement(notification, now))
+	if nil != err {
+		return userID, "", err
+	}
+	refreshOnlineUser(ctx, userID)
+	return userID, outcomeApplied, nil
+}
+
+// findSubscriptionUser finds the user from the subscription's original
+// transaction, falling back to the app account token when the subscription
+// has not been verified by this back-end. Subscriptions bought before
+// purchases were claimed are matched once the app has its receipt verified
+// again, which older apps do too.
+func findSubscriptionUser(ftCtx awsproxy.FTContext, transaction transactionInfo) (string, error) {
+	userID, err := entitlements.FindUser(ftCtx, entitlements.StoreApple, transaction.OriginalTransactionID)
+	if nil != err || len(userID) > 0 || len(transaction.AppAccountToken) == 0 {
+		return userID, err
+	}
+	user, err := sharing.LoadOnlineUser(ftCtx, transaction.AppAccountToken)
+	var notFound *sharing.UserNotFoundError
+	if errors.As(err, &notFound) || nil == user {
+		return "", nil
+	}
+	if nil != err {
+		return "", err
+	}
+	return transaction.AppAccountToken, nil
+}
+
+// refreshOnlineUser has the store library bring the user's own subscription
+// state up to date too. It is logged if it fails, the entitlement has been
+// updated either way.
+func refreshOnlineUser(ctx context.Context, userID string) {
+	awsproxy.SetupAccessParameters(ctx)
+	userCtx := awsproxy.NewFromContext(ctx, userID)
+	onlineUser, err := sharing.LoadOnlineUser(userCtx, userID)
+	if nil != err {
+		userCtx.RequestLogger.Error().Err(err).Str("user", userID).Msg("online user not refreshed")
+		return
+	}
+	connectPassword, clientSecret, refreshToken, accessToken := awsproxy.AccessParameters()
+	accessConfig := store.AccessConfig{
+		ConnectPassword: connectPassword,
+		ClientSecret:    clientSecret,
+		RefreshToken:    refreshToken,
+		AccessToken:     accessToken,
+	}
+	store.UpdateUserSubscription(userCtx, onlineUser, accessConfig, &http.Client{Timeout: 30 * time.Second})
+}
+
+// loadRootCertificate reads the Apple root certificate, PEM encoded.
+func loadRootCertificate(ftCtx awsproxy.FTContext) (*x509.Certificate, error) {
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return nil, err
+	}
+	name := os.Getenv("appleRootCertificateParameter")
+	if len(name) == 0 {
+		name = "/apple/rootCertificate"
+	}
+	result, err := ssm.NewFromConfig(cfg).GetParameter(ftCtx.Context, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if nil != err {
+		return nil, err
+	}
+	if nil == result.Parameter || nil == result.Parameter.Value {
+		return nil, fmt.Errorf("No value for parameter %s", name)
+	}
+	block, _ := pem.Decode([]byte(*result.Parameter.Value))
+	if nil == block {
+		return nil, fmt.Errorf("Parameter %s is not a PEM certificate", name)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, serial int64, parent *testCertificate, isCA bool, oid []int) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "test " + big.NewInt(serial).String()},
+		NotBefore:             time.Unix(1600000000, 0),
+		NotAfter:              time.Unix(1900000000, 0),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if nil != oid {
+		template.ExtraExtensions = []pkix.Extension{{Id: oid, Value: []byte{0x05, 0x00}}}
+	}
+	signer, signerKey := template, key
+	if nil != parent {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return testCertificate{certificate: certificate, key: key}
+}
+
+// testChain makes a root, and an intermediate and leaf marked the way Apple
+// marks them.
+func testChain(t *testing.T) (testCertificate, testCertificate, testCertificate) {
+	root := newTestCertificate(t, 1, nil, true, nil)
+	intermediate := newTestCertificate(t, 2, &root, true, appleIntermediateOID)
+	leaf := newTestCertificate(t, 3, &intermediate, false, appleLeafOID)
+	return root, intermediate, leaf
+}
+
+func signTestJWS(t *testing.T, leaf, intermediate testCertificate, claims interface{}) string {
+	header, _ := json.Marshal(jwsHeader{
+		Algorithm: "ES256",
+		X5C: []string{
+			base64.StdEncoding.EncodeToString(leaf.certificate.Raw),
+			base64.StdEncoding.EncodeToString(intermediate.certificate.Raw),
+		},
+	})
+	payload, err := json.Marshal(claims)
+	if nil != err {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, leaf.key, digest[:])
+	if nil != err {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyAppleJWS(t *testing.T) {
+	root, intermediate, leaf := testChain(t)
+	now := time.Unix(1700000000, 0)
+	token := signTestJWS(t, leaf, intermediate, renewalInfo{OriginalTransactionID: "1000", AutoRenewStatus: 1})
+	var renewal renewalInfo
+	err := verifyAppleJWS(token, root.certificate, now, &renewal)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if renewal.OriginalTransactionID != "1000" || renewal.AutoRenewStatus != 1 {
+		t.Errorf("Expected the signed renewal info, was %+v", renewal)
+	}
+	parts := strings.Split(token, ".")
+	tampered, _ := json.Marshal(renewalInfo{OriginalTransactionID: "2000", AutoRenewStatus: 1})
+	parts[1] = base64.RawURLEncoding.EncodeToString(tampered)
+	if verifyAppleJWS(strings.Join(parts, "."), root.certificate, now, &renewal) != errInvalidSignature {
+		t.Error("Expected a tampered payload to be rejected")
+	}
+	otherRoot, _, _ := testChain(t)
+	if verifyAppleJWS(token, otherRoot.certificate, now, &renewal) != errInvalidSignature {
+		t.Error("Expected a chain to another root to be rejected")
+	}
+	if verifyAppleJWS(token, root.certificate, time.Unix(2000000000, 0), &renewal) != errInvalidSignature {
+		t.Error("Expected an expired chain to be rejected")
+	}
+	unmarked := newTestCertificate(t, 4, &intermediate, false, nil)
+	if verifyAppleJWS(signTestJWS(t, unmarked, intermediate, renewal), root.certificate, now, &renewal) != errInvalidSignature {
+		t.Error("Expected a leaf without the Apple extension to be rejected")
+	}
+}
+
+func TestDecodeNotification(t *testing.T) {
+	root, intermediate, leaf := testChain(t)
+	now := time.Unix(1700000000, 0)
+	payload := notificationPayload{
+		NotificationType: "DID_RENEW",
+		NotificationUUID: "abc",
+		SignedDate:       1699999999000,
+		Data: notificationData{
+			BundleID:    "com.folktells.app",
+			Environment: "Production",
+			SignedTransactionInfo: signTestJWS(t, leaf, intermediate, transactionInfo{
+				OriginalTransactionID: "1000",
+				ProductID:             "yearly",
+				ExpiresDate:           1730000000000,
+			}),
+			SignedRenewalInfo: signTestJWS(t, leaf, intermediate, renewalInfo{OriginalTransactionID: "1000", AutoRenewStatus: 1}),
+		},
+	}
+	notification, err := decodeNotification(signTestJWS(t, leaf, intermediate, payload), root.certificate, now)
+	if nil != err {
+		t.Fatal(err)
+	}
+	current := notificationEntitlement(notification, now)
+	if current.Store != entitlements.StoreApple || current.ProductID != "yearly" || current.OriginalTransactionID != "1000" {
+		t.Errorf("Expected the yearly subscription, was %+v", current)
+	}
+	if !current.Active || !current.AutoRenew || current.Revoked || current.UpdatedAt != int(now.Unix()*1000) {
+		t.Errorf("Expected an active renewing subscription, was %+v", current)
+	}
+	notification.Transaction.RevocationDate = 1699999990000
+	current = notificationEntitlement(notification, now)
+	if current.Active || !current.Revoked {
+		t.Errorf("Expected a revoked subscription, was %+v", current)
+	}
+	notification.Transaction.RevocationDate = 0
+	notification.Transaction.ExpiresDate = 1690000000000
+	if notificationEntitlement(notification, now).Active {
+		t.Error("Expected an expired subscription to be inactive")
+	}
+	payload.Data.SignedRenewalInfo = "not.a.jws"
+	_, err = decodeNotification(signTestJWS(t, leaf, intermediate, payload), root.certificate, now)
+	if errInvalidSignature != err {
+		t.Errorf("Expected bad renewal info to be rejected, was %v", err)
+	}
+}
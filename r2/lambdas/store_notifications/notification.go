@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// Each notification received is kept as
+// O#notification#{signedDate}#{notificationUUID} under the subscription's
+// O#transaction#apple#{originalTransactionID}, in the order Apple signed
+// them. Notifications without a transaction, such as TEST, go under the
+// empty transaction.
+const notificationPrefix = "O#notification#"
+
+// The outcome of a notification in the history.
+const (
+	outcomeApplied   = "applied"
+	outcomeStale     = "stale"
+	outcomeUnmatched = "unmatched"
+	outcomeIgnored   = "ignored"
+)
+
+// notificationPayload is the decoded responseBodyV2 payload.
+type notificationPayload struct {
+	NotificationType string           `json:"notificationType"`
+	Subtype          string           `json:"subtype"`
+	NotificationUUID string           `json:"notificationUUID"`
+	Version          string           `json:"version"`
+	SignedDate       int64            `json:"signedDate"`
+	Data             notificationData `json:"data"`
+}
+
+type notificationData struct {
+	BundleID              string `json:"bundleId"`
+	Environment           string `json:"environment"`
+	SignedTransactionInfo string `json:"signedTransactionInfo"`
+	SignedRenewalInfo     string `json:"signedRenewalInfo"`
+}
+
+// transactionInfo and renewalInfo are the decoded signed transaction and
+// renewal information, times in milliseconds.
+type transactionInfo struct {
+	OriginalTransactionID string `json:"originalTransactionId"`
+	TransactionID         string `json:"transactionId"`
+	ProductID             string `json:"productId"`
+	BundleID              string `json:"bundleId"`
+	ExpiresDate           int64  `json:"expiresDate"`
+	RevocationDate        int64  `json:"revocationDate"`
+	AppAccountToken       string `json:"appAccountToken"`
+}
+
+type renewalInfo struct {
+	OriginalTransactionID string `json:"originalTransactionId"`
+	AutoRenewStatus       int    `json:"autoRenewStatus"`
+}
+
+// appStoreNotification is a verified notification with its transaction and
+// renewal information, which are empty when it has none.
+type appStoreNotification struct {
+	Payload     notificationPayload
+	Transaction transactionInfo
+	Renewal     renewalInfo
+}
+
+// decodeNotification verifies the signed payload and the signed transaction
+// and renewal information inside it.
+func decodeNotification(signedPayload string, root *x509.Certificate, now time.Time) (appStoreNotification, error) {
+	var notification appStoreNotification
+	err := verifyAppleJWS(signedPayload, root, now, &notification.Payload)
+	if nil != err {
+		return notification, err
+	}
+	if len(notification.Payload.Data.SignedTransactionInfo) > 0 {
+		err = verifyAppleJWS(notification.Payload.Data.SignedTransactionInfo, root, now, &notification.Transaction)
+		if nil != err {
+			return notification, err
+		}
+	}
+	if len(notification.Payload.Data.SignedRenewalInfo) > 0 {
+		err = verifyAppleJWS(notification.Payload.Data.SignedRenewalInfo, root, now, &notification.Renewal)
+		if nil != err {
+			return notification, err
+		}
+	}
+	return notification, nil
+}
+
+// notificationEntitlement is what the notification's transaction entitles the
+// user to. Every notification carries the subscription's latest transaction,
+// so renewals, expiry, refunds and revocations all come down to its expiry
+// and revocation dates.
+func notificationEntitlement(notification appStoreNotification, now time.Time) entitlements.Entitlement {
+	transaction := notification.Transaction
+	nowMs := int(now.Unix() * 1000)
+	current := entitlements.Entitlement{
+		Store:                 entitlements.StoreApple,
+		ProductID:             transaction.ProductID,
+		OriginalTransactionID: transaction.OriginalTransactionID,
+		ExpiresAt:             int(transaction.ExpiresDate),
+		AutoRenew:             notification.Renewal.AutoRenewStatus == 1,
+		Revoked:               transaction.RevocationDate > 0,
+		UpdatedAt:             nowMs,
+	}
+	current.Active = !current.Revoked && (current.ExpiresAt == 0 || current.ExpiresAt > nowMs)
+	return current
+}
+
+func notificationReferenceID(payload notificationPayload) string {
+	return fmt.Sprintf("%s%013d#%s", notificationPrefix, payload.SignedDate, payload.NotificationUUID)
+}
+
+// alreadyReceived checks the history for the notification, Apple sends a
+// notification again until it is acknowledged.
+func alreadyReceived(ftCtx awsproxy.FTContext, notification appStoreNotification) (bool, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: entitlements.TransactionResourceID(entitlements.StoreApple, notification.Transaction.OriginalTransactionID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: notificationReferenceID(notification.Payload)},
+		},
+	})
+	if nil != err {
+		return false, err
+	}
+	return len(result.Item) > 0, nil
+}
+
+// recordNotification adds the notification and what was done with it to the
+// subscription's history.
+func recordNotification(ftCtx awsproxy.FTContext, notification appStoreNotification, userID, outcome string, receivedAt time.Time) error {
+	payload := notification.Payload
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: entitlements.TransactionResourceID(entitlements.StoreApple, notification.Transaction.OriginalTransactionID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: notificationReferenceID(payload)},
+			"notificationType":    &types.AttributeValueMemberS{Value: payload.NotificationType},
+			"subtype":             &types.AttributeValueMemberS{Value: payload.Subtype},
+			"notificationUUID":    &types.AttributeValueMemberS{Value: payload.NotificationUUID},
+			"environment":         &types.AttributeValueMemberS{Value: payload.Data.Environment},
+			"productId":           &types.AttributeValueMemberS{Value: notification.Transaction.ProductID},
+			"transactionId":       &types.AttributeValueMemberS{Value: notification.Transaction.TransactionID},
+			"userId":              &types.AttributeValueMemberS{Value: userID},
+			"outcome":             &types.AttributeValueMemberS{Value: outcome},
+			"signedDate":          &types.AttributeValueMemberN{Value: fmt.Sprint(payload.SignedDate)},
+			"receivedAt":          &types.AttributeValueMemberN{Value: fmt.Sprint(receivedAt.Unix() * 1000)},
+		},
+	})
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// settled is late enough that no change in these tests is held back.
+const settled = 1 << 40
+
+func TestChangesSplitIntoStoriesAndTombstones(t *testing.T) {
+	changes := newStoryChanges(100, nil)
+	items := []map[string]types.AttributeValue{
+		changedItem("S#story1", "story1", 150),
+		changedItem("D#story2", "", 300),
+		changedItem("M#user1", "user1", 400),
+	}
+	collectChanges(&changes, "GroupId1", items, 100, nil, settled)
+	if 1 != len(changes.Stories) || changes.Stories[0].StoryID != "story1" {
+		t.Errorf("Expected story1 to be changed, was %v", changes.Stories)
+	}
+	if 1 != len(changes.Tombstones) || changes.Tombstones[0].StoryID != "story2" {
+		t.Errorf("Expected story2 to be deleted, was %v", changes.Tombstones)
+	}
+	if changes.Cursor != 300 {
+		t.Errorf("Expected cursor 300, was %d", changes.Cursor)
+	}
+}
+
+func TestDeletedStoryIsTombstone(t *testing.T) {
+	changes := newStoryChanges(100, nil)
+	item := changedItem("S#story1", "story1", 200)
+	item[deletedAtField] = &types.AttributeValueMemberN{Value: "200"}
+	collectChanges(&changes, "GroupId1", []map[string]types.AttributeValue{item}, 100, nil, settled)
+	if 0 != len(changes.Stories) {
+		t.Errorf("Expected no changed stories, was %v", changes.Stories)
+	}
+	if 1 != len(changes.Tombstones) || changes.Tombstones[0].StoryID != "story1" {
+		t.Errorf("Expected story1 to be deleted, was %v", changes.Tombstones)
+	}
+}
+
+func TestNoChangesKeepsCursor(t *testing.T) {
+	seen := map[string]bool{"GroupId1/S#story1": true}
+	changes := newStoryChanges(100, seen)
+	collectChanges(&changes, "GroupId1", nil, 100, seen, settled)
+	if changes.Cursor != 100 || len(changes.Seen) != 1 || changes.Seen[0] != "GroupId1/S#story1" {
+		t.Errorf("Expected cursor 100 with story1 seen, was %d %v", changes.Cursor, changes.Seen)
+	}
+}
+
+func TestChangesAtCursorNotSeenAreReturned(t *testing.T) {
+	seen := map[string]bool{"GroupId1/S#story1": true}
+	changes := newStoryChanges(100, seen)
+	items := []map[string]types.AttributeValue{
+		changedItem("S#story1", "story1", 100),
+		changedItem("S#story2", "story2", 100),
+	}
+	collectChanges(&changes, "GroupId1", items, 100, seen, settled)
+	if 1 != len(changes.Stories) || changes.Stories[0].StoryID != "story2" {
+		t.Errorf("Expected only story2 to be changed, was %v", changes.Stories)
+	}
+	if changes.Cursor != 100 || len(changes.Seen) != 2 {
+		t.Errorf("Expected both stories seen at 100, was %d %v", changes.Cursor, changes.Seen)
+	}
+	collectChanges(&changes, "GroupId2", []map[string]types.AttributeValue{changedItem("S#story3", "story3", 200)}, 100, seen, settled)
+	if changes.Cursor != 200 || len(changes.Seen) != 1 || changes.Seen[0] != "GroupId2/S#story3" {
+		t.Errorf("Expected cursor 200 with story3 seen, was %d %v", changes.Cursor, changes.Seen)
+	}
+}
+
+func TestChangesAfterSettledDoNotMoveCursor(t *testing.T) {
+	changes := newStoryChanges(100, nil)
+	items := []map[string]types.AttributeValue{
+		changedItem("S#story1", "story1", 150),
+		changedItem("S#story2", "story2", 300),
+	}
+	collectChanges(&changes, "GroupId1", items, 100, nil, 200)
+	if 2 != len(changes.Stories) {
+		t.Errorf("Expected both stories to be changed, was %v", changes.Stories)
+	}
+	if changes.Cursor != 150 || len(changes.Seen) != 1 || changes.Seen[0] != "GroupId1/S#story1" {
+		t.Errorf("Expected cursor 150 with story1 seen, was %d %v", changes.Cursor, changes.Seen)
+	}
+}
+
+func changedItem(referenceID string, id string, lastUpdated int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		ftdb.ResourceIDField:    &types.AttributeValueMemberS{Value: "G#GroupId1"},
+		ftdb.ReferenceIDField:   &types.AttributeValueMemberS{Value: referenceID},
+		ftdb.IDField:            &types.AttributeValueMemberS{Value: id},
+		ftdb.LastUpdatedField:   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", lastUpdated)},
+		ftdb.LastUpdatedByField: &types.AttributeValueMemberS{Value: "user1"},
+	}
+}
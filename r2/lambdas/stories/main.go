@@ -2,25 +2,321 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
 	"github.com/sowens-csd/folktells-server/sharing"
 )
 
-// Handler is our lambda handler invoked by the `lambda.Start` function call
+// storyReferencePrefix marks story items within a group, S#{storyID}
+const storyReferencePrefix = "S#"
+
+// lastUpdatedIndex is the story table index keyed on resId and lastUpdated
+// that delta sync reads a group's changes from, created by index.sh. Items
+// without a lastUpdated are not in it.
+const lastUpdatedIndex = "resId-lastUpdated-index"
+
+// indexSettleMillis is how far behind the sync the cursor is kept. The index
+// is updated shortly after the table, a change written just before a newer
+// one can show up after it, so the cursor never passes the time the index may
+// still be catching up on.
+const indexSettleMillis = 5000
+
+// tombstoneReferencePrefix marks a deleted story within a group, D#{storyID}.
+// The tombstone keeps the LastUpdated of the delete so that syncing clients
+// learn about stories that no longer exist.
+const tombstoneReferencePrefix = "D#"
+
+// deletedAtField and deletedByField are set on a story that has been moved to
+// the trash, it is reported as a tombstone until it is restored.
+const deletedAtField = "deletedAt"
+const deletedByField = "deletedBy"
+
+// changedStory is a story that was created or updated after the sync cursor.
+type changedStory struct {
+	GroupID       string `json:"groupId"`
+	StoryID       string `json:"id"`
+	Content       string `json:"content"`
+	Version       string `json:"version"`
+	BaseVersion   string `json:"baseVersion"`
+	LastUpdated   int    `json:"lastUpdated"`
+	LastUpdatedBy string `json:"lastUpdatedBy"`
+	StorySource   string `json:"storySource"`
+}
+
+// storyTombstone tells the client to remove a story it has cached.
+type storyTombstone struct {
+	GroupID   string `json:"groupId"`
+	StoryID   string `json:"id"`
+	DeletedAt int    `json:"deletedAt"`
+	DeletedBy string `json:"deletedBy"`
+}
+
+// storyChanges is the response for a delta sync. The client should keep Cursor
+// and Seen and send them as the since and seen parameters on the next sync.
+// Several writes can share the cursor's millisecond, so the next sync looks
+// from the cursor itself and Seen lists the changes at that millisecond the
+// client already has, as {groupID}/{referenceID}. The cursor stays
+// indexSettleMillis behind the time of the sync, so changes newer than that
+// are sent again on the next sync.
+type storyChanges struct {
+	Cursor     int              `json:"cursor"`
+	Seen       []string         `json:"seen"`
+	Stories    []changedStory   `json:"stories"`
+	Tombstones []storyTombstone `json:"tombstones"`
+}
+
+// Handler returns the stories shared with the user. With no parameters every
+// story is returned. When a since parameter is provided only the stories that
+// were created, updated or deleted since that cursor are returned, leaving out
+// the ones listed in the seen parameter, comma separated and URL encoded as
+// the # in a reference would otherwise start the fragment. A q
+// parameter searches the stories, optionally filtered by groupId, author and
+// a from and to date.
+// https://devapi.folktells.com/r2/stories?since=1583440478299&seen=group1%2FS%23story1
+// https://devapi.folktells.com/r2/stories?q=grandpa+fishing&author=user1
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
 	if nil != errResp {
 		return *errResp, nil
 	}
+	if query, found := request.QueryStringParameters["q"]; found {
+		filter, err := parseSearchFilter(request.QueryStringParameters)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		results, err := searchStories(ftCtx, query, filter)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, results), nil
+	}
+	sinceParam, found := request.QueryStringParameters["since"]
+	if found {
+		since, err := strconv.Atoi(sinceParam)
+		if nil != err {
+			return awsproxy.HandleError(fmt.Errorf("since must be a number, was %s", sinceParam), ftCtx.RequestLogger), nil
+		}
+		changes, err := findStoryChangesForUser(ftCtx, since, parseSeen(request.QueryStringParameters["seen"]))
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, changes), nil
+	}
 	stories, err := sharing.FindSharedStoriesForUser(ftCtx)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
+	deleted, err := findDeletedStoriesForUser(ftCtx)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if len(deleted) > 0 {
+		visible := stories.Stories[:0]
+		for _, story := range stories.Stories {
+			if !deleted[story.StoryID] {
+				visible = append(visible, story)
+			}
+		}
+		stories.Stories = visible
+	}
 	return awsproxy.NewJSONResponse(ftCtx, stories), nil
 }
 
+// findDeletedStoriesForUser finds the stories in the user's groups that are in
+// the trash so that they can be left out of the full story list.
+func findDeletedStoriesForUser(ftCtx awsproxy.FTContext) (map[string]bool, error) {
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	deleted := map[string]bool{}
+	for _, groupID := range groups {
+		result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+			TableName:              aws.String(ftdb.GetTableName()),
+			KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :story)"),
+			FilterExpression:       aws.String("attribute_exists(#deletedAt)"),
+			ProjectionExpression:   aws.String("#id"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId":     ftdb.ResourceIDField,
+				"#refId":     ftdb.ReferenceIDField,
+				"#deletedAt": deletedAtField,
+				"#id":        ftdb.IDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":resId": &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(groupID)},
+				":story": &types.AttributeValueMemberS{Value: storyReferencePrefix},
+			},
+		})
+		if nil != err {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			deleted[stringAttribute(item, ftdb.IDField)] = true
+		}
+	}
+	return deleted, nil
+}
+
+// parseSeen splits the seen parameter, the changes at the cursor's
+// millisecond the client already has.
+func parseSeen(param string) map[string]bool {
+	seen := map[string]bool{}
+	for _, key := range strings.Split(param, ",") {
+		if len(key) > 0 {
+			seen[key] = true
+		}
+	}
+	return seen
+}
+
+// findStoryChangesForUser looks through every group the user belongs to for
+// stories and tombstones updated at or after the since cursor that the client
+// has not already seen.
+func findStoryChangesForUser(ftCtx awsproxy.FTContext, since int, seen map[string]bool) (*storyChanges, error) {
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	changes := newStoryChanges(since, seen)
+	settled := int(time.Now().UTC().Unix()*1000) - indexSettleMillis
+	for _, groupID := range groups {
+		items, err := queryGroupChanges(ftCtx, groupID, since)
+		if nil != err {
+			return nil, err
+		}
+		collectChanges(&changes, groupID, items, since, seen, settled)
+	}
+	ftCtx.RequestLogger.Debug().Int("since", since).Int("cursor", changes.Cursor).Int("stories", len(changes.Stories)).Int("tombstones", len(changes.Tombstones)).Msg("story changes")
+	return &changes, nil
+}
+
+// newStoryChanges starts from the client's cursor, which stays where it is
+// with the same changes seen when nothing newer has changed.
+func newStoryChanges(since int, seen map[string]bool) storyChanges {
+	changes := storyChanges{
+		Cursor:     since,
+		Seen:       []string{},
+		Stories:    []changedStory{},
+		Tombstones: []storyTombstone{},
+	}
+	for key := range seen {
+		changes.Seen = append(changes.Seen, key)
+	}
+	sort.Strings(changes.Seen)
+	return changes
+}
+
+// queryGroupChanges reads the items under the group updated at or after
+// since from the lastUpdated index, so only the changes are read.
+func queryGroupChanges(ftCtx awsproxy.FTContext, groupID string, since int) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+			TableName:              aws.String(ftdb.GetTableName()),
+			IndexName:              aws.String(lastUpdatedIndex),
+			KeyConditionExpression: aws.String("#resId = :resId AND #lastUpdated >= :since"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId":       ftdb.ResourceIDField,
+				"#lastUpdated": ftdb.LastUpdatedField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":resId": &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(groupID)},
+				":since": &types.AttributeValueMemberN{Value: strconv.Itoa(since)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			return nil, err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+// collectChanges sorts the changed items for a group into stories and
+// tombstones, ignoring anything else stored under the group and the changes
+// at the cursor the client has seen, and moves the cursor forward to the
+// newest change up to settled.
+func collectChanges(changes *storyChanges, groupID string, items []map[string]types.AttributeValue, since int, seen map[string]bool, settled int) {
+	for _, item := range items {
+		referenceID := stringAttribute(item, ftdb.ReferenceIDField)
+		lastUpdated := numberAttribute(item, ftdb.LastUpdatedField)
+		key := groupID + "/" + referenceID
+		if lastUpdated < since || (lastUpdated == since && seen[key]) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(referenceID, storyReferencePrefix) && numberAttribute(item, deletedAtField) > 0:
+			changes.Tombstones = append(changes.Tombstones, storyTombstone{
+				GroupID:   groupID,
+				StoryID:   stringAttribute(item, ftdb.IDField),
+				DeletedAt: numberAttribute(item, deletedAtField),
+				DeletedBy: stringAttribute(item, deletedByField),
+			})
+		case strings.HasPrefix(referenceID, storyReferencePrefix):
+			changes.Stories = append(changes.Stories, changedStory{
+				GroupID:       groupID,
+				StoryID:       stringAttribute(item, ftdb.IDField),
+				Content:       stringAttribute(item, ftdb.ContentField),
+				Version:       stringAttribute(item, ftdb.VersionField),
+				BaseVersion:   stringAttribute(item, ftdb.BaseVersionField),
+				LastUpdated:   lastUpdated,
+				LastUpdatedBy: stringAttribute(item, ftdb.LastUpdatedByField),
+				StorySource:   stringAttribute(item, ftdb.StorySourceField),
+			})
+		case strings.HasPrefix(referenceID, tombstoneReferencePrefix):
+			changes.Tombstones = append(changes.Tombstones, storyTombstone{
+				GroupID:   groupID,
+				StoryID:   strings.TrimPrefix(referenceID, tombstoneReferencePrefix),
+				DeletedAt: lastUpdated,
+				DeletedBy: stringAttribute(item, ftdb.LastUpdatedByField),
+			})
+		default:
+			continue
+		}
+		if lastUpdated > settled {
+			continue
+		}
+		if lastUpdated > changes.Cursor {
+			changes.Cursor = lastUpdated
+			changes.Seen = []string{key}
+		} else if lastUpdated == changes.Cursor {
+			changes.Seen = append(changes.Seen, key)
+		}
+	}
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func numberAttribute(item map[string]types.AttributeValue, name string) int {
+	if value, ok := item[name].(*types.AttributeValueMemberN); ok {
+		number, err := strconv.Atoi(value.Value)
+		if nil == err {
+			return number
+		}
+	}
+	return 0
+}
+
 func main() {
 	lambda.Start(Handler)
 }
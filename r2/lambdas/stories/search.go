@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/search"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// maxQueryTerms limits how many index lookups a single search can cause.
+const maxQueryTerms = 8
+
+// defaultSearchLimit and maxSearchLimit bound the number of results returned.
+const defaultSearchLimit = 20
+const maxSearchLimit = 50
+
+// snippetRadius is how many characters of context are kept either side of the
+// first match in a snippet.
+const snippetRadius = 60
+
+// searchFilter narrows a search to a group, an author or a date range. The
+// author is the user who first saved the story. Dates are milliseconds since
+// the epoch like LastUpdated, zero means no limit.
+type searchFilter struct {
+	GroupID string
+	Author  string
+	From    int
+	To      int
+	Limit   int
+}
+
+// highlight is a match within a snippet, Start and End are byte offsets.
+type highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type searchResult struct {
+	GroupID       string      `json:"groupId"`
+	StoryID       string      `json:"id"`
+	Score         int         `json:"score"`
+	Snippet       string      `json:"snippet"`
+	Highlights    []highlight `json:"highlights"`
+	LastUpdated   int         `json:"lastUpdated"`
+	LastUpdatedBy string      `json:"lastUpdatedBy"`
+	Author        string      `json:"author"`
+}
+
+type searchResults struct {
+	Query   string         `json:"query"`
+	Results []searchResult `json:"results"`
+}
+
+// storyMatch collects the postings for one story across the query terms.
+type storyMatch struct {
+	groupID       string
+	storyID       string
+	matchedTerms  int
+	frequency     int
+	lastUpdated   int
+	lastUpdatedBy string
+	author        string
+}
+
+func queryTerms(query string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, term := range search.Tokenize(query) {
+		if !seen[term] && len(terms) < maxQueryTerms {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func parseSearchFilter(params map[string]string) (searchFilter, error) {
+	filter := searchFilter{
+		GroupID: params["groupId"],
+		Author:  params["author"],
+		Limit:   defaultSearchLimit,
+	}
+	var err error
+	if from, found := params["from"]; found {
+		filter.From, err = strconv.Atoi(from)
+		if nil != err {
+			return filter, fmt.Errorf("from must be a number, was %s", from)
+		}
+	}
+	if to, found := params["to"]; found {
+		filter.To, err = strconv.Atoi(to)
+		if nil != err {
+			return filter, fmt.Errorf("to must be a number, was %s", to)
+		}
+	}
+	if limit, found := params["limit"]; found {
+		filter.Limit, err = strconv.Atoi(limit)
+		if nil != err || filter.Limit < 1 {
+			return filter, fmt.Errorf("limit must be a positive number, was %s", limit)
+		}
+		if filter.Limit > maxSearchLimit {
+			filter.Limit = maxSearchLimit
+		}
+	}
+	return filter, nil
+}
+
+// searchStories finds the stories the user can see that contain the query
+// terms. Stories matching more of the terms rank first, then stories where the
+// terms appear more often, then the most recently updated.
+func searchStories(ftCtx awsproxy.FTContext, query string, filter searchFilter) (*searchResults, error) {
+	results := searchResults{Query: query, Results: []searchResult{}}
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return &results, nil
+	}
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	matches := map[string]*storyMatch{}
+	for _, groupID := range groups {
+		if len(filter.GroupID) > 0 && filter.GroupID != groupID {
+			continue
+		}
+		for _, term := range terms {
+			postings, err := search.Postings(ftCtx, groupID, term)
+			if nil != err {
+				return nil, err
+			}
+			for _, posting := range postings {
+				addPosting(matches, groupID, posting, filter)
+			}
+		}
+	}
+	for _, match := range rankMatches(matches) {
+		if len(results.Results) >= filter.Limit {
+			break
+		}
+		content, visible, err := loadStoryContent(ftCtx, match.groupID, match.storyID)
+		if nil != err {
+			return nil, err
+		}
+		if !visible {
+			continue
+		}
+		snippet, highlights := buildSnippet(content, terms)
+		results.Results = append(results.Results, searchResult{
+			GroupID:       match.groupID,
+			StoryID:       match.storyID,
+			Score:         match.matchedTerms*1000 + match.frequency,
+			Snippet:       snippet,
+			Highlights:    highlights,
+			LastUpdated:   match.lastUpdated,
+			LastUpdatedBy: match.lastUpdatedBy,
+			Author:        match.author,
+		})
+	}
+	ftCtx.RequestLogger.Debug().Strs("terms", terms).Int("matches", len(matches)).Int("results", len(results.Results)).Msg("story search")
+	return &results, nil
+}
+
+// addPosting adds a term posting to the story it belongs to, unless the story
+// is excluded by the author or date filters.
+func addPosting(matches map[string]*storyMatch, groupID string, posting search.Posting, filter searchFilter) {
+	if len(filter.Author) > 0 && filter.Author != posting.Author {
+		return
+	}
+	if (filter.From > 0 && posting.LastUpdated < filter.From) || (filter.To > 0 && posting.LastUpdated > filter.To) {
+		return
+	}
+	key := groupID + "#" + posting.StoryID
+	match, found := matches[key]
+	if !found {
+		match = &storyMatch{
+			groupID:       groupID,
+			storyID:       posting.StoryID,
+			lastUpdated:   posting.LastUpdated,
+			lastUpdatedBy: posting.LastUpdatedBy,
+			author:        posting.Author,
+		}
+		matches[key] = match
+	}
+	match.matchedTerms++
+	match.frequency += posting.Frequency
+}
+
+func rankMatches(matches map[string]*storyMatch) []*storyMatch {
+	ranked := make([]*storyMatch, 0, len(matches))
+	for _, match := range matches {
+		ranked = append(ranked, match)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].matchedTerms != ranked[j].matchedTerms {
+			return ranked[i].matchedTerms > ranked[j].matchedTerms
+		}
+		if ranked[i].frequency != ranked[j].frequency {
+			return ranked[i].frequency > ranked[j].frequency
+		}
+		return ranked[i].lastUpdated > ranked[j].lastUpdated
+	})
+	return ranked
+}
+
+// loadStoryContent reads the current content of a matched story. A story that
+// has since been removed or moved to the trash is not visible.
+func loadStoryContent(ftCtx awsproxy.FTContext, groupID, storyID string) (string, bool, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(groupID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: storyReferencePrefix + storyID},
+		},
+	})
+	if nil != err {
+		return "", false, err
+	}
+	if len(result.Item) == 0 || numberAttribute(result.Item, deletedAtField) > 0 {
+		return "", false, nil
+	}
+	return stringAttribute(result.Item, ftdb.ContentField), true, nil
+}
+
+// buildSnippet cuts the content down to the text around the first query term
+// found and marks every whole word occurrence of the terms within it.
+func buildSnippet(content string, terms []string) (string, []highlight) {
+	matched := map[string]bool{}
+	for _, term := range terms {
+		matched[term] = true
+	}
+	type word struct{ start, end int }
+	var words []word
+	start := -1
+	for i, r := range content {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			words = append(words, word{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, word{start, len(content)})
+	}
+	isMatch := func(w word) bool {
+		return matched[strings.ToLower(content[w.start:w.end])]
+	}
+	first := 0
+	for _, w := range words {
+		if isMatch(w) {
+			first = w.start
+			break
+		}
+	}
+	from := runeBoundary(content, first-snippetRadius)
+	to := runeBoundary(content, first+snippetRadius)
+	highlights := []highlight{}
+	for _, w := range words {
+		if w.start >= from && w.end <= to && isMatch(w) {
+			highlights = append(highlights, highlight{Start: w.start - from, End: w.end - from})
+		}
+	}
+	return content[from:to], highlights
+}
+
+// runeBoundary clamps an offset into the content and moves it back to the
+// start of a rune so that a snippet never splits a character.
+func runeBoundary(content string, offset int) int {
+	if offset <= 0 {
+		return 0
+	}
+	if offset >= len(content) {
+		return len(content)
+	}
+	for offset > 0 && !isRuneStart(content[offset]) {
+		offset--
+	}
+	return offset
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/search"
+)
+
+func TestSnippetHighlightsMatchedWords(t *testing.T) {
+	snippet, highlights := buildSnippet("# Fishing\nGrandpa took us fishing at the lake.", []string{"fishing"})
+	if 2 != len(highlights) {
+		t.Fatalf("Expected 2 highlights, was %v", highlights)
+	}
+	for _, h := range highlights {
+		if snippet[h.Start:h.End] != "Fishing" && snippet[h.Start:h.End] != "fishing" {
+			t.Errorf("Highlight %v is %s", h, snippet[h.Start:h.End])
+		}
+	}
+}
+
+func TestMoreMatchedTermsRankFirst(t *testing.T) {
+	matches := map[string]*storyMatch{
+		"g#story1": {storyID: "story1", matchedTerms: 1, frequency: 9},
+		"g#story2": {storyID: "story2", matchedTerms: 2, frequency: 2},
+	}
+	ranked := rankMatches(matches)
+	if ranked[0].storyID != "story2" {
+		t.Errorf("Expected story2 first, was %s", ranked[0].storyID)
+	}
+}
+
+func TestQueryDropsStopWordsAndDuplicates(t *testing.T) {
+	terms := queryTerms("The lake and THE Lake house")
+	if 2 != len(terms) || terms[0] != "lake" || terms[1] != "house" {
+		t.Errorf("Unexpected terms %v", terms)
+	}
+}
+
+func TestAuthorFilterUsesTheStoryAuthor(t *testing.T) {
+	matches := map[string]*storyMatch{}
+	filter := searchFilter{Author: "author1"}
+	addPosting(matches, "g", search.Posting{StoryID: "story1", Author: "author1", LastUpdatedBy: "editor1"}, filter)
+	addPosting(matches, "g", search.Posting{StoryID: "story2", Author: "editor1", LastUpdatedBy: "author1"}, filter)
+	if len(matches) != 1 || matches["g#story1"] == nil {
+		t.Errorf("Expected only story1, was %v", matches)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// exportReferencePrefix marks an export job for the user that asked for it,
+// E#{jobID} under U#{userID}.
+const exportReferencePrefix = "E#"
+
+// exportPending is the status of a job until the worker completes or fails it.
+const exportPending = "pending"
+
+// exportRequest asks for the stories of one group, or every story the user can
+// see when GroupID is empty.
+type exportRequest struct {
+	GroupID string `json:"groupId"`
+}
+
+// exportJob tracks an export from request to the emailed download link. The
+// story_export_worker lambda is invoked with the job and fills in the rest.
+type exportJob struct {
+	JobID       string `json:"jobId" dynamodbav:"jobId"`
+	UserID      string `json:"userId" dynamodbav:"userId"`
+	GroupID     string `json:"groupId,omitempty" dynamodbav:"groupId"`
+	Status      string `json:"status" dynamodbav:"status"`
+	CreatedAt   int    `json:"createdAt" dynamodbav:"createdAt"`
+	CompletedAt int    `json:"completedAt,omitempty" dynamodbav:"completedAt"`
+	StoryCount  int    `json:"storyCount,omitempty" dynamodbav:"storyCount"`
+	ArchiveKey  string `json:"-" dynamodbav:"archiveKey"`
+	ExpiresAt   int    `json:"expiresAt,omitempty" dynamodbav:"expiresAt"`
+	Error       string `json:"error,omitempty" dynamodbav:"error"`
+}
+
+// Handler starts an export of the user's stories, or with a jobID path
+// parameter reports how an earlier export is progressing. The archive is built
+// in the background and a download link is emailed to the user when it is
+// ready.
+//
+// POST stories/export {"groupId": "..."}
+// GET stories/export/{jobID}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	if jobID, found := request.PathParameters["jobID"]; found {
+		var job exportJob
+		found, err := ftdb.GetItem(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), exportReferencePrefix+jobID, &job)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		if !found {
+			return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("No export %s", jobID)), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, job), nil
+	}
+	var exportReq exportRequest
+	if len(request.Body) > 0 {
+		err := json.Unmarshal([]byte(request.Body), &exportReq)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+	}
+	if len(exportReq.GroupID) > 0 {
+		member, err := records.IsGroupMember(ftCtx, exportReq.GroupID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		if !member {
+			return awsproxy.NewForbiddenResponse(ftCtx, "Only group members can export a group's stories."), nil
+		}
+	}
+	job, err := startExport(ftCtx, exportReq.GroupID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	return awsproxy.NewJSONResponse(ftCtx, job), nil
+}
+
+// startExport records the job and hands it to the worker lambda, which runs
+// asynchronously so the request returns straight away.
+func startExport(ftCtx awsproxy.FTContext, groupID string) (*exportJob, error) {
+	job := exportJob{
+		JobID:     uuid.NewV4().String(),
+		UserID:    ftCtx.UserID,
+		GroupID:   groupID,
+		Status:    exportPending,
+		CreatedAt: int(time.Now().UTC().Unix() * 1000),
+	}
+	err := ftdb.PutItem(ftCtx, ftdb.ResourceIDFromUserID(job.UserID), exportReferencePrefix+job.JobID, job)
+	if nil != err {
+		return nil, err
+	}
+	payload, err := json.Marshal(job)
+	if nil != err {
+		return nil, err
+	}
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return nil, err
+	}
+	_, err = awslambda.NewFromConfig(cfg).Invoke(ftCtx.Context, &awslambda.InvokeInput{
+		FunctionName:   aws.String(os.Getenv("exportWorker")),
+		InvocationType: types.InvocationTypeEvent,
+		Payload:        payload,
+	})
+	if nil != err {
+		return nil, err
+	}
+	ftCtx.RequestLogger.Info().Str("job", job.JobID).Str("group", groupID).Msg("story export started")
+	return &job, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/media"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// exportReferencePrefix marks an export job for the user that asked for it,
+// E#{jobID} under U#{userID}.
+const exportReferencePrefix = "E#"
+
+// exportKeyPrefix is where archives are written in the media bucket, media
+// references never point there.
+const exportKeyPrefix = "exports/"
+
+const (
+	exportComplete = "complete"
+	exportFailed   = "failed"
+)
+
+// downloadLinkHours is how long the emailed download link works.
+const downloadLinkHours = 72
+
+// exportJob is written by the story_export lambda and completed here.
+type exportJob struct {
+	JobID       string `json:"jobId" dynamodbav:"jobId"`
+	UserID      string `json:"userId" dynamodbav:"userId"`
+	GroupID     string `json:"groupId,omitempty" dynamodbav:"groupId"`
+	Status      string `json:"status" dynamodbav:"status"`
+	CreatedAt   int    `json:"createdAt" dynamodbav:"createdAt"`
+	CompletedAt int    `json:"completedAt,omitempty" dynamodbav:"completedAt"`
+	StoryCount  int    `json:"storyCount,omitempty" dynamodbav:"storyCount"`
+	ArchiveKey  string `json:"-" dynamodbav:"archiveKey"`
+	ExpiresAt   int    `json:"expiresAt,omitempty" dynamodbav:"expiresAt"`
+	Error       string `json:"error,omitempty" dynamodbav:"error"`
+}
+
+// manifestStory describes one story file in the archive.
+type manifestStory struct {
+	StoryID       string   `json:"id"`
+	GroupID       string   `json:"groupId"`
+	File          string   `json:"file"`
+	Version       string   `json:"version"`
+	LastUpdated   int      `json:"lastUpdated"`
+	LastUpdatedBy string   `json:"lastUpdatedBy"`
+	StorySource   string   `json:"storySource"`
+	Media         []string `json:"media"`
+}
+
+// manifest is written to manifest.json at the root of the archive.
+type manifest struct {
+	ExportedAt    int             `json:"exportedAt"`
+	ExportedBy    string          `json:"exportedBy"`
+	Groups        []string        `json:"groups"`
+	Stories       []manifestStory `json:"stories"`
+	MissingMedia  []string        `json:"missingMedia,omitempty"`
+	FormatVersion int             `json:"formatVersion"`
+}
+
+// mediaLink finds the target of markdown images and links, ![alt](target).
+var mediaLink = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)`)
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler is invoked asynchronously by story_export. It gathers the stories in
+// the job, the media they reference and a manifest into a zip, uploads the zip
+// under exports/ in the media bucket and emails the user a link to download
+// it. Media is only read through media references, so one export cannot end
+// up in another.
+func handler(ctx context.Context, job exportJob) error {
+	ftCtx := awsproxy.NewFromContext(ctx, job.UserID)
+	ftCtx.RequestLogger.Info().Str("job", job.JobID).Str("group", job.GroupID).Msg("story export running")
+	err := runExport(ftCtx, &job)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("job", job.JobID).Msg("story export failed")
+		job.Status = exportFailed
+		job.Error = err.Error()
+	}
+	job.CompletedAt = int(time.Now().UTC().Unix() * 1000)
+	return ftdb.PutItem(ftCtx, ftdb.ResourceIDFromUserID(job.UserID), exportReferencePrefix+job.JobID, job)
+}
+
+func runExport(ftCtx awsproxy.FTContext, job *exportJob) error {
+	mediaBucket := os.Getenv("mediaBucket")
+	if mediaBucket == "" {
+		return fmt.Errorf("mediaBucket must be configured")
+	}
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return err
+	}
+	s3Client := s3.NewFromConfig(cfg)
+	groups := []string{job.GroupID}
+	if job.GroupID == "" {
+		groups, err = sharing.FindGroupsForUser(ftCtx)
+		if nil != err {
+			return err
+		}
+	}
+	job.ArchiveKey = fmt.Sprintf("%s%s/%s.zip", exportKeyPrefix, job.UserID, job.JobID)
+	contents, err := uploadArchive(ftCtx, s3Client, mediaBucket, groups, job.ArchiveKey)
+	if nil != err {
+		return err
+	}
+	expires := time.Duration(downloadLinkHours) * time.Hour
+	downloadURL, err := presignDownload(ftCtx, cfg, mediaBucket, job.ArchiveKey, expires)
+	if nil != err {
+		return err
+	}
+	err = emailDownloadLink(ftCtx, cfg, job.UserID, downloadURL, len(contents.Stories))
+	if nil != err {
+		return err
+	}
+	job.Status = exportComplete
+	job.StoryCount = len(contents.Stories)
+	job.ExpiresAt = int(time.Now().Add(expires).UTC().Unix() * 1000)
+	ftCtx.RequestLogger.Info().Str("job", job.JobID).Int("stories", job.StoryCount).Int("missingMedia", len(contents.MissingMedia)).Msg("story export complete")
+	return nil
+}
+
+// uploadArchive streams the archive to the key as it is written, in parts
+// through a multipart upload, so that it never has to fit in memory or on
+// disk.
+func uploadArchive(ftCtx awsproxy.FTContext, s3Client *s3.Client, bucket string, groups []string, key string) (*manifest, error) {
+	reader, writer := io.Pipe()
+	type written struct {
+		contents *manifest
+		err      error
+	}
+	done := make(chan written, 1)
+	go func() {
+		contents, err := writeArchive(ftCtx, s3Client, bucket, groups, writer)
+		writer.CloseWithError(err)
+		done <- written{contents, err}
+	}()
+	_, err := manager.NewUploader(s3Client).Upload(ftCtx.Context, &s3.PutObjectInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(key),
+		Body:               reader,
+		ContentType:        aws.String("application/zip"),
+		ContentDisposition: aws.String("attachment; filename=\"folktells-stories.zip\""),
+	})
+	// Stops the archive being written when the upload has failed.
+	reader.CloseWithError(err)
+	archive := <-done
+	if nil != archive.err {
+		return nil, archive.err
+	}
+	return archive.contents, err
+}
+
+// writeArchive writes every story in the groups as a markdown file under
+// stories/, the media they reference under media/ and the manifest. Media is
+// only exported through its media reference record, and only if it was added
+// by a member of the story's group, so a story cannot pull in another
+// family's media.
+func writeArchive(ftCtx awsproxy.FTContext, s3Client *s3.Client, bucket string, groups []string, archive io.Writer) (*manifest, error) {
+	zipWriter := zip.NewWriter(archive)
+	contents := manifest{
+		ExportedAt:    int(time.Now().UTC().Unix() * 1000),
+		ExportedBy:    ftCtx.UserID,
+		Groups:        groups,
+		Stories:       []manifestStory{},
+		FormatVersion: 1,
+	}
+	written := map[string]string{}
+	for _, groupID := range groups {
+		items, err := loadGroupStories(ftCtx, groupID)
+		if nil != err {
+			return nil, err
+		}
+		members, err := groupMembers(ftCtx, groupID)
+		if nil != err {
+			return nil, err
+		}
+		for _, item := range items {
+			story := manifestStory{
+				StoryID:       stringAttribute(item, ftdb.IDField),
+				GroupID:       groupID,
+				Version:       stringAttribute(item, ftdb.VersionField),
+				LastUpdated:   numberAttribute(item, ftdb.LastUpdatedField),
+				LastUpdatedBy: stringAttribute(item, ftdb.LastUpdatedByField),
+				StorySource:   stringAttribute(item, ftdb.StorySourceField),
+				Media:         []string{},
+			}
+			content := stringAttribute(item, ftdb.ContentField)
+			story.File = fmt.Sprintf("stories/%s/%s.md", groupID, story.StoryID)
+			err = writeFile(zipWriter, story.File, strings.NewReader(content))
+			if nil != err {
+				return nil, err
+			}
+			for _, mediaReference := range mediaReferences(content) {
+				file, found := written[mediaReference]
+				if !found {
+					file, err = exportMedia(ftCtx, s3Client, bucket, mediaReference, members, zipWriter)
+					if nil != err {
+						ftCtx.RequestLogger.Info().Err(err).Str("media", mediaReference).Msg("media not exported")
+						contents.MissingMedia = append(contents.MissingMedia, mediaReference)
+					}
+					written[mediaReference] = file
+				}
+				if len(file) > 0 {
+					story.Media = append(story.Media, file)
+				}
+			}
+			contents.Stories = append(contents.Stories, story)
+		}
+	}
+	manifestJSON, err := json.MarshalIndent(contents, "", "  ")
+	if nil != err {
+		return nil, err
+	}
+	err = writeFile(zipWriter, "manifest.json", strings.NewReader(string(manifestJSON)))
+	if nil != err {
+		return nil, err
+	}
+	return &contents, zipWriter.Close()
+}
+
+// mediaReferences finds the media references in a story, the targets of its
+// markdown images that are not links to somewhere else.
+func mediaReferences(content string) []string {
+	var references []string
+	for _, match := range mediaLink.FindAllStringSubmatch(content, -1) {
+		target, err := url.PathUnescape(match[1])
+		if nil != err {
+			continue
+		}
+		if parsed, err := url.Parse(target); nil == err && len(parsed.Scheme) > 0 {
+			continue
+		}
+		references = append(references, target)
+	}
+	return references
+}
+
+// exportMedia copies the referenced file into the archive and returns its
+// name there, which is unique to the reference.
+func exportMedia(ftCtx awsproxy.FTContext, s3Client *s3.Client, bucket, mediaReference string, members map[string]bool, zipWriter *zip.Writer) (string, error) {
+	reference, found, err := media.Load(ftCtx, mediaReference)
+	if nil != err {
+		return "", err
+	}
+	if !found || len(reference.MediaFile) == 0 {
+		return "", fmt.Errorf("No media file for %s", mediaReference)
+	}
+	if !members[reference.CreatedBy] {
+		return "", fmt.Errorf("Media %s was not added by a member of the group", mediaReference)
+	}
+	object, err := s3Client.GetObject(ftCtx.Context, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(reference.MediaFile),
+	})
+	if nil != err {
+		return "", err
+	}
+	defer object.Body.Close()
+	file := archiveMediaName(mediaReference, reference.MediaFile)
+	return file, writeFile(zipWriter, file, object.Body)
+}
+
+// archiveMediaName keeps media files directly under media/ in the archive,
+// named for the reference as well as the file so that files with the same
+// name do not collide.
+func archiveMediaName(mediaReference, mediaFile string) string {
+	return "media/" + url.PathEscape(mediaReference) + "_" + path.Base("/"+mediaFile)
+}
+
+func groupMembers(ftCtx awsproxy.FTContext, groupID string) (map[string]bool, error) {
+	userPrefix := ftdb.ReferenceIDFromUserID("")
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromGroupID(groupID), userPrefix)
+	if nil != err {
+		return nil, err
+	}
+	members := map[string]bool{}
+	for _, item := range items {
+		members[strings.TrimPrefix(stringAttribute(item, ftdb.ReferenceIDField), userPrefix)] = true
+	}
+	return members, nil
+}
+
+func writeFile(zipWriter *zip.Writer, name string, content io.Reader) error {
+	fileWriter, err := zipWriter.Create(name)
+	if nil != err {
+		return err
+	}
+	_, err = io.Copy(fileWriter, content)
+	return err
+}
+
+func loadGroupStories(ftCtx awsproxy.FTContext, groupID string) ([]map[string]dbtypes.AttributeValue, error) {
+	var items []map[string]dbtypes.AttributeValue
+	var startKey map[string]dbtypes.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+			TableName:              aws.String(ftdb.GetTableName()),
+			KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :story)"),
+			FilterExpression:       aws.String("attribute_not_exists(#deletedAt)"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId":     ftdb.ResourceIDField,
+				"#refId":     ftdb.ReferenceIDField,
+				"#deletedAt": "deletedAt",
+			},
+			ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+				":resId": &dbtypes.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(groupID)},
+				":story": &dbtypes.AttributeValueMemberS{Value: "S#"},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			return nil, err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+// presignDownload signs the link with the shared credentials rather than the
+// lambda's role, so that it stays valid after the role session ends.
+func presignDownload(ftCtx awsproxy.FTContext, cfg aws.Config, bucket, key string, expires time.Duration) (string, error) {
+	accessKey, secretKey := awsproxy.SharedCredentialParameters(ftCtx.Context)
+	signingCfg := cfg.Copy()
+	signingCfg.Credentials = aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""))
+	presigner := s3.NewPresignClient(s3.NewFromConfig(signingCfg))
+	request, err := presigner.PresignGetObject(ftCtx.Context, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if nil != err {
+		return "", err
+	}
+	return request.URL, nil
+}
+
+func emailDownloadLink(ftCtx awsproxy.FTContext, cfg aws.Config, userID, downloadURL string, storyCount int) error {
+	email, err := findUserEmail(ftCtx, userID)
+	if nil != err {
+		return err
+	}
+	body := fmt.Sprintf("Your Folktells export of %d stories is ready. You can download it from the link below for the next %d hours.\n\n%s\n", storyCount, downloadLinkHours, downloadURL)
+	_, err = ses.NewFromConfig(cfg).SendEmail(ftCtx.Context, &ses.SendEmailInput{
+		Source: aws.String(os.Getenv("emailSender")),
+		Destination: &sestypes.Destination{
+			ToAddresses: []string{email},
+		},
+		Message: &sestypes.Message{
+			Subject: &sestypes.Content{Data: aws.String("Your Folktells stories are ready to download")},
+			Body: &sestypes.Body{
+				Text: &sestypes.Content{Data: aws.String(body)},
+			},
+		},
+	})
+	return err
+}
+
+func findUserEmail(ftCtx awsproxy.FTContext, userID string) (string, error) {
+	resID := ftdb.ResourceIDFromUserID(userID)
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]dbtypes.AttributeValue{
+			ftdb.ResourceIDField:  &dbtypes.AttributeValueMemberS{Value: resID},
+			ftdb.ReferenceIDField: &dbtypes.AttributeValueMemberS{Value: resID},
+		},
+	})
+	if nil != err {
+		return "", err
+	}
+	email := stringAttribute(result.Item, ftdb.EmailField)
+	if email == "" {
+		return "", fmt.Errorf("No email for user %s", userID)
+	}
+	return email, nil
+}
+
+func stringAttribute(item map[string]dbtypes.AttributeValue, name string) string {
+	if value, ok := item[name].(*dbtypes.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func numberAttribute(item map[string]dbtypes.AttributeValue, name string) int {
+	if value, ok := item[name].(*dbtypes.AttributeValueMemberN); ok {
+		number, err := strconv.Atoi(value.Value)
+		if nil == err {
+			return number
+		}
+	}
+	return 0
+}
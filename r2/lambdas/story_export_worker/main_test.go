@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMediaReferencesFromMarkdown(t *testing.T) {
+	content := "# Picnic\n![lake](abc123) and ![dock](def%20456) [link](notes.md)"
+	references := mediaReferences(content)
+	if 2 != len(references) || references[0] != "abc123" || references[1] != "def 456" {
+		t.Errorf("Unexpected references %v", references)
+	}
+}
+
+func TestMediaReferencesSkipLinksElsewhere(t *testing.T) {
+	references := mediaReferences("![cat](https://example.com/cat.jpg) ![dock](https://media.s3.ca-central-1.amazonaws.com/exports/u1/j1.zip)")
+	if 0 != len(references) {
+		t.Errorf("Expected no references, was %v", references)
+	}
+}
+
+func TestArchiveMediaNameCannotEscapeMediaFolder(t *testing.T) {
+	if name := archiveMediaName("ref1", "../../secret.jpg"); name != "media/ref1_secret.jpg" {
+		t.Errorf("Expected media/ref1_secret.jpg, was %s", name)
+	}
+	if name := archiveMediaName("../ref1", "photo.jpg"); name != "media/..%2Fref1_photo.jpg" {
+		t.Errorf("Expected the reference to stay in the media folder, was %s", name)
+	}
+}
+
+func TestArchiveMediaNamesWithSameFileDoNotCollide(t *testing.T) {
+	if archiveMediaName("ref1", "a/photo.jpg") == archiveMediaName("ref2", "b/photo.jpg") {
+		t.Errorf("Expected files with the same name to get different archive names")
+	}
+}
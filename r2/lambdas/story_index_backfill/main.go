@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/search"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// storyReferencePrefix marks story items within a group, S#{storyID} under
+// G#{groupID}, and revisionReferencePrefix a revision under S#{storyID}.
+const storyReferencePrefix = "S#"
+const revisionReferencePrefix = "R#"
+
+// stopBefore is how long before the invocation times out the backfill stops
+// and reports where to resume from.
+const stopBefore = time.Minute
+
+// backfillRequest resumes a backfill from the story it stopped at, an empty
+// request starts from the beginning.
+type backfillRequest struct {
+	ResumeFrom *storyKey `json:"resumeFrom,omitempty"`
+}
+
+type storyKey struct {
+	ResourceID  string `json:"resId"`
+	ReferenceID string `json:"refId"`
+}
+
+// backfillResult says how many stories were indexed and, if the backfill ran
+// out of time, the request to invoke it with again.
+type backfillResult struct {
+	Indexed    int       `json:"indexed"`
+	ResumeFrom *storyKey `json:"resumeFrom,omitempty"`
+}
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler adds the stories saved before search existed to the search index,
+// recording an author for each that has none. It is invoked by hand after a
+// deploy, again with the resumeFrom it returns until it returns none. Running
+// it more than once is harmless, a story is indexed the same way each time.
+func handler(ctx context.Context, request backfillRequest) (backfillResult, error) {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	result := backfillResult{}
+	var startKey map[string]types.AttributeValue
+	if nil != request.ResumeFrom {
+		startKey = records.Key(request.ResumeFrom.ResourceID, request.ResumeFrom.ReferenceID)
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	for {
+		scanned, err := ftCtx.DBSvc.Scan(ftCtx.Context, &dynamodb.ScanInput{
+			TableName:        aws.String(ftdb.GetTableName()),
+			FilterExpression: aws.String("begins_with(#resId, :group) AND begins_with(#refId, :story)"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":group": &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID("")},
+				":story": &types.AttributeValueMemberS{Value: storyReferencePrefix},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			return result, err
+		}
+		for _, item := range scanned.Items {
+			err = backfillStory(ftCtx, item)
+			if nil != err {
+				ftCtx.RequestLogger.Error().Err(err).Str("story", records.StringAttribute(item, ftdb.ReferenceIDField)).Msg("story not indexed")
+				return result, err
+			}
+			result.Indexed++
+		}
+		if len(scanned.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = scanned.LastEvaluatedKey
+		if hasDeadline && time.Until(deadline) < stopBefore {
+			result.ResumeFrom = &storyKey{
+				ResourceID:  records.StringAttribute(startKey, ftdb.ResourceIDField),
+				ReferenceID: records.StringAttribute(startKey, ftdb.ReferenceIDField),
+			}
+			break
+		}
+	}
+	ftCtx.RequestLogger.Info().Int("indexed", result.Indexed).Bool("finished", nil == result.ResumeFrom).Msg("story index backfill")
+	return result, nil
+}
+
+// backfillStory indexes the story. A story without an author is given the
+// editor of its oldest revision, or its last editor if it was never revised.
+func backfillStory(ftCtx awsproxy.FTContext, item map[string]types.AttributeValue) error {
+	groupID := strings.TrimPrefix(records.StringAttribute(item, ftdb.ResourceIDField), ftdb.ResourceIDFromGroupID(""))
+	storyID := strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), storyReferencePrefix)
+	story := search.Story{
+		GroupID:       groupID,
+		StoryID:       storyID,
+		Content:       records.StringAttribute(item, ftdb.ContentField),
+		LastUpdated:   records.NumberAttribute(item, ftdb.LastUpdatedField),
+		LastUpdatedBy: records.StringAttribute(item, ftdb.LastUpdatedByField),
+		Author:        records.StringAttribute(item, search.AuthorField),
+	}
+	if len(story.Author) == 0 {
+		author, err := originalAuthor(ftCtx, story)
+		if nil != err {
+			return err
+		}
+		story.Author, err = setAuthor(ftCtx, story, author)
+		if nil != err {
+			return err
+		}
+	}
+	return search.Index(ftCtx, story)
+}
+
+func originalAuthor(ftCtx awsproxy.FTContext, story search.Story) (string, error) {
+	revisions, err := records.QueryPrefix(ftCtx, storyReferencePrefix+story.StoryID, revisionReferencePrefix)
+	if nil != err {
+		return "", err
+	}
+	for _, revision := range revisions {
+		if records.StringAttribute(revision, "groupId") == story.GroupID {
+			if author := records.StringAttribute(revision, ftdb.LastUpdatedByField); len(author) > 0 {
+				return author, nil
+			}
+		}
+	}
+	return story.LastUpdatedBy, nil
+}
+
+// setAuthor records the author unless the story has been given one since it
+// was read, and returns the author the story now has.
+func setAuthor(ftCtx awsproxy.FTContext, story search.Story, author string) (string, error) {
+	result, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(ftdb.ResourceIDFromGroupID(story.GroupID), storyReferencePrefix+story.StoryID),
+		ConditionExpression: aws.String("attribute_exists(#refId)"),
+		UpdateExpression:    aws.String("SET #createdBy = if_not_exists(#createdBy, :author)"),
+		ExpressionAttributeNames: map[string]string{
+			"#refId":     ftdb.ReferenceIDField,
+			"#createdBy": search.AuthorField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":author": &types.AttributeValueMemberS{Value: author},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return author, nil
+	}
+	if nil != err {
+		return "", err
+	}
+	return records.StringAttribute(result.Attributes, search.AuthorField), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/trash"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs on a schedule and purges every story whose trash retention
+// window has ended. A story purged here is gone for good, only a tombstone is
+// left in its group. A story that fails to purge is logged and stays queued,
+// it is tried again on the next run without holding up the rest.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	entries, err := trash.Due(ftCtx, int(time.Now().UTC().Unix()*1000))
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Msg("purge queue query failed")
+		return err
+	}
+	failed := 0
+	for _, entry := range entries {
+		err = trash.Purge(ftCtx, entry)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("group", entry.GroupID).Str("story", entry.StoryID).Msg("purge failed")
+			failed++
+		}
+	}
+	ftCtx.RequestLogger.Info().Int("purged", len(entries)-failed).Int("failed", failed).Msg("trash purge complete")
+	return nil
+}
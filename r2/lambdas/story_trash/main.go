@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/broadcast"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/trash"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// trashRetentionDays is how long a deleted story can be restored before the
+// purger removes it for good.
+const trashRetentionDays = 30
+
+// deletedAtField and deletedByField mark a story as soft deleted. The story
+// stays in place under the group so that it can be restored.
+const deletedAtField = "deletedAt"
+const deletedByField = "deletedBy"
+
+// trashEntry is a deleted story in the trash of the user that deleted it.
+type trashEntry struct {
+	GroupID   string `json:"groupId" dynamodbav:"groupId"`
+	StoryID   string `json:"id" dynamodbav:"storyId"`
+	Content   string `json:"content" dynamodbav:"content"`
+	DeletedAt int    `json:"deletedAt" dynamodbav:"deletedAt"`
+	DeletedBy string `json:"deletedBy" dynamodbav:"deletedBy"`
+	ExpiresAt int    `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+// storyTrash is the list of stories the user has deleted and can restore.
+type storyTrash struct {
+	Stories []trashEntry `json:"stories"`
+}
+
+// sharedStory is the part of the story kept in the trash.
+type sharedStory struct {
+	StoryID string
+	Content string
+}
+
+// storyEvent tells the devices of the group's members that a story was moved
+// to the trash or restored from it. The other members are pushed to as well,
+// a story in the trash is synced as a tombstone.
+type storyEvent struct {
+	Action string         `json:"action"`
+	Data   storyEventData `json:"data"`
+}
+
+type storyEventData struct {
+	GroupID   string `json:"groupId"`
+	StoryID   string `json:"id"`
+	DeletedAt int    `json:"deletedAt,omitempty"`
+	DeletedBy string `json:"deletedBy,omitempty"`
+}
+
+const (
+	storyDeletedAction  = "storyDeleted"
+	storyRestoredAction = "storyRestored"
+)
+
+const storyAlertTitle = "Folktells"
+
+// Handler deletes a story into the trash, lists the trash, and restores or
+// permanently purges stories from the trash.
+//
+// DELETE story/{storyID}?groupId={groupID} moves a story to the trash
+// GET stories/trash lists the stories the user has deleted
+// POST stories/trash/{trashedID}?groupId={groupID} restores a story
+// DELETE stories/trash/{trashedID}?groupId={groupID} purges a story now
+//
+// Deleting or restoring a story only marks the story item, its content is
+// left alone. It is also stamped as last updated so the change is picked up
+// on the next sync, as a tombstone for a deletion, and the group is told
+// straight away.
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	groupID := request.QueryStringParameters["groupId"]
+	if rawStoryID, found := request.PathParameters["storyID"]; found {
+		storyID, err := url.PathUnescape(rawStoryID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return deleteStory(ftCtx, groupID, storyID), nil
+	}
+	rawTrashedID, found := request.PathParameters["trashedID"]
+	if !found {
+		return listTrash(ftCtx), nil
+	}
+	trashedID, err := url.PathUnescape(rawTrashedID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if request.HTTPMethod == http.MethodDelete {
+		return purgeFromTrash(ftCtx, groupID, trashedID), nil
+	}
+	return restoreStory(ftCtx, groupID, trashedID), nil
+}
+
+func listTrash(ftCtx awsproxy.FTContext) awsproxy.Response {
+	result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+		TableName:              aws.String(ftdb.GetTableName()),
+		KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :trash)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId": ftdb.ResourceIDField,
+			"#refId": ftdb.ReferenceIDField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":resId": &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ftCtx.UserID)},
+			":trash": &types.AttributeValueMemberS{Value: trash.ReferencePrefix},
+		},
+	})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	deleted := storyTrash{Stories: []trashEntry{}}
+	err = attributevalue.UnmarshalListOfMaps(result.Items, &deleted.Stories)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.NewJSONResponse(ftCtx, deleted)
+}
+
+// deleteStory marks the story deleted and puts it in the user's trash. Only
+// members of the group the story is shared with can delete it.
+func deleteStory(ftCtx awsproxy.FTContext, groupID, storyID string) awsproxy.Response {
+	member, err := records.IsGroupMember(ftCtx, groupID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !member {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Only group members can delete a story.")
+	}
+	story, found, err := loadStory(ftCtx, groupID, storyID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !found {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("No story %s", storyID))
+	}
+	now := nowMilliseconds()
+	_, err = ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 storyKey(groupID, storyID),
+		ConditionExpression: aws.String("attribute_not_exists(#deletedAt)"),
+		UpdateExpression:    aws.String("SET #deletedAt = :deletedAt, #deletedBy = :deletedBy, #lastUpdated = :deletedAt"),
+		ExpressionAttributeNames: map[string]string{
+			"#deletedAt":   deletedAtField,
+			"#deletedBy":   deletedByField,
+			"#lastUpdated": ftdb.LastUpdatedField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deletedAt": &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+			":deletedBy": &types.AttributeValueMemberS{Value: ftCtx.UserID},
+		},
+	})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	entry := trashEntry{
+		GroupID:   groupID,
+		StoryID:   storyID,
+		Content:   story.Content,
+		DeletedAt: now,
+		DeletedBy: ftCtx.UserID,
+		ExpiresAt: now + trashRetentionDays*24*60*60*1000,
+	}
+	err = ftdb.PutItem(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), trash.ReferenceID(groupID, storyID), entry)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	err = trash.Schedule(ftCtx, entry.purge(ftCtx.UserID))
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	notifyGroup(ftCtx, now, storyEvent{
+		Action: storyDeletedAction,
+		Data:   storyEventData{GroupID: groupID, StoryID: storyID, DeletedAt: now, DeletedBy: ftCtx.UserID},
+	})
+	ftCtx.RequestLogger.Info().Str("group", groupID).Str("story", storyID).Msg("story moved to trash")
+	return awsproxy.NewSuccessResponse(ftCtx)
+}
+
+// restoreStory takes a story out of the trash and back into the group, as
+// long as the user is still a member of it.
+func restoreStory(ftCtx awsproxy.FTContext, groupID, storyID string) awsproxy.Response {
+	member, err := records.IsGroupMember(ftCtx, groupID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !member {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Only group members can restore a story.")
+	}
+	entry, found, err := loadTrashEntry(ftCtx, groupID, storyID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !found {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("Story %s is not in the trash", storyID))
+	}
+	now := nowMilliseconds()
+	_, err = ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 storyKey(groupID, storyID),
+		ConditionExpression: aws.String("attribute_exists(#deletedAt)"),
+		UpdateExpression:    aws.String("SET #lastUpdated = :now REMOVE #deletedAt, #deletedBy"),
+		ExpressionAttributeNames: map[string]string{
+			"#deletedAt":   deletedAtField,
+			"#deletedBy":   deletedByField,
+			"#lastUpdated": ftdb.LastUpdatedField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+		},
+	})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	err = deleteItem(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), trash.ReferenceID(groupID, storyID))
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	err = trash.Unschedule(ftCtx, entry.purge(ftCtx.UserID))
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	notifyGroup(ftCtx, now, storyEvent{
+		Action: storyRestoredAction,
+		Data:   storyEventData{GroupID: groupID, StoryID: storyID},
+	})
+	ftCtx.RequestLogger.Info().Str("group", groupID).Str("story", storyID).Msg("story restored from trash")
+	return awsproxy.NewSuccessResponse(ftCtx)
+}
+
+// purgeFromTrash removes a story from the trash for good without waiting for
+// the retention window to end.
+func purgeFromTrash(ftCtx awsproxy.FTContext, groupID, storyID string) awsproxy.Response {
+	entry, found, err := loadTrashEntry(ftCtx, groupID, storyID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if !found {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, fmt.Sprintf("Story %s is not in the trash", storyID))
+	}
+	err = trash.Purge(ftCtx, entry.purge(ftCtx.UserID))
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.NewSuccessResponse(ftCtx)
+}
+
+// notifyGroup sends the event, made at the time given, to the group's
+// devices and pushes an alert to the other members. Failing to is only
+// logged, the devices see the change on their next sync.
+func notifyGroup(ftCtx awsproxy.FTContext, at int, event storyEvent) {
+	alert := "%s moved a story to the trash"
+	if event.Action == storyRestoredAction {
+		alert = "%s restored a story"
+	}
+	data, err := json.Marshal(event)
+	if nil == err {
+		_, err = broadcast.Send(ftCtx, broadcast.Event{
+			ID:      fmt.Sprintf("%s#%s#%d", event.Action, event.Data.StoryID, at),
+			GroupID: event.Data.GroupID,
+			Data:    data,
+			Alert:   &broadcast.Alert{Title: storyAlertTitle, Body: fmt.Sprintf(alert, broadcast.SenderName(ftCtx))},
+		}, &http.Client{Timeout: 30 * time.Second})
+	}
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("group", event.Data.GroupID).Str("story", event.Data.StoryID).Msg("story event not sent")
+	}
+}
+
+func loadTrashEntry(ftCtx awsproxy.FTContext, groupID, storyID string) (trashEntry, bool, error) {
+	var entry trashEntry
+	found, err := ftdb.GetItem(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), trash.ReferenceID(groupID, storyID), &entry)
+	return entry, found, err
+}
+
+// purge is the entry as the user's in the purge queue.
+func (entry trashEntry) purge(userID string) trash.Entry {
+	return trash.Entry{UserID: userID, GroupID: entry.GroupID, StoryID: entry.StoryID, ExpiresAt: entry.ExpiresAt}
+}
+
+func loadStory(ftCtx awsproxy.FTContext, groupID, storyID string) (sharedStory, bool, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key:       storyKey(groupID, storyID),
+	})
+	if nil != err {
+		return sharedStory{}, false, err
+	}
+	if len(result.Item) == 0 {
+		return sharedStory{}, false, nil
+	}
+	return sharedStory{
+		StoryID: storyID,
+		Content: stringAttribute(result.Item, ftdb.ContentField),
+	}, true, nil
+}
+
+func deleteItem(ftCtx awsproxy.FTContext, resourceID, referenceID string) error {
+	_, err := ftCtx.DBSvc.DeleteItem(ftCtx.Context, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: referenceID},
+		},
+	})
+	return err
+}
+
+func storyKey(groupID, storyID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(groupID)},
+		ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: "S#" + storyID},
+	}
+}
+
+func nowMilliseconds() int {
+	return int(time.Now().UTC().Unix() * 1000)
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func main() {
+	lambda.Start(Handler)
+}
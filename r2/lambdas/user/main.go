@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
 	"github.com/sowens-csd/folktells-server/awsproxy"
 	"github.com/sowens-csd/folktells-server/sharing"
 	"github.com/sowens-csd/folktells-server/store"
@@ -21,20 +22,29 @@ func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response,
 	return findUser(ftCtx), nil
 }
 
+// findUser answers with the online user, whose subscription state is kept
+// for either store when a purchase is verified. The store library only
+// checks Apple subscriptions, so it is left out for Google subscribers.
 func findUser(ftCtx awsproxy.FTContext) awsproxy.Response {
 	onlineUser, err := sharing.LoadOnlineUser(ftCtx, ftCtx.UserID)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger)
 	}
 	if onlineUser.IsSubscriptionCheckRequired() {
-		connectPassword, clientSecret, refreshToken, accessToken := awsproxy.AccessParameters()
-		accessConfig := store.AccessConfig{
-			ConnectPassword: connectPassword,
-			ClientSecret:    clientSecret,
-			RefreshToken:    refreshToken,
-			AccessToken:     accessToken,
+		current, err := entitlements.Load(ftCtx, ftCtx.UserID)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+		if nil == current || current.Store != entitlements.StoreGoogle {
+			connectPassword, clientSecret, refreshToken, accessToken := awsproxy.AccessParameters()
+			accessConfig := store.AccessConfig{
+				ConnectPassword: connectPassword,
+				ClientSecret:    clientSecret,
+				RefreshToken:    refreshToken,
+				AccessToken:     accessToken,
+			}
+			onlineUser = store.UpdateUserSubscription(ftCtx, onlineUser, accessConfig, &http.Client{Timeout: 30 * time.Second})
 		}
-		onlineUser = store.UpdateUserSubscription(ftCtx, onlineUser, accessConfig, &http.Client{Timeout: 30 * time.Second})
 	}
 	return awsproxy.NewJSONResponse(ftCtx, onlineUser)
 }
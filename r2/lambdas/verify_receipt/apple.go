@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+)
+
+// appleSandboxURL is where receipts from TestFlight and development builds
+// are verified, the production endpoint answers those with 21007.
+const appleSandboxURL = "https://sandbox.itunes.apple.com/verifyReceipt"
+const appleSandboxStatus = 21007
+
+// appleVerifier verifies app receipts with the verifyReceipt endpoint using
+// the app's shared secret.
+type appleVerifier struct {
+	URL          string
+	SharedSecret string
+}
+
+type appleReceiptRequest struct {
+	ReceiptData            string `json:"receipt-data"`
+	Password               string `json:"password"`
+	ExcludeOldTransactions bool   `json:"exclude-old-transactions"`
+}
+
+type appleReceiptResponse struct {
+	Status             int                  `json:"status"`
+	LatestReceiptInfo  []appleTransaction   `json:"latest_receipt_info"`
+	PendingRenewalInfo []appleRenewalStatus `json:"pending_renewal_info"`
+}
+
+type appleTransaction struct {
+	ProductID             string `json:"product_id"`
+	OriginalTransactionID string `json:"original_transaction_id"`
+	ExpiresDateMs         string `json:"expires_date_ms"`
+	CancellationDateMs    string `json:"cancellation_date_ms"`
+}
+
+type appleRenewalStatus struct {
+	OriginalTransactionID string `json:"original_transaction_id"`
+	AutoRenewStatus       string `json:"auto_renew_status"`
+}
+
+func (v appleVerifier) verify(purchase purchaseRequest, client *http.Client) (entitlements.Entitlement, error) {
+	if len(purchase.Receipt) == 0 {
+		return entitlements.Entitlement{}, errNotPurchased
+	}
+	response, err := v.post(v.URL, purchase.Receipt, client)
+	if nil == err && response.Status == appleSandboxStatus {
+		response, err = v.post(appleSandboxURL, purchase.Receipt, client)
+	}
+	if nil != err {
+		return entitlements.Entitlement{}, err
+	}
+	if response.Status != 0 {
+		return entitlements.Entitlement{}, errNotPurchased
+	}
+	return appleEntitlement(response, time.Now().UTC())
+}
+
+func (v appleVerifier) post(url, receipt string, client *http.Client) (appleReceiptResponse, error) {
+	var receiptResponse appleReceiptResponse
+	body, err := json.Marshal(appleReceiptRequest{ReceiptData: receipt, Password: v.SharedSecret, ExcludeOldTransactions: true})
+	if nil != err {
+		return receiptResponse, err
+	}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if nil != err {
+		return receiptResponse, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return receiptResponse, fmt.Errorf("Receipt verification failed with status %d", response.StatusCode)
+	}
+	err = json.NewDecoder(response.Body).Decode(&receiptResponse)
+	return receiptResponse, err
+}
+
+// appleEntitlement takes the transaction that expires last as the user's
+// subscription.
+func appleEntitlement(response appleReceiptResponse, now time.Time) (entitlements.Entitlement, error) {
+	var latest *appleTransaction
+	latestExpiry := -1
+	for i, transaction := range response.LatestReceiptInfo {
+		expiresAt, _ := strconv.Atoi(transaction.ExpiresDateMs)
+		if expiresAt > latestExpiry {
+			latest, latestExpiry = &response.LatestReceiptInfo[i], expiresAt
+		}
+	}
+	if nil == latest {
+		return entitlements.Entitlement{}, errNotPurchased
+	}
+	nowMs := int(now.Unix() * 1000)
+	current := entitlements.Entitlement{
+		Store:                 entitlements.StoreApple,
+		ProductID:             latest.ProductID,
+		OriginalTransactionID: latest.OriginalTransactionID,
+		ExpiresAt:             latestExpiry,
+		Revoked:               len(latest.CancellationDateMs) > 0,
+		UpdatedAt:             nowMs,
+	}
+	for _, renewal := range response.PendingRenewalInfo {
+		if renewal.OriginalTransactionID == latest.OriginalTransactionID {
+			current.AutoRenew = renewal.AutoRenewStatus == "1"
+		}
+	}
+	current.Active = !current.Revoked && (current.ExpiresAt == 0 || current.ExpiresAt > nowMs)
+	return current, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+)
+
+// The Google Play Developer API, subscriptions and one time products are
+// looked up by product and purchase token.
+const (
+	playPurchasesURL = "https://androidpublisher.googleapis.com/androidpublisher/v3/applications/%s/purchases/%s/%s/tokens/%s"
+	playScope        = "https://www.googleapis.com/auth/androidpublisher"
+	googleTokenURL   = "https://oauth2.googleapis.com/token"
+)
+
+// The kinds of Google purchase.
+const (
+	kindSubscription = "subscription"
+	kindProduct      = "product"
+)
+
+// googleVerifier verifies purchase tokens with the Play Developer API as the
+// service account linked to the Play Console. Purchases that have not been
+// acknowledged are acknowledged, Google refunds them otherwise. A purchase
+// made for another account is not.
+type googleVerifier struct {
+	PackageName    string
+	ServiceAccount string
+	TokenURL       string
+	PurchasesURL   string
+}
+
+// googleServiceAccount is the part of the service account key file used.
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type googleSubscription struct {
+	ExpiryTimeMillis            string `json:"expiryTimeMillis"`
+	AutoRenewing                bool   `json:"autoRenewing"`
+	PaymentState                *int   `json:"paymentState"`
+	AcknowledgementState        int    `json:"acknowledgementState"`
+	ObfuscatedExternalAccountID string `json:"obfuscatedExternalAccountId"`
+}
+
+type googleProduct struct {
+	PurchaseState               int    `json:"purchaseState"`
+	AcknowledgementState        int    `json:"acknowledgementState"`
+	ObfuscatedExternalAccountID string `json:"obfuscatedExternalAccountId"`
+}
+
+// A cached access token for the service account, kept while the lambda is
+// warm.
+var googleToken struct {
+	sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (v googleVerifier) verify(purchase purchaseRequest, client *http.Client) (entitlements.Entitlement, error) {
+	if purchase.PackageName != v.PackageName || len(purchase.ProductID) == 0 || len(purchase.PurchaseToken) == 0 {
+		return entitlements.Entitlement{}, errNotPurchased
+	}
+	collection := "subscriptions"
+	if purchase.Kind == kindProduct {
+		collection = "products"
+	} else if purchase.Kind != kindSubscription {
+		return entitlements.Entitlement{}, fmt.Errorf("kind must be %s or %s", kindSubscription, kindProduct)
+	}
+	accessToken, err := v.accessToken(client)
+	if nil != err {
+		return entitlements.Entitlement{}, err
+	}
+	purchaseURL := fmt.Sprintf(v.PurchasesURL, url.PathEscape(v.PackageName), collection, url.PathEscape(purchase.ProductID), url.PathEscape(purchase.PurchaseToken))
+	var acknowledged bool
+	var accountID string
+	var current entitlements.Entitlement
+	now := time.Now().UTC()
+	if purchase.Kind == kindProduct {
+		var product googleProduct
+		err = googleRequest(client, http.MethodGet, purchaseURL, accessToken, &product)
+		if nil != err {
+			return entitlements.Entitlement{}, err
+		}
+		current = productEntitlement(purchase, product, now)
+		acknowledged = product.AcknowledgementState == 1
+		accountID = product.ObfuscatedExternalAccountID
+	} else {
+		var subscription googleSubscription
+		err = googleRequest(client, http.MethodGet, purchaseURL, accessToken, &subscription)
+		if nil != err {
+			return entitlements.Entitlement{}, err
+		}
+		current = subscriptionEntitlement(purchase, subscription, now)
+		acknowledged = subscription.AcknowledgementState == 1
+		accountID = subscription.ObfuscatedExternalAccountID
+	}
+	if len(accountID) > 0 && accountID != obfuscatedAccountID(purchase.UserID) {
+		return entitlements.Entitlement{}, entitlements.ErrClaimed
+	}
+	if current.Active && !acknowledged {
+		err = googleRequest(client, http.MethodPost, purchaseURL+":acknowledge", accessToken, nil)
+		if nil != err {
+			return entitlements.Entitlement{}, err
+		}
+	}
+	return current, nil
+}
+
+// obfuscatedAccountID is the account ID the app sets on its Play purchases,
+// the hex SHA-256 of the user's ID. Purchases from apps that do not set one
+// are only protected by the purchase being claimed once.
+func obfuscatedAccountID(userID string) string {
+	digest := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(digest[:])
+}
+
+// subscriptionEntitlement maps a Play subscription. A subscription is active
+// until it expires once paid for or in its free trial, a pending payment does
+// not entitle the user yet.
+func subscriptionEntitlement(purchase purchaseRequest, subscription googleSubscription, now time.Time) entitlements.Entitlement {
+	expiresAt, _ := strconv.Atoi(subscription.ExpiryTimeMillis)
+	nowMs := int(now.Unix() * 1000)
+	paid := nil != subscription.PaymentState && (*subscription.PaymentState == 1 || *subscription.PaymentState == 2)
+	return entitlements.Entitlement{
+		Store:                 entitlements.StoreGoogle,
+		ProductID:             purchase.ProductID,
+		OriginalTransactionID: purchase.PurchaseToken,
+		Active:                paid && expiresAt > nowMs,
+		ExpiresAt:             expiresAt,
+		AutoRenew:             subscription.AutoRenewing,
+		UpdatedAt:             nowMs,
+	}
+}
+
+// productEntitlement maps a Play one time product, which does not expire
+// and is revoked when cancelled.
+func productEntitlement(purchase purchaseRequest, product googleProduct, now time.Time) entitlements.Entitlement {
+	return entitlements.Entitlement{
+		Store:                 entitlements.StoreGoogle,
+		ProductID:             purchase.ProductID,
+		OriginalTransactionID: purchase.PurchaseToken,
+		Active:                product.PurchaseState == 0,
+		Revoked:               product.PurchaseState == 1,
+		UpdatedAt:             int(now.Unix() * 1000),
+	}
+}
+
+// googleRequest calls the Play Developer API, decoding the answer into result
+// when there is one. A purchase Google does not know is errNotPurchased.
+func googleRequest(client *http.Client, method, requestURL, accessToken string, result interface{}) error {
+	request, err := http.NewRequest(method, requestURL, nil)
+	if nil != err {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	response, err := client.Do(request)
+	if nil != err {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone || response.StatusCode == http.StatusBadRequest {
+		return errNotPurchased
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Play Developer API failed with status %d", response.StatusCode)
+	}
+	if nil == result {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// accessToken gets an OAuth access token for the service account with a
+// signed JWT assertion, reusing the last one until shortly before it expires.
+func (v googleVerifier) accessToken(client *http.Client) (string, error) {
+	googleToken.Lock()
+	defer googleToken.Unlock()
+	if len(googleToken.token) > 0 && time.Now().Before(googleToken.expiresAt) {
+		return googleToken.token, nil
+	}
+	var account googleServiceAccount
+	err := json.Unmarshal([]byte(v.ServiceAccount), &account)
+	if nil != err {
+		return "", errors.New("Google service account is not valid JSON")
+	}
+	tokenURL := v.TokenURL
+	if len(account.TokenURI) > 0 {
+		tokenURL = account.TokenURI
+	}
+	now := time.Now()
+	assertion, err := signAssertion(account, tokenURL, now)
+	if nil != err {
+		return "", err
+	}
+	response, err := client.PostForm(tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if nil != err {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Google token request failed with status %d", response.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if nil != err {
+		return "", err
+	}
+	googleToken.token = token.AccessToken
+	googleToken.expiresAt = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return token.AccessToken, nil
+}
+
+// signAssertion makes the RS256 JWT the service account exchanges for an
+// access token.
+func signAssertion(account googleServiceAccount, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if nil == block {
+		return "", errors.New("Google service account key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if nil != err {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("Google service account key is not RSA")
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": playScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if nil != err {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if nil != err {
+		return "", err
+	}
+	return strings.Join([]string{unsigned, base64.RawURLEncoding.EncodeToString(signature)}, "."), nil
+}
@@ -2,15 +2,50 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
 	"github.com/sowens-csd/folktells-server/awsproxy"
 	"github.com/sowens-csd/folktells-server/store"
 )
 
+// verifiers makes the verifier for each store. Supporting another store is
+// a matter of adding it here.
+var verifiers = map[string]func(awsproxy.FTContext, store.AccessConfig) (storeVerifier, error){
+	entitlements.StoreApple: func(ftCtx awsproxy.FTContext, accessConfig store.AccessConfig) (storeVerifier, error) {
+		return appleVerifier{URL: os.Getenv("verifyReceipt"), SharedSecret: accessConfig.ConnectPassword}, nil
+	},
+	entitlements.StoreGoogle: func(ftCtx awsproxy.FTContext, accessConfig store.AccessConfig) (storeVerifier, error) {
+		serviceAccount, err := loadParameter(ftCtx, "googleServiceAccountParameter", "/google/playServiceAccount")
+		if nil != err {
+			return nil, err
+		}
+		return googleVerifier{
+			PackageName:    os.Getenv("googlePackageName"),
+			ServiceAccount: serviceAccount,
+			TokenURL:       googleTokenURL,
+			PurchasesURL:   playPurchasesURL,
+		}, nil
+	},
+}
+
 // Handler is our lambda handler invoked by the `lambda.Start` function call
+//
+// A body naming the store, {"store": "apple", "receipt": ...} or
+// {"store": "google", "packageName": ..., "productId": ..., "purchaseToken":
+// ..., "kind": "subscription"}, is verified with that store and answered with
+// the user's entitlement, the same for either store. A purchase another
+// account has claimed is answered with 409. Bodies without a store come from
+// older apps and are processed as Apple purchases as before, what the store
+// library verified is also recorded as the user's entitlement.
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	awsproxy.SetupAccessParameters(ctx)
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
@@ -24,11 +59,96 @@ func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response,
 		RefreshToken:    refreshToken,
 		AccessToken:     accessToken,
 	}
+	var purchase purchaseRequest
+	err := json.Unmarshal([]byte(request.Body), &purchase)
+	if nil == err && len(purchase.Store) > 0 {
+		purchase.UserID = ftCtx.UserID
+		return verifyPurchase(ftCtx, purchase, accessConfig), nil
+	}
 	verifyResp, updatedToken := store.ProcessPurchaseRequest(ftCtx, request.Body, accessConfig, &http.Client{Timeout: 30 * time.Second})
 	awsproxy.UpdateAccessToken(ctx, updatedToken)
+	recordLegacyPurchase(ftCtx, verifyResp)
 	return awsproxy.NewJSONResponse(ftCtx, verifyResp), nil
 }
 
+// verifyPurchase checks the purchase with its store and records what it
+// entitles the user to.
+func verifyPurchase(ftCtx awsproxy.FTContext, purchase purchaseRequest, accessConfig store.AccessConfig) awsproxy.Response {
+	newVerifier, found := verifiers[purchase.Store]
+	if !found {
+		return awsproxy.HandleError(fmt.Errorf("Unknown store %s", purchase.Store), ftCtx.RequestLogger)
+	}
+	verifier, err := newVerifier(ftCtx, accessConfig)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	current, err := verifier.verify(purchase, &http.Client{Timeout: 30 * time.Second})
+	if nil == err {
+		err = entitlements.Save(ftCtx, ftCtx.UserID, current)
+	}
+	if entitlements.ErrClaimed == err {
+		ftCtx.RequestLogger.Info().Str("store", purchase.Store).Str("product", purchase.ProductID).Msg("purchase claimed by another account")
+		return entitlements.NewClaimedResponse(ftCtx)
+	}
+	if errNotPurchased == err {
+		ftCtx.RequestLogger.Info().Str("store", purchase.Store).Str("product", purchase.ProductID).Msg("purchase not verified")
+		return awsproxy.NewForbiddenResponse(ftCtx, err.Error())
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.NewJSONResponse(ftCtx, current)
+}
+
+// recordLegacyPurchase records the receipt the store library verified for an
+// older app as the user's entitlement, so that its store notifications can be
+// applied. The library answers with Apple's verifyReceipt response. Failing
+// to is only logged, the purchase has been processed as before.
+func recordLegacyPurchase(ftCtx awsproxy.FTContext, verifyResp store.VerifyResponse) {
+	var response appleReceiptResponse
+	encoded, err := json.Marshal(verifyResp)
+	if nil == err {
+		err = json.Unmarshal(encoded, &response)
+	}
+	if nil == err && response.Status != 0 {
+		err = errNotPurchased
+	}
+	var current entitlements.Entitlement
+	if nil == err {
+		current, err = appleEntitlement(response, time.Now().UTC())
+	}
+	if nil == err {
+		err = entitlements.Record(ftCtx, ftCtx.UserID, current)
+	}
+	if nil != err {
+		ftCtx.RequestLogger.Info().Err(err).Msg("legacy purchase not recorded")
+	}
+}
+
+// loadParameter reads the SSM parameter named by the environment variable, or
+// the default name when the variable is not set.
+func loadParameter(ftCtx awsproxy.FTContext, env, defaultName string) (string, error) {
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return "", err
+	}
+	name := os.Getenv(env)
+	if len(name) == 0 {
+		name = defaultName
+	}
+	result, err := ssm.NewFromConfig(cfg).GetParameter(ftCtx.Context, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: true,
+	})
+	if nil != err {
+		return "", err
+	}
+	if nil == result.Parameter || nil == result.Parameter.Value {
+		return "", fmt.Errorf("No value for parameter %s", name)
+	}
+	return *result.Parameter.Value, nil
+}
+
 func main() {
 	lambda.Start(Handler)
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+)
+
+func TestAppleEntitlementTakesLatestTransaction(t *testing.T) {
+	now := time.Unix(1656000000, 0)
+	response := appleReceiptResponse{
+		LatestReceiptInfo: []appleTransaction{
+			{ProductID: "monthly", OriginalTransactionID: "1000", ExpiresDateMs: "1650000000000"},
+			{ProductID: "yearly", OriginalTransactionID: "2000", ExpiresDateMs: "1680000000000"},
+		},
+		PendingRenewalInfo: []appleRenewalStatus{{OriginalTransactionID: "2000", AutoRenewStatus: "1"}},
+	}
+	current, err := appleEntitlement(response, now)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if current.Store != entitlements.StoreApple || current.ProductID != "yearly" || current.OriginalTransactionID != "2000" {
+		t.Errorf("Expected the yearly subscription, was %+v", current)
+	}
+	if !current.Active || !current.AutoRenew || current.ExpiresAt != 1680000000000 {
+		t.Errorf("Expected an active renewing subscription, was %+v", current)
+	}
+	response.LatestReceiptInfo[1].CancellationDateMs = "1660000000000"
+	current, _ = appleEntitlement(response, now)
+	if current.Active || !current.Revoked {
+		t.Errorf("Expected a refunded subscription to be revoked, was %+v", current)
+	}
+}
+
+func TestGoogleSubscriptionEntitlement(t *testing.T) {
+	now := time.Unix(1656000000, 0)
+	purchase := purchaseRequest{ProductID: "monthly", PurchaseToken: "token"}
+	paid, pending := 1, 0
+	current := subscriptionEntitlement(purchase, googleSubscription{ExpiryTimeMillis: "1660000000000", AutoRenewing: true, PaymentState: &paid}, now)
+	if current.Store != entitlements.StoreGoogle || !current.Active || !current.AutoRenew || current.OriginalTransactionID != "token" {
+		t.Errorf("Expected an active renewing subscription, was %+v", current)
+	}
+	current = subscriptionEntitlement(purchase, googleSubscription{ExpiryTimeMillis: "1660000000000", PaymentState: &pending}, now)
+	if current.Active {
+		t.Errorf("Expected a pending payment not to entitle the user")
+	}
+	current = subscriptionEntitlement(purchase, googleSubscription{ExpiryTimeMillis: "1650000000000", PaymentState: &paid}, now)
+	if current.Active {
+		t.Errorf("Expected an expired subscription not to be active")
+	}
+}
+
+func testServiceAccount(t *testing.T) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if nil != err {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(googleServiceAccount{
+		ClientEmail: "play@folktells.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	return string(account), key
+}
+
+func TestGoogleVerifierAcknowledgesNewPurchase(t *testing.T) {
+	account, key := testServiceAccount(t)
+	acknowledged := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			r.ParseForm()
+			parts := strings.Split(r.PostForm.Get("assertion"), ".")
+			if len(parts) != 3 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if nil != rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+		case r.Header.Get("Authorization") != "Bearer access":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/com.folktells/subscriptions/monthly/token" && r.Method == http.MethodGet:
+			w.Write([]byte(`{"expiryTimeMillis":"4102444800000","autoRenewing":true,"paymentState":1,"acknowledgementState":0}`))
+		case r.URL.Path == "/com.folktells/subscriptions/monthly/token:acknowledge" && r.Method == http.MethodPost:
+			acknowledged = true
+		case r.URL.Path == "/com.folktells/subscriptions/weekly/token" && r.Method == http.MethodGet:
+			w.Write([]byte(`{"expiryTimeMillis":"4102444800000","paymentState":1,"acknowledgementState":1,"obfuscatedExternalAccountId":"` + obfuscatedAccountID("user1") + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	verifier := googleVerifier{
+		PackageName:    "com.folktells",
+		ServiceAccount: account,
+		TokenURL:       server.URL + "/token",
+		PurchasesURL:   server.URL + "/%s/%s/%s/%s",
+	}
+	current, err := verifier.verify(purchaseRequest{Store: entitlements.StoreGoogle, PackageName: "com.folktells", ProductID: "monthly", PurchaseToken: "token", Kind: kindSubscription}, server.Client())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !current.Active || !acknowledged {
+		t.Errorf("Expected an active, acknowledged subscription, was %+v acknowledged %v", current, acknowledged)
+	}
+	_, err = verifier.verify(purchaseRequest{Store: entitlements.StoreGoogle, PackageName: "com.folktells", ProductID: "yearly", PurchaseToken: "token", Kind: kindSubscription}, server.Client())
+	if errNotPurchased != err {
+		t.Errorf("Expected an unknown purchase not to verify, was %v", err)
+	}
+	_, err = verifier.verify(purchaseRequest{Store: entitlements.StoreGoogle, PackageName: "com.other", ProductID: "monthly", PurchaseToken: "token", Kind: kindSubscription}, server.Client())
+	if errNotPurchased != err {
+		t.Errorf("Expected a purchase for another app not to verify, was %v", err)
+	}
+	_, err = verifier.verify(purchaseRequest{Store: entitlements.StoreGoogle, PackageName: "com.folktells", ProductID: "weekly", PurchaseToken: "token", Kind: kindSubscription, UserID: "user1"}, server.Client())
+	if nil != err {
+		t.Errorf("Expected a purchase for the user's account to verify, was %v", err)
+	}
+	_, err = verifier.verify(purchaseRequest{Store: entitlements.StoreGoogle, PackageName: "com.folktells", ProductID: "weekly", PurchaseToken: "token", Kind: kindSubscription, UserID: "user2"}, server.Client())
+	if entitlements.ErrClaimed != err {
+		t.Errorf("Expected a purchase for another account to be refused, was %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/entitlements"
+)
+
+// purchaseRequest is a purchase the app asks to have verified. Apple
+// purchases carry the app receipt, Google ones the product, purchase token and
+// whether it is a subscription or a one time product. The user is the one
+// asking, set by the handler.
+type purchaseRequest struct {
+	Store         string `json:"store"`
+	Receipt       string `json:"receipt,omitempty"`
+	PackageName   string `json:"packageName,omitempty"`
+	ProductID     string `json:"productId,omitempty"`
+	PurchaseToken string `json:"purchaseToken,omitempty"`
+	Kind          string `json:"kind,omitempty"`
+	UserID        string `json:"-"`
+}
+
+// storeVerifier checks a purchase with the store it was made in and says what
+// it entitles the user to.
+type storeVerifier interface {
+	verify(purchase purchaseRequest, client *http.Client) (entitlements.Entitlement, error)
+}
+
+// errNotPurchased means the store does not know the purchase, or it was not
+// made in this app.
+var errNotPurchased = errors.New("Purchase could not be verified")
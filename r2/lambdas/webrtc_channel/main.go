@@ -2,26 +2,70 @@ package main
 
 import (
 	"context"
+	"net/url"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/channels"
 	"github.com/sowens-csd/folktells-server/awsproxy"
 	"github.com/sowens-csd/folktells-server/webrtc"
 )
 
 // Handler takes a deviceId in the body of the request and uses it create or find a
-// ChannelArn which it then returns in the body of the response.
+// ChannelArn which it then returns in the body of the response. The channel is
+// recorded as the user's, a channel another user already owns is refused.
+//
+// DELETE webrtc/channel/{deviceID} deletes the user's channel for the device,
+// for when the device is removed. Channels that are not deleted this way are
+// deleted by webrtc_sweeper once they have been idle long enough.
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
 	if nil != errResp {
 		return *errResp, nil
 	}
+	if request.HTTPMethod == "DELETE" {
+		return removeDeviceChannel(ftCtx, request.PathParameters["deviceID"]), nil
+	}
 	channelArn, err := webrtc.CreateChannel(ftCtx, request.Body)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
+	err = channels.Record(ftCtx, request.Body, channelArn, int(time.Now().UTC().Unix()*1000))
+	if channels.ErrNotOwned == err {
+		return awsproxy.NewForbiddenResponse(ftCtx, err.Error()), nil
+	}
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
 	return awsproxy.NewTextResponse(ftCtx, channelArn), nil
 }
 
+func removeDeviceChannel(ftCtx awsproxy.FTContext, rawDeviceID string) awsproxy.Response {
+	deviceID, err := url.PathUnescape(rawDeviceID)
+	if nil != err || len(deviceID) == 0 {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such device")
+	}
+	deviceChannels, err := channels.FindDeviceChannels(ftCtx, deviceID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	if len(deviceChannels) == 0 {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No channel for the device")
+	}
+	client, err := channels.NewClient(ftCtx.Context)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	for _, channel := range deviceChannels {
+		err = channels.Delete(ftCtx, client, channel)
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger)
+		}
+		ftCtx.RequestLogger.Info().Str("channel", channel.ChannelARN).Str("device", deviceID).Msg("signaling channel deleted")
+	}
+	return awsproxy.NewSuccessResponse(ftCtx)
+}
+
 func main() {
 	lambda.Start(Handler)
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/channels"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// canConnect checks whether the user may connect to the channel. Only the
+// owner connects as master. A viewer must be the owner or share a group with
+// them, and when the owner has restricted the channel, be an allowed viewer.
+func canConnect(ftCtx awsproxy.FTContext, channel channels.Channel, viewer bool) (bool, error) {
+	if channel.OwnerID == ftCtx.UserID {
+		return true, nil
+	}
+	if !viewer || len(channel.OwnerID) == 0 {
+		return false, nil
+	}
+	shared, err := records.SharesGroup(ftCtx, channel.OwnerID)
+	if nil != err || !shared {
+		return false, err
+	}
+	mode, err := channels.ViewerMode(ftCtx, channel)
+	if nil != err || mode == channels.ViewersOpen {
+		return nil == err, err
+	}
+	allowed, err := records.LoadItem(ftCtx, channels.Prefix+channel.ChannelARN, channels.ViewerPrefix+ftCtx.UserID)
+	return len(allowed) > 0, err
+}
@@ -4,9 +4,15 @@ go 1.16
 
 require (
 	github.com/aws/aws-lambda-go v1.32.0
-	github.com/aws/aws-sdk-go-v2/service/kinesisvideo v1.4.1 // indirect
+	github.com/aws/aws-sdk-go-v2 v1.16.4
+	github.com/aws/aws-sdk-go-v2/config v1.15.9
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.15.5
+	github.com/aws/aws-sdk-go-v2/service/kinesisvideo v1.4.1
 	github.com/aws/aws-sdk-go-v2/service/kinesisvideosignaling v1.4.1 // indirect
 	github.com/rs/zerolog v1.26.1 // indirect
+	github.com/sowens-csd/folktells-cloud-deploy/shared v0.0.0
 	github.com/sowens-csd/folktells-server v1.7.21
 	github.com/sowens-csd/ftlambdas v0.0.0-20211007203249-34f5c14bf754
 )
+
+replace github.com/sowens-csd/folktells-cloud-deploy/shared => ../../shared
@@ -2,15 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/url"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/channels"
 	"github.com/sowens-csd/folktells-server/awsproxy"
 	"github.com/sowens-csd/folktells-server/webrtc"
 )
 
 // Handler takes a deviceId in the body of the request and uses it create or find a
-// ChannelArn which it then returns in the body of the response.
+// ChannelArn which it then returns in the body of the response. Each use of a
+// channel is recorded so that idle channels can be swept.
+//
+// Only the channel's owner may connect as master. Viewers must share a group
+// with the owner and, when the owner keeps a list of viewers, be on it.
+// Channels made before they were recorded by webrtc_channel have no known
+// owner. A device connecting to one as master records it as its own, as
+// webrtc_channel would have, when Kinesis Video has the channel named after
+// the device. Otherwise it is refused and has to register its channel again
+// through webrtc_channel. Until a channel has an owner viewers are refused.
 func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
 	awsproxy.SetupAccessParameters(ctx)
 	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
@@ -23,13 +35,68 @@ func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response,
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
+	channel, err := channels.Load(ftCtx, channelARN)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if !viewer && (nil == channel || len(channel.OwnerID) == 0) {
+		channel, err = adoptChannel(ftCtx, channelARN, request.PathParameters["device"])
+		if channels.ErrNotOwned == err || errNotDeviceChannel == err {
+			return awsproxy.NewForbiddenResponse(ftCtx, err.Error()), nil
+		}
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+	}
+	if nil == channel {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such channel"), nil
+	}
+	allowed, err := canConnect(ftCtx, *channel, viewer)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if !allowed {
+		return awsproxy.NewForbiddenResponse(ftCtx, "Not allowed to connect to this channel"), nil
+	}
 	services, err := webrtc.GetServices(ftCtx, channelARN, request.PathParameters["device"], viewer)
 	if nil != err {
 		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
 	}
+	err = channels.Touch(ftCtx, channelARN, int(time.Now().UTC().Unix()*1000))
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("channel", channelARN).Msg("channel use not recorded")
+	}
 	return awsproxy.NewJSONResponse(ftCtx, services), nil
 }
 
+var errNotDeviceChannel = errors.New("Channel was not made for this device, register the device's channel again")
+
+// adoptChannel records a channel that has no owner as the user's device's
+// when it was made for the device.
+func adoptChannel(ftCtx awsproxy.FTContext, channelARN, rawDeviceID string) (*channels.Channel, error) {
+	deviceID, err := url.PathUnescape(rawDeviceID)
+	if nil != err {
+		return nil, err
+	}
+	client, err := channels.NewClient(ftCtx.Context)
+	if nil != err {
+		return nil, err
+	}
+	madeFor, err := channels.MadeFor(ftCtx.Context, client, channelARN, deviceID)
+	if nil != err {
+		return nil, err
+	}
+	if !madeFor {
+		return nil, errNotDeviceChannel
+	}
+	err = channels.Record(ftCtx, deviceID, channelARN, int(time.Now().UTC().Unix()*1000))
+	if nil != err {
+		return nil, err
+	}
+	ftCtx.RequestLogger.Info().Str("channel", channelARN).Str("device", deviceID).Msg("untracked signaling channel recorded")
+	return channels.Load(ftCtx, channelARN)
+}
+
 func main() {
 	lambda.Start(Handler)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/channels"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs once a day and deletes the signaling channels that are no
+// longer needed, those whose device its owner no longer has registered for
+// pushes and those that have not been used for channelIdleDays. Every channel
+// in Kinesis Video is checked, a channel no device has recorded, such as one
+// made before channels were tracked, is tracked from its first sweep and
+// deleted once it has been idle as long. Channels that Kinesis Video no longer has are
+// forgotten. A channel that cannot be deleted is logged and tried again on
+// the next run.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	ftCtx := awsproxy.NewFromContext(ctx, "")
+	client, err := channels.NewClient(ctx)
+	if nil != err {
+		return err
+	}
+	listed, err := channels.List(ctx, client)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Msg("channel list failed")
+		return err
+	}
+	tracked, err := channels.Tracked(ftCtx)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Msg("channel scan failed")
+		return err
+	}
+	now := time.Now().UTC()
+	current, untracked, vanished := reconcile(listed, tracked)
+	for _, channel := range untracked {
+		channel.LastUsedAt = int(now.Unix() * 1000)
+		_, err = channels.Discover(ftCtx, channel.ChannelARN, channel.CreatedAt, channel.LastUsedAt)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("channel", channel.ChannelARN).Msg("untracked channel not recorded")
+			continue
+		}
+		current = append(current, channel)
+	}
+	for _, channel := range vanished {
+		err = channels.Forget(ftCtx, channel)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("channel", channel.ChannelARN).Msg("vanished channel not forgotten")
+		}
+	}
+	owners := map[string]*sharing.OnlineUser{}
+	removed := func(channel channels.Channel) bool {
+		if len(channel.OwnerID) == 0 {
+			return false
+		}
+		owner, found := owners[channel.OwnerID]
+		if !found {
+			var err error
+			owner, err = sharing.LoadOnlineUser(ftCtx, channel.OwnerID)
+			var notFound *sharing.UserNotFoundError
+			if errors.As(err, &notFound) {
+				owner = nil
+			} else if nil != err {
+				ftCtx.RequestLogger.Error().Err(err).Str("user", channel.OwnerID).Msg("channel owner lookup failed")
+				return false
+			}
+			owners[channel.OwnerID] = owner
+		}
+		return nil == owner || !channels.Registered(owner, channel)
+	}
+	deleted := sweepChannels(ctx, client, current, removed, channels.IdleSince(now), func(channel channels.Channel, err error) {
+		ftCtx.RequestLogger.Error().Err(err).Str("channel", channel.ChannelARN).Msg("signaling channel not deleted")
+	})
+	for _, channel := range deleted {
+		err = channels.Forget(ftCtx, channel)
+		if nil != err {
+			ftCtx.RequestLogger.Error().Err(err).Str("channel", channel.ChannelARN).Msg("deleted channel not forgotten")
+		}
+	}
+	ftCtx.RequestLogger.Info().Int("checked", len(current)).Int("untracked", len(untracked)).Int("vanished", len(vanished)).Int("deleted", len(deleted)).Msg("signaling channels swept")
+	return nil
+}
+
+// reconcile matches the channels Kinesis Video has with the tracked ones. The
+// tracked channels it still has are current, those it has that are not
+// tracked are untracked and the tracked ones it no longer has have vanished.
+func reconcile(listed, tracked []channels.Channel) (current, untracked, vanished []channels.Channel) {
+	exists := map[string]bool{}
+	for _, channel := range listed {
+		exists[channel.ChannelARN] = true
+	}
+	known := map[string]bool{}
+	for _, channel := range tracked {
+		known[channel.ChannelARN] = true
+		if exists[channel.ChannelARN] {
+			current = append(current, channel)
+		} else {
+			vanished = append(vanished, channel)
+		}
+	}
+	for _, channel := range listed {
+		if !known[channel.ChannelARN] {
+			untracked = append(untracked, channel)
+		}
+	}
+	return current, untracked, vanished
+}
+
+// sweepChannels deletes the channels of removed devices and the ones last
+// used before idleBefore from Kinesis Video, returning those deleted.
+func sweepChannels(ctx context.Context, client channels.Client, current []channels.Channel, removed func(channels.Channel) bool, idleBefore int, failed func(channels.Channel, error)) []channels.Channel {
+	deleted := []channels.Channel{}
+	for _, channel := range current {
+		if channel.LastUsedAt >= idleBefore && !removed(channel) {
+			continue
+		}
+		err := channels.RemoveSignalingChannel(ctx, client, channel.ChannelARN)
+		if nil != err {
+			failed(channel, err)
+			continue
+		}
+		deleted = append(deleted, channel)
+	}
+	return deleted
+}
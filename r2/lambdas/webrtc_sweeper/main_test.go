@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesisvideo"
+	kvtypes "github.com/aws/aws-sdk-go-v2/service/kinesisvideo/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/channels"
+)
+
+// fakeChannelClient records the channels deleted and fails with the error
+// set for a channel.
+type fakeChannelClient struct {
+	deleted []string
+	errs    map[string]error
+}
+
+func (c *fakeChannelClient) DescribeSignalingChannel(ctx context.Context, params *kinesisvideo.DescribeSignalingChannelInput, optFns ...func(*kinesisvideo.Options)) (*kinesisvideo.DescribeSignalingChannelOutput, error) {
+	return &kinesisvideo.DescribeSignalingChannelOutput{}, nil
+}
+
+func (c *fakeChannelClient) ListSignalingChannels(ctx context.Context, params *kinesisvideo.ListSignalingChannelsInput, optFns ...func(*kinesisvideo.Options)) (*kinesisvideo.ListSignalingChannelsOutput, error) {
+	return &kinesisvideo.ListSignalingChannelsOutput{}, nil
+}
+
+func (c *fakeChannelClient) DeleteSignalingChannel(ctx context.Context, params *kinesisvideo.DeleteSignalingChannelInput, optFns ...func(*kinesisvideo.Options)) (*kinesisvideo.DeleteSignalingChannelOutput, error) {
+	if err := c.errs[*params.ChannelARN]; nil != err {
+		return nil, err
+	}
+	c.deleted = append(c.deleted, *params.ChannelARN)
+	return &kinesisvideo.DeleteSignalingChannelOutput{}, nil
+}
+
+func noneRemoved(channel channels.Channel) bool {
+	return false
+}
+
+func ignoreFailure(channel channels.Channel, err error) {}
+
+func TestSweepDeletesIdleChannels(t *testing.T) {
+	client := &fakeChannelClient{}
+	current := []channels.Channel{
+		{ChannelARN: "idle", OwnerID: "u1", LastUsedAt: 999},
+		{ChannelARN: "active", OwnerID: "u1", LastUsedAt: 1000},
+	}
+	deleted := sweepChannels(context.Background(), client, current, noneRemoved, 1000, ignoreFailure)
+	if len(deleted) != 1 || deleted[0].ChannelARN != "idle" {
+		t.Errorf("Expected only the idle channel to be deleted, was %v", deleted)
+	}
+	if len(client.deleted) != 1 || client.deleted[0] != "idle" {
+		t.Errorf("Expected only the idle channel to be deleted from Kinesis Video, was %v", client.deleted)
+	}
+}
+
+func TestSweepDeletesChannelsOfRemovedDevices(t *testing.T) {
+	client := &fakeChannelClient{}
+	current := []channels.Channel{
+		{ChannelARN: "kept", OwnerID: "u1", LastUsedAt: 2000},
+		{ChannelARN: "orphan", OwnerID: "u1", DeviceID: "gone", LastUsedAt: 2000},
+	}
+	removed := func(channel channels.Channel) bool {
+		return channel.DeviceID == "gone"
+	}
+	deleted := sweepChannels(context.Background(), client, current, removed, 1000, ignoreFailure)
+	if len(deleted) != 1 || deleted[0].ChannelARN != "orphan" {
+		t.Errorf("Expected only the orphaned channel to be deleted, was %v", deleted)
+	}
+}
+
+func TestSweepTreatsMissingChannelAsDeleted(t *testing.T) {
+	client := &fakeChannelClient{errs: map[string]error{"missing": &kvtypes.ResourceNotFoundException{}}}
+	current := []channels.Channel{{ChannelARN: "missing", OwnerID: "u1"}}
+	deleted := sweepChannels(context.Background(), client, current, noneRemoved, 1000, ignoreFailure)
+	if len(deleted) != 1 {
+		t.Errorf("Expected a channel Kinesis Video no longer has to be forgotten, was %v", deleted)
+	}
+}
+
+func TestSweepKeepsChannelsThatFailToDelete(t *testing.T) {
+	client := &fakeChannelClient{errs: map[string]error{"stuck": errors.New("throttled")}}
+	current := []channels.Channel{{ChannelARN: "stuck", OwnerID: "u1"}}
+	var failures []string
+	deleted := sweepChannels(context.Background(), client, current, noneRemoved, 1000, func(channel channels.Channel, err error) {
+		failures = append(failures, channel.ChannelARN)
+	})
+	if len(deleted) != 0 {
+		t.Errorf("Expected a channel that failed to delete to be kept, was %v", deleted)
+	}
+	if len(failures) != 1 || failures[0] != "stuck" {
+		t.Errorf("Expected the failure to be reported, was %v", failures)
+	}
+}
+
+func TestReconcileFindsUntrackedAndVanishedChannels(t *testing.T) {
+	listed := []channels.Channel{{ChannelARN: "tracked"}, {ChannelARN: "old", CreatedAt: 500}}
+	tracked := []channels.Channel{{ChannelARN: "tracked", OwnerID: "u1"}, {ChannelARN: "vanished", OwnerID: "u1"}}
+	current, untracked, vanished := reconcile(listed, tracked)
+	if len(current) != 1 || current[0].ChannelARN != "tracked" || current[0].OwnerID != "u1" {
+		t.Errorf("Expected the tracked channel to be current, was %v", current)
+	}
+	if len(untracked) != 1 || untracked[0].ChannelARN != "old" || untracked[0].CreatedAt != 500 {
+		t.Errorf("Expected the channel made before tracking to be untracked, was %v", untracked)
+	}
+	if len(vanished) != 1 || vanished[0].ChannelARN != "vanished" {
+		t.Errorf("Expected the channel Kinesis Video no longer has to have vanished, was %v", vanished)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/channels"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+type channelViewer struct {
+	UserID  string `json:"userId"`
+	AddedAt int    `json:"addedAt"`
+}
+
+// channelViewers is who may view the device's channels, anyone sharing a
+// group with the owner when the mode is open and only the listed viewers
+// when it is restricted.
+type channelViewers struct {
+	Mode    string          `json:"mode"`
+	Viewers []channelViewer `json:"viewers"`
+}
+
+// Handler lets the owner of a device's channels choose who may view them.
+// The mode is kept apart from the list, so removing the last viewer from a
+// restricted channel leaves only the owner able to view it. Viewers must
+// share a group with the owner.
+//
+// GET webrtc/channel/{deviceID}/viewers
+// PUT webrtc/channel/{deviceID}/viewers with {"mode": "open"} or
+// {"mode": "restricted"}
+// PUT webrtc/channel/{deviceID}/viewers/{userID}
+// DELETE webrtc/channel/{deviceID}/viewers/{userID}
+func Handler(ctx context.Context, request awsproxy.Request) (awsproxy.Response, error) {
+	ftCtx, errResp := awsproxy.NewFromContextAndJWT(ctx, request)
+	if nil != errResp {
+		return *errResp, nil
+	}
+	deviceID, err := url.PathUnescape(request.PathParameters["deviceID"])
+	if nil != err || len(deviceID) == 0 {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such device"), nil
+	}
+	deviceChannels, err := loadDeviceChannels(ftCtx, deviceID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if len(deviceChannels) == 0 {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No channel for the device"), nil
+	}
+	rawUserID, found := request.PathParameters["userID"]
+	if !found && request.HTTPMethod == "GET" {
+		viewers, err := loadViewers(ftCtx, deviceChannels[0])
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, viewers), nil
+	}
+	if !found {
+		var update channelViewers
+		err = json.Unmarshal([]byte(request.Body), &update)
+		if nil != err || (update.Mode != channels.ViewersOpen && update.Mode != channels.ViewersRestricted) {
+			return awsproxy.HandleError(fmt.Errorf("mode must be open or restricted"), ftCtx.RequestLogger), nil
+		}
+		for _, channel := range deviceChannels {
+			err = channels.SetViewerMode(ftCtx, channel.ChannelARN, update.Mode)
+			if nil != err {
+				return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+			}
+		}
+		deviceChannels[0].Viewers = update.Mode
+		viewers, err := loadViewers(ftCtx, deviceChannels[0])
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+		return awsproxy.NewJSONResponse(ftCtx, viewers), nil
+	}
+	userID, err := url.PathUnescape(rawUserID)
+	if nil != err || len(userID) == 0 || userID == ftCtx.UserID {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such user"), nil
+	}
+	if request.HTTPMethod == "DELETE" {
+		for _, channel := range deviceChannels {
+			err = records.DeleteItem(ftCtx, channels.Prefix+channel.ChannelARN, channels.ViewerPrefix+userID)
+			if nil != err {
+				return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+			}
+		}
+		return awsproxy.NewSuccessResponse(ftCtx), nil
+	}
+	shared, err := records.SharesGroup(ftCtx, userID)
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+	}
+	if !shared {
+		return awsproxy.NewResourceNotFoundResponse(ftCtx, "No such user in your groups"), nil
+	}
+	viewer := channelViewer{UserID: userID, AddedAt: int(time.Now().UTC().Unix() * 1000)}
+	for _, channel := range deviceChannels {
+		_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Item: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: channels.Prefix + channel.ChannelARN},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: channels.ViewerPrefix + userID},
+				"addedAt":             &types.AttributeValueMemberN{Value: strconv.Itoa(viewer.AddedAt)},
+			},
+		})
+		if nil != err {
+			return awsproxy.HandleError(err, ftCtx.RequestLogger), nil
+		}
+	}
+	return awsproxy.NewJSONResponse(ftCtx, viewer), nil
+}
+
+// loadDeviceChannels finds the user's channels for the device. A channel
+// from before the mode was kept is given the mode it had then.
+func loadDeviceChannels(ftCtx awsproxy.FTContext, deviceID string) ([]channels.Channel, error) {
+	owned, err := channels.FindDeviceChannels(ftCtx, deviceID)
+	if nil != err {
+		return nil, err
+	}
+	deviceChannels := []channels.Channel{}
+	for _, channel := range owned {
+		tracked, err := channels.Load(ftCtx, channel.ChannelARN)
+		if nil != err {
+			return nil, err
+		}
+		if nil == tracked {
+			continue
+		}
+		if len(tracked.Viewers) == 0 {
+			tracked.Viewers, err = channels.ViewerMode(ftCtx, *tracked)
+			if nil == err {
+				err = channels.SetViewerMode(ftCtx, tracked.ChannelARN, tracked.Viewers)
+			}
+			if nil != err {
+				return nil, err
+			}
+		}
+		deviceChannels = append(deviceChannels, *tracked)
+	}
+	return deviceChannels, nil
+}
+
+func loadViewers(ftCtx awsproxy.FTContext, channel channels.Channel) (channelViewers, error) {
+	viewers := channelViewers{Mode: channel.Viewers, Viewers: []channelViewer{}}
+	items, err := records.QueryPrefix(ftCtx, channels.Prefix+channel.ChannelARN, channels.ViewerPrefix)
+	if nil != err {
+		return viewers, err
+	}
+	for _, item := range items {
+		viewers.Viewers = append(viewers.Viewers, channelViewer{
+			UserID:  strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), channels.ViewerPrefix),
+			AddedAt: records.NumberAttribute(item, "addedAt"),
+		})
+	}
+	return viewers, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -7,12 +7,34 @@
 (cd lambdas/user_post; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/user_post)
 (cd lambdas/user_by_email; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/user_by_email)
 (cd lambdas/verify_receipt; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/verify_receipt)
+(cd lambdas/store_notifications; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/store_notifications)
 (cd lambdas/new_story; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/new_story)
 (cd lambdas/stories; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/stories)
+(cd lambdas/story_trash; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/story_trash)
+(cd lambdas/story_purge; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/story_purge)
+(cd lambdas/story_export; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/story_export)
+(cd lambdas/story_export_worker; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/story_export_worker)
+(cd lambdas/story_index_backfill; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/story_index_backfill)
 (cd lambdas/si; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/si)
 (cd lambdas/sms_getnumber; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_getnumber)
 (cd lambdas/sms_assignnumber; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_assignnumber)
 (cd lambdas/sms_receive; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_receive)
+(cd lambdas/sms_replies; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_replies)
+(cd lambdas/sms_contacts; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_contacts)
+(cd lambdas/sms_release; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_release)
+(cd lambdas/sms_number_backfill; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_number_backfill)
+(cd lambdas/sms_status; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_status)
+(cd lambdas/sms_log; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/sms_log)
+(cd lambdas/presence; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/presence)
+(cd lambdas/socket_message; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/socket_message)
+(cd lambdas/socket_reaper; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/socket_reaper)
+(cd lambdas/group_broadcast; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/group_broadcast)
+(cd lambdas/call_session; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/call_session)
+(cd lambdas/call_timeout; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/call_timeout)
+(cd lambdas/call_history; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/call_history)
+(cd lambdas/call_rules; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/call_rules)
+(cd lambdas/quiet_hours; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/quiet_hours)
+(cd lambdas/delayed_alerts; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/delayed_alerts)
 (cd lambdas/remote_command; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/remote_command)
 (cd lambdas/new_group; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/new_group)
 (cd lambdas/group_member; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/group_member)
@@ -23,6 +45,8 @@
 (cd lambdas/p2p_lookup; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/p2p_lookup)
 (cd lambdas/webrtc_channel; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/webrtc_channel)
 (cd lambdas/webrtc_service; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/webrtc_service)
+(cd lambdas/webrtc_sweeper; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/webrtc_sweeper)
+(cd lambdas/webrtc_viewers; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/webrtc_viewers)
 (cd lambdas/connection_handler; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/connection_handler)
 (cd lambdas/disconnection_handler; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/disconnection_handler)
 (cd lambdas/websocketAuthorizer; exec env GOOS=linux go build -ldflags="-s -w" -o ../../bin/websocketAuthorizer)
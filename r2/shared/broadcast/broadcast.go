@@ -0,0 +1,244 @@
+// Package broadcast sends an event to every device of every member of a
+// group, over the websocket to each connected device and by push to each
+// member.
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/quiet"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/notification"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// Each delivery of a broadcast is recorded under
+// B#{groupID}#{senderID}#{eventID}, as
+// U#{userID}#{deviceID} for a device reached over the websocket and
+// U#{userID}#push for a push to the member. A delivery is recorded before it
+// is made and only if it has not been already, which is what keeps a repeated
+// broadcast from reaching a device twice. The event ID comes from the sender,
+// so it only counts as a repeat within the same group from the same sender.
+const resourcePrefix = "B#"
+const pushDeviceID = "push"
+
+// retentionDays is how long deliveries are remembered, a broadcast sent
+// again after that is delivered again.
+const retentionDays = 7
+
+// The outcome of each delivery in the report. A duplicate was delivered by an
+// earlier send of the same event.
+const (
+	Delivered = "delivered"
+	Duplicate = "duplicate"
+	Failed    = "failed"
+	Gone      = "gone"
+	Skipped   = "skipped"
+)
+
+// Event is what is sent to the group. Data goes to each connected device as
+// is, the alert is pushed to the members and without one they are not pushed
+// to.
+type Event struct {
+	ID      string
+	GroupID string
+	Data    []byte
+	Alert   *Alert
+}
+
+type Alert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type Report struct {
+	EventID    string            `json:"eventId"`
+	GroupID    string            `json:"groupId"`
+	Recipients []RecipientReport `json:"recipients"`
+}
+
+// RecipientReport is how the event reached the member. Push is the push
+// outcome, or the outcome of the member's quiet hours when they held it back,
+// with the time a delayed push will be sent.
+type RecipientReport struct {
+	UserID        string           `json:"userId"`
+	Devices       []DeviceDelivery `json:"devices"`
+	Push          string           `json:"push,omitempty"`
+	PushDeliverAt int              `json:"pushDeliverAt,omitempty"`
+	Delivered     bool             `json:"delivered"`
+}
+
+type DeviceDelivery struct {
+	DeviceID string `json:"deviceId"`
+	Status   string `json:"status"`
+}
+
+// Send sends the event to each member's connected devices and pushes the
+// alert to every member other than the sender. A push goes to all of a
+// member's registered devices and only the devices without a live connection
+// are missing the event, so the app drops a pushed alert for an event it
+// already got over the websocket. The sender's own devices only get the event
+// over the websocket. A member in their quiet hours has the push suppressed
+// or delayed.
+func Send(ftCtx awsproxy.FTContext, event Event, client *http.Client) (Report, error) {
+	poster, err := sockets.NewPoster(ftCtx)
+	if nil != err {
+		return Report{EventID: event.ID, GroupID: event.GroupID, Recipients: []RecipientReport{}}, err
+	}
+	return send(ftCtx, event, transport{
+		post: func(connection sockets.Connection, data []byte) error {
+			return poster.Deliver(ftCtx, connection, data)
+		},
+		push: func(userID string, alert Alert) error {
+			user, err := sharing.LoadOnlineUser(ftCtx, userID)
+			if nil != err {
+				return err
+			}
+			return notification.SendAlert(ftCtx, alert.Title, alert.Body, user, client)
+		},
+	})
+}
+
+// transport is how send reaches a connection and pushes to a member.
+type transport struct {
+	post func(connection sockets.Connection, data []byte) error
+	push func(userID string, alert Alert) error
+}
+
+func send(ftCtx awsproxy.FTContext, event Event, via transport) (Report, error) {
+	report := Report{EventID: event.ID, GroupID: event.GroupID, Recipients: []RecipientReport{}}
+	broadcastID := ResourceID(event.GroupID, ftCtx.UserID, event.ID)
+	members, err := sockets.GroupMemberIDs(ftCtx, []string{event.GroupID})
+	if nil != err {
+		return report, err
+	}
+	for _, memberID := range members {
+		recipient := RecipientReport{UserID: memberID, Devices: []DeviceDelivery{}}
+		connections, err := sockets.UserConnections(ftCtx, memberID)
+		if nil != err {
+			return report, err
+		}
+		for _, device := range sockets.DeviceConnections(connections) {
+			status := deliver(ftCtx, broadcastID, memberID, device.DeviceID, func() error {
+				return via.post(device, event.Data)
+			})
+			if status == Delivered || status == Duplicate {
+				recipient.Delivered = true
+			}
+			recipient.Devices = append(recipient.Devices, DeviceDelivery{DeviceID: device.DeviceID, Status: status})
+		}
+		if memberID != ftCtx.UserID {
+			recipient.Push = Skipped
+			if nil != event.Alert {
+				recipient.Push, recipient.PushDeliverAt = pushAlert(ftCtx, broadcastID, memberID, *event.Alert, via)
+				if recipient.Push == Delivered || recipient.Push == Duplicate {
+					recipient.Delivered = true
+				}
+			}
+		}
+		report.Recipients = append(report.Recipients, recipient)
+	}
+	ftCtx.RequestLogger.Info().Str("event", event.ID).Str("group", event.GroupID).Int("recipients", len(report.Recipients)).Msg("broadcast sent")
+	return report, nil
+}
+
+// pushAlert pushes the alert to the member unless their quiet hours hold it
+// back. Holding the alert counts as its delivery, so sending the event again
+// neither pushes it nor queues another delayed alert. The outcome is returned
+// with the time a delayed alert will be sent.
+func pushAlert(ftCtx awsproxy.FTContext, broadcastID, memberID string, alert Alert, via transport) (string, int) {
+	held, deliverAt := quiet.Sent, 0
+	status := deliver(ftCtx, broadcastID, memberID, pushDeviceID, func() error {
+		var err error
+		held, deliverAt, err = quiet.Hold(ftCtx, memberID, alert.Title, alert.Body, true)
+		if nil != err {
+			if held != quiet.Sent {
+				return err
+			}
+			ftCtx.RequestLogger.Error().Err(err).Str("user", memberID).Msg("quiet hours not checked")
+		}
+		if held != quiet.Sent {
+			return nil
+		}
+		return via.push(memberID, alert)
+	})
+	if status == Delivered && held != quiet.Sent {
+		return held, deliverAt
+	}
+	return status, 0
+}
+
+// deliver makes the delivery unless it has been made already. A delivery that
+// fails is forgotten so that sending the event again retries it.
+func deliver(ftCtx awsproxy.FTContext, broadcastID, userID, deviceID string, send func() error) string {
+	referenceID := ftdb.ReferenceIDFromUserID(userID) + "#" + deviceID
+	first, err := recordDelivery(ftCtx, broadcastID, referenceID)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("broadcast", broadcastID).Str("delivery", referenceID).Msg("delivery not recorded")
+		return Failed
+	}
+	if !first {
+		return Duplicate
+	}
+	err = send()
+	if nil == err {
+		return Delivered
+	}
+	ftCtx.RequestLogger.Info().Err(err).Str("broadcast", broadcastID).Str("delivery", referenceID).Msg("broadcast not delivered")
+	if forgetErr := records.DeleteItem(ftCtx, broadcastID, referenceID); nil != forgetErr {
+		ftCtx.RequestLogger.Error().Err(forgetErr).Str("broadcast", broadcastID).Str("delivery", referenceID).Msg("failed delivery not forgotten")
+	}
+	if sockets.ErrGone == err {
+		return Gone
+	}
+	return Failed
+}
+
+// ResourceID is what the deliveries of the sender's event to the group are
+// recorded under.
+func ResourceID(groupID, senderID, eventID string) string {
+	return fmt.Sprintf("%s%s#%s#%s", resourcePrefix, groupID, senderID, eventID)
+}
+
+// recordDelivery records the delivery, first is false if it already was.
+func recordDelivery(ftCtx awsproxy.FTContext, broadcastID, referenceID string) (bool, error) {
+	now := time.Now().UTC()
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: broadcastID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: referenceID},
+			"deliveredAt":         &types.AttributeValueMemberN{Value: strconv.Itoa(int(now.Unix() * 1000))},
+			records.TTLField:      records.TTLAttribute(now.Add(retentionDays * 24 * time.Hour)),
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#refId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#refId": ftdb.ReferenceIDField,
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	return nil == err, err
+}
+
+// SenderName is how the sender is named in an alert.
+func SenderName(ftCtx awsproxy.FTContext) string {
+	resID := ftdb.ResourceIDFromUserID(ftCtx.UserID)
+	item, err := records.LoadItem(ftCtx, resID, resID)
+	if name := records.StringAttribute(item, ftdb.NameField); nil == err && len(name) > 0 {
+		return name
+	}
+	return "Someone in your group"
+}
@@ -0,0 +1,319 @@
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/quiet"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+func TestBroadcastIDIsScopedToGroupAndSender(t *testing.T) {
+	id := ResourceID("g1", "u1", "e1")
+	if id != "B#g1#u1#e1" {
+		t.Errorf("Expected B#g1#u1#e1, was %s", id)
+	}
+	if id == ResourceID("g2", "u1", "e1") || id == ResourceID("g1", "u2", "e1") {
+		t.Errorf("Expected the same event ID in another group or from another sender to be another broadcast")
+	}
+}
+
+func TestDeliveryIsMadeOnce(t *testing.T) {
+	ftCtx := newTestContext(t, newStubTable(), "sender")
+	sent := 0
+	send := func() error {
+		sent++
+		return nil
+	}
+	if status := deliver(ftCtx, "B#g1#sender#e1", "u1", "d1", send); status != Delivered {
+		t.Errorf("Expected the first delivery to be made, was %s", status)
+	}
+	if status := deliver(ftCtx, "B#g1#sender#e1", "u1", "d1", send); status != Duplicate {
+		t.Errorf("Expected the repeated delivery to be a duplicate, was %s", status)
+	}
+	if status := deliver(ftCtx, "B#g1#sender#e1", "u1", "d2", send); status != Delivered {
+		t.Errorf("Expected another device to be delivered to, was %s", status)
+	}
+	if sent != 2 {
+		t.Errorf("Expected 2 deliveries, was %d", sent)
+	}
+}
+
+func TestFailedDeliveryIsRetried(t *testing.T) {
+	ftCtx := newTestContext(t, newStubTable(), "sender")
+	failing := func() error { return errors.New("unreachable") }
+	if status := deliver(ftCtx, "B#g1#sender#e1", "u1", "d1", failing); status != Failed {
+		t.Errorf("Expected the delivery to fail, was %s", status)
+	}
+	gone := func() error { return sockets.ErrGone }
+	if status := deliver(ftCtx, "B#g1#sender#e1", "u1", "d1", gone); status != Gone {
+		t.Errorf("Expected the retry to be made and find the connection gone, was %s", status)
+	}
+	if status := deliver(ftCtx, "B#g1#sender#e1", "u1", "d1", func() error { return nil }); status != Delivered {
+		t.Errorf("Expected the next retry to be delivered, was %s", status)
+	}
+}
+
+func TestSendPushesEachOtherMemberOnce(t *testing.T) {
+	table := newStubTable()
+	table.addMember("g1", "sender")
+	table.addMember("g1", "connected")
+	table.addMember("g1", "offline")
+	table.addConnection("sender", "c0", "d0")
+	table.addConnection("connected", "c1", "d1")
+	table.addConnection("connected", "c2", "d2")
+	ftCtx := newTestContext(t, table, "sender")
+	posted := map[string]int{}
+	pushed := map[string]int{}
+	via := transport{
+		post: func(connection sockets.Connection, data []byte) error {
+			posted[connection.DeviceID]++
+			if connection.DeviceID == "d2" {
+				return sockets.ErrGone
+			}
+			return nil
+		},
+		push: func(userID string, alert Alert) error {
+			pushed[userID]++
+			return nil
+		},
+	}
+	event := Event{ID: "e1", GroupID: "g1", Data: []byte(`{}`), Alert: &Alert{Title: "Folktells", Body: "Hello"}}
+	report, err := send(ftCtx, event, via)
+	if nil != err {
+		t.Fatal(err)
+	}
+	recipients := map[string]RecipientReport{}
+	for _, recipient := range report.Recipients {
+		recipients[recipient.UserID] = recipient
+	}
+	if sender := recipients["sender"]; sender.Push != "" || len(sender.Devices) != 1 || sender.Devices[0].Status != Delivered {
+		t.Errorf("Expected the sender's device to get the event without a push, was %+v", sender)
+	}
+	connected := recipients["connected"]
+	if connected.Push != Delivered || !connected.Delivered {
+		t.Errorf("Expected a member with a gone device to be pushed to, was %+v", connected)
+	}
+	statuses := map[string]string{}
+	for _, device := range connected.Devices {
+		statuses[device.DeviceID] = device.Status
+	}
+	if statuses["d1"] != Delivered || statuses["d2"] != Gone {
+		t.Errorf("Expected d1 delivered and d2 gone, was %v", statuses)
+	}
+	if offline := recipients["offline"]; offline.Push != Delivered || len(offline.Devices) != 0 {
+		t.Errorf("Expected a member without connections to be pushed to, was %+v", offline)
+	}
+
+	report, err = send(ftCtx, event, via)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if pushed["connected"] != 1 || pushed["offline"] != 1 || pushed["sender"] != 0 {
+		t.Errorf("Expected each other member pushed to once, was %v", pushed)
+	}
+	if posted["d0"] != 1 || posted["d1"] != 1 || posted["d2"] != 2 {
+		t.Errorf("Expected only the gone device to be posted to again, was %v", posted)
+	}
+	for _, recipient := range report.Recipients {
+		if recipient.UserID != "sender" && recipient.Push != Duplicate {
+			t.Errorf("Expected the repeated push to be a duplicate, was %+v", recipient)
+		}
+	}
+}
+
+func TestSendWithoutAlertDoesNotPush(t *testing.T) {
+	table := newStubTable()
+	table.addMember("g1", "sender")
+	table.addMember("g1", "offline")
+	ftCtx := newTestContext(t, table, "sender")
+	via := transport{
+		post: func(connection sockets.Connection, data []byte) error { return nil },
+		push: func(userID string, alert Alert) error {
+			t.Errorf("Expected no push to %s", userID)
+			return nil
+		},
+	}
+	report, err := send(ftCtx, Event{ID: "e1", GroupID: "g1", Data: []byte(`{}`)}, via)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, recipient := range report.Recipients {
+		if recipient.UserID == "offline" && (recipient.Push != Skipped || recipient.Delivered) {
+			t.Errorf("Expected the push to be skipped, was %+v", recipient)
+		}
+	}
+}
+
+func TestHeldAlertIsQueuedOnce(t *testing.T) {
+	table := newStubTable()
+	table.addMember("g1", "sender")
+	table.addMember("g1", "sleeping")
+	now := time.Now().UTC()
+	table.put(map[string]map[string]interface{}{
+		ftdb.ResourceIDField:  {"S": ftdb.ResourceIDFromUserID("sleeping")},
+		ftdb.ReferenceIDField: {"S": quiet.SettingsReferenceID},
+		"enabled":             {"BOOL": true},
+		"timeZone":            {"S": "UTC"},
+		"start":               {"S": now.Add(-time.Hour).Format("15:04")},
+		"end":                 {"S": now.Add(time.Hour).Format("15:04")},
+		"delay":               {"BOOL": true},
+	})
+	ftCtx := newTestContext(t, table, "sender")
+	via := transport{
+		post: func(connection sockets.Connection, data []byte) error { return nil },
+		push: func(userID string, alert Alert) error {
+			t.Errorf("Expected no push to %s in their quiet hours", userID)
+			return nil
+		},
+	}
+	event := Event{ID: "e1", GroupID: "g1", Data: []byte(`{}`), Alert: &Alert{Title: "Folktells", Body: "Hello"}}
+	for attempt := 0; attempt < 2; attempt++ {
+		report, err := send(ftCtx, event, via)
+		if nil != err {
+			t.Fatal(err)
+		}
+		for _, recipient := range report.Recipients {
+			if recipient.UserID != "sleeping" {
+				continue
+			}
+			if attempt == 0 && (recipient.Push != quiet.Delayed || recipient.PushDeliverAt == 0) {
+				t.Errorf("Expected the alert to be delayed, was %+v", recipient)
+			}
+			if attempt == 1 && recipient.Push != Duplicate {
+				t.Errorf("Expected the repeated alert to be a duplicate, was %+v", recipient)
+			}
+		}
+	}
+	if delayed := table.writes[quiet.DelayedResourceID]; delayed != 1 {
+		t.Errorf("Expected one delayed alert, was %d", delayed)
+	}
+}
+
+func newTestContext(t *testing.T, table *stubTable, userID string) awsproxy.FTContext {
+	server := httptest.NewServer(table)
+	t.Cleanup(server.Close)
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: dynamodb.EndpointResolverFromURL(server.URL),
+	})
+	logger := zerolog.Nop()
+	return awsproxy.FTContext{Context: context.Background(), DBSvc: client, RequestLogger: &logger, UserID: userID}
+}
+
+// stubTable answers the DynamoDB calls broadcast makes from memory. Only
+// attribute_not_exists conditions and begins_with key conditions are
+// understood. The items written under each resource are counted.
+type stubTable struct {
+	lock   sync.Mutex
+	items  map[string]map[string]map[string]interface{}
+	writes map[string]int
+}
+
+func newStubTable() *stubTable {
+	return &stubTable{items: map[string]map[string]map[string]interface{}{}, writes: map[string]int{}}
+}
+
+func (table *stubTable) put(item map[string]map[string]interface{}) {
+	table.items[stubKey(item)] = item
+}
+
+func (table *stubTable) addMember(groupID, userID string) {
+	table.put(map[string]map[string]interface{}{
+		ftdb.ResourceIDField:  {"S": ftdb.ResourceIDFromGroupID(groupID)},
+		ftdb.ReferenceIDField: {"S": ftdb.ReferenceIDFromUserID(userID)},
+	})
+}
+
+func (table *stubTable) addConnection(userID, connectionID, deviceID string) {
+	table.put(map[string]map[string]interface{}{
+		ftdb.ResourceIDField:  {"S": ftdb.ResourceIDFromUserID(userID)},
+		ftdb.ReferenceIDField: {"S": sockets.ConnectionPrefix + connectionID},
+		"connectionId":        {"S": connectionID},
+		"deviceId":            {"S": deviceID},
+		"domainName":          {"S": "ws.example.com"},
+		"stage":               {"S": "test"},
+	})
+}
+
+type stubRequest struct {
+	Item                      map[string]map[string]interface{} `json:"Item"`
+	Key                       map[string]map[string]interface{} `json:"Key"`
+	ConditionExpression       string                            `json:"ConditionExpression"`
+	ExpressionAttributeValues map[string]map[string]interface{} `json:"ExpressionAttributeValues"`
+}
+
+func (table *stubTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	var request stubRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	response := map[string]interface{}{}
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "PutItem":
+		if _, found := table.items[stubKey(request.Item)]; found && strings.Contains(request.ConditionExpression, "attribute_not_exists") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException",
+				"message": "The conditional request failed",
+			})
+			return
+		}
+		table.put(request.Item)
+		resourceID, _ := request.Item[ftdb.ResourceIDField]["S"].(string)
+		table.writes[resourceID]++
+	case "GetItem":
+		if item, found := table.items[stubKey(request.Key)]; found {
+			response["Item"] = item
+		}
+	case "DeleteItem":
+		delete(table.items, stubKey(request.Key))
+	case "Query":
+		var resourceID, prefix string
+		for name, value := range request.ExpressionAttributeValues {
+			if name == ":prefix" {
+				prefix, _ = value["S"].(string)
+			} else {
+				resourceID, _ = value["S"].(string)
+			}
+		}
+		items := []map[string]map[string]interface{}{}
+		for _, item := range table.items {
+			if item[ftdb.ResourceIDField]["S"] == resourceID && strings.HasPrefix(item[ftdb.ReferenceIDField]["S"].(string), prefix) {
+				items = append(items, item)
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return stubKey(items[i]) < stubKey(items[j]) })
+		response["Items"] = items
+		response["Count"] = len(items)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func stubKey(item map[string]map[string]interface{}) string {
+	resourceID, _ := item[ftdb.ResourceIDField]["S"].(string)
+	referenceID, _ := item[ftdb.ReferenceIDField]["S"].(string)
+	return resourceID + "|" + referenceID
+}
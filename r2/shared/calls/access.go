@@ -0,0 +1,119 @@
+package calls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// A user may look up and call the people they share a group with, and anyone
+// who has put them on their allow list. Blocking someone stops them whatever
+// groups are shared. Rules are kept as J#{userID} under the U#{userID} of the
+// user who set them.
+const RuleReferencePrefix = "J#"
+const RuleField = "rule"
+
+const (
+	RuleAllow = "allow"
+	RuleBlock = "block"
+)
+
+// Call alerts are limited per caller. Each window's alerts are counted in
+// Z#{windowStart} under the caller's U#{userID}.
+const alertWindowPrefix = "Z#"
+const alertWindow = 10 * time.Minute
+const maxAlertsPerWindow = 10
+
+var ErrRateLimited = errors.New("too many calls, try again later")
+
+// CanCall checks whether the user may look up and call the callee.
+func CanCall(ftCtx awsproxy.FTContext, calleeID string) (bool, error) {
+	if len(calleeID) == 0 || calleeID == ftCtx.UserID {
+		return false, nil
+	}
+	rule, err := records.LoadItem(ftCtx, ftdb.ResourceIDFromUserID(calleeID), RuleReferencePrefix+ftCtx.UserID)
+	if nil != err {
+		return false, err
+	}
+	switch records.StringAttribute(rule, RuleField) {
+	case RuleBlock:
+		return false, nil
+	case RuleAllow:
+		return true, nil
+	}
+	return records.SharesGroup(ftCtx, calleeID)
+}
+
+// FindCallableByEmail finds the user with the email through the user index
+// and checks that the user may call them. Nil means there is no such user that
+// may be called, which is not told apart from there being no such user.
+func FindCallableByEmail(ftCtx awsproxy.FTContext, email string) (*sharing.OnlineUser, error) {
+	callee, err := sharing.LoadOnlineUserByEmail(ftCtx, email)
+	var notFound *sharing.UserNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if nil != err || nil == callee {
+		return nil, err
+	}
+	allowed, err := CanCall(ftCtx, callee.ID)
+	if nil != err || !allowed {
+		return nil, err
+	}
+	return callee, nil
+}
+
+// TakeAlert counts a call alert against the caller, failing with
+// ErrRateLimited once they have sent maxAlertsPerWindow in the window.
+func TakeAlert(ftCtx awsproxy.FTContext) error {
+	window := time.Now().UTC().Truncate(alertWindow)
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(ftdb.ResourceIDFromUserID(ftCtx.UserID), fmt.Sprintf("%s%d", alertWindowPrefix, window.Unix()*1000)),
+		UpdateExpression:    aws.String("ADD #alerts :one SET #ttl = :ttl"),
+		ConditionExpression: aws.String("attribute_not_exists(#alerts) OR #alerts < :max"),
+		ExpressionAttributeNames: map[string]string{
+			"#alerts": "alerts",
+			"#ttl":    records.TTLField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: strconv.Itoa(maxAlertsPerWindow)},
+			":ttl": records.TTLAttribute(window.Add(2 * alertWindow)),
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrRateLimited
+	}
+	return err
+}
+
+// NewRateLimitedResponse tells the caller they have sent too many call alerts
+// and should try again later.
+func NewRateLimitedResponse(ftCtx awsproxy.FTContext) awsproxy.Response {
+	body, err := json.Marshal(map[string]string{"message": ErrRateLimited.Error()})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.Response{
+		StatusCode:      http.StatusTooManyRequests,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Retry-After":  strconv.Itoa(int(alertWindow.Seconds())),
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package calls
+
+import "testing"
+
+var ringingCall = Session{
+	SessionID: "s1",
+	CallerID:  "caller",
+	CalleeID:  "callee",
+	CallType:  "video",
+	State:     StateRinging,
+	CreatedAt: 1000,
+}
+
+func TestCalleeAcceptsOrDeclines(t *testing.T) {
+	if state, err := NextState(ringingCall, "callee", ActionAccept, 2000); nil != err || state != StateAccepted {
+		t.Errorf("Expected accepted, was %s %v", state, err)
+	}
+	if state, err := NextState(ringingCall, "callee", ActionDecline, 2000); nil != err || state != StateDeclined {
+		t.Errorf("Expected declined, was %s %v", state, err)
+	}
+}
+
+func TestOnlyCallerCancels(t *testing.T) {
+	if state, err := NextState(ringingCall, "caller", ActionCancel, 2000); nil != err || state != StateCancelled {
+		t.Errorf("Expected cancelled, was %s %v", state, err)
+	}
+	if _, err := NextState(ringingCall, "callee", ActionCancel, 2000); ErrNotParticipant != err {
+		t.Errorf("Expected callee not to cancel, was %v", err)
+	}
+	if _, err := NextState(ringingCall, "caller", ActionAccept, 2000); ErrNotParticipant != err {
+		t.Errorf("Expected caller not to accept, was %v", err)
+	}
+}
+
+func TestRingingTooLongIsMissed(t *testing.T) {
+	if state, err := NextState(ringingCall, "callee", ActionAccept, 1000+46000); nil != err || state != StateMissed {
+		t.Errorf("Expected missed, was %s %v", state, err)
+	}
+}
+
+func TestAnsweredCallCannotBeAnsweredAgain(t *testing.T) {
+	accepted := ringingCall
+	accepted.State = StateAccepted
+	if _, err := NextState(accepted, "callee", ActionDecline, 2000); ErrInvalidAction != err {
+		t.Errorf("Expected invalid action, was %v", err)
+	}
+}
+
+func TestEitherPartyEndsAnAcceptedCall(t *testing.T) {
+	accepted := ringingCall
+	accepted.State = StateAccepted
+	for _, userID := range []string{"caller", "callee"} {
+		if state, err := NextState(accepted, userID, ActionEnd, 2000); nil != err || state != StateEnded {
+			t.Errorf("Expected %s to end the call, was %s %v", userID, state, err)
+		}
+	}
+	if _, err := NextState(accepted, "someone", ActionEnd, 2000); ErrNotParticipant != err {
+		t.Errorf("Expected only participants to end the call, was %v", err)
+	}
+}
+
+func TestHistoryOfEndedCall(t *testing.T) {
+	ended := ringingCall
+	ended.State = StateEnded
+	ended.CallerName = "Mary"
+	ended.CalleeName = "Bob"
+	ended.AnsweredAt = 5000
+	ended.EndedAt = 95000
+	entries := historyEntries(ended)
+	if entries[0].Direction != "outgoing" || entries[0].OtherName != "Bob" || entries[0].Duration != 90 {
+		t.Errorf("Expected the caller's outgoing call to Bob of 90s, was %+v", entries[0])
+	}
+	if entries[1].Direction != "incoming" || entries[1].OtherID != "caller" || entries[1].Unseen {
+		t.Errorf("Expected the callee's seen incoming call, was %+v", entries[1])
+	}
+}
+
+func TestMissedCallIsUnseenByCallee(t *testing.T) {
+	missed := ringingCall
+	missed.State = StateMissed
+	missed.EndedAt = 46000
+	entries := historyEntries(missed)
+	if entries[0].Unseen || !entries[1].Unseen || entries[1].Duration != 0 {
+		t.Errorf("Expected only the callee to have an unseen missed call, was %+v", entries)
+	}
+}
@@ -0,0 +1,84 @@
+package calls
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// The missed calls a user has not seen are kept as the set of their history
+// keys in O#missedCalls under their U#{userID}, so the badge is one read
+// however long the history grows.
+const missedReferenceID = "O#missedCalls"
+const unseenField = "unseen"
+
+// addMissed adds the history entry to the user's unseen missed calls.
+func addMissed(ftCtx awsproxy.FTContext, userID, historyReferenceID string) error {
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ftdb.GetTableName()),
+		Key:              records.Key(ftdb.ResourceIDFromUserID(userID), missedReferenceID),
+		UpdateExpression: aws.String("ADD #unseen :call"),
+		ExpressionAttributeNames: map[string]string{
+			"#unseen": unseenField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":call": &types.AttributeValueMemberSS{Value: []string{historyReferenceID}},
+		},
+	})
+	return err
+}
+
+// Unseen lists the history keys of the user's missed calls they have not
+// seen.
+func Unseen(ftCtx awsproxy.FTContext, userID string) ([]string, error) {
+	item, err := records.LoadItem(ftCtx, ftdb.ResourceIDFromUserID(userID), missedReferenceID)
+	if nil != err {
+		return nil, err
+	}
+	if unseen, ok := item[unseenField].(*types.AttributeValueMemberSS); ok {
+		return unseen.Value, nil
+	}
+	return []string{}, nil
+}
+
+// MarkSeen marks each of the user's unseen missed calls seen. Only the calls
+// read are taken out of the set, a call missed meanwhile stays unseen.
+func MarkSeen(ftCtx awsproxy.FTContext, userID string) (int, error) {
+	unseen, err := Unseen(ftCtx, userID)
+	if nil != err || len(unseen) == 0 {
+		return 0, err
+	}
+	for _, referenceID := range unseen {
+		_, err = ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(ftdb.GetTableName()),
+			Key:                 records.Key(ftdb.ResourceIDFromUserID(userID), referenceID),
+			UpdateExpression:    aws.String("REMOVE #unseen"),
+			ConditionExpression: aws.String("attribute_exists(#refId)"),
+			ExpressionAttributeNames: map[string]string{
+				"#unseen": unseenField,
+				"#refId":  ftdb.ReferenceIDField,
+			},
+		})
+		var conditionFailed *types.ConditionalCheckFailedException
+		if nil != err && !errors.As(err, &conditionFailed) {
+			return 0, err
+		}
+	}
+	_, err = ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ftdb.GetTableName()),
+		Key:              records.Key(ftdb.ResourceIDFromUserID(userID), missedReferenceID),
+		UpdateExpression: aws.String("DELETE #unseen :seen"),
+		ExpressionAttributeNames: map[string]string{
+			"#unseen": unseenField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":seen": &types.AttributeValueMemberSS{Value: unseen},
+		},
+	})
+	return len(unseen), err
+}
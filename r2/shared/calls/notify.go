@@ -0,0 +1,42 @@
+package calls
+
+import (
+	"encoding/json"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/sockets"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// callEvent is what the connected devices of both parties get each time the
+// call changes state.
+type callEvent struct {
+	Action string  `json:"action"`
+	Data   Session `json:"data"`
+}
+
+// NotifyParticipants sends the call's state to every connected device of the
+// caller and the callee. A connection that has gone is dropped on the spot,
+// any other failure is logged and the connection skipped.
+func NotifyParticipants(ftCtx awsproxy.FTContext, session Session) error {
+	body, err := json.Marshal(callEvent{Action: "call", Data: session})
+	if nil != err {
+		return err
+	}
+	poster, err := sockets.NewPoster(ftCtx)
+	if nil != err {
+		return err
+	}
+	for _, userID := range []string{session.CallerID, session.CalleeID} {
+		connections, err := sockets.UserConnections(ftCtx, userID)
+		if nil != err {
+			return err
+		}
+		for _, connection := range connections {
+			err = poster.Deliver(ftCtx, connection, body)
+			if nil != err && sockets.ErrGone != err {
+				ftCtx.RequestLogger.Info().Err(err).Str("connection", connection.ConnectionID).Msg("call state not delivered")
+			}
+		}
+	}
+	return nil
+}
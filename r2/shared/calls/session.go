@@ -0,0 +1,289 @@
+// Package calls keeps call sessions, the history each party has of them and
+// the count of missed calls the callee has not seen.
+package calls
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// A call is kept as V#{sessionID} under itself. While it rings it is also
+// V#{sessionID} under V#ringing, which call_timeout checks for calls nobody
+// answered, and under V#ringing#{calleeID}, which the callee's devices check
+// for the call they were rung for. Each party has the call in their history
+// as H#{createdAt}#{sessionID} under their U#{userID}, so it lists in order.
+const SessionPrefix = "V#"
+const RingingResourceID = "V#ringing"
+const HistoryPrefix = "H#"
+
+// CalleeRingingResourceID is where the calls ringing the callee are listed.
+func CalleeRingingResourceID(calleeID string) string {
+	return RingingResourceID + "#" + calleeID
+}
+
+// RingTimeout is how long a call rings before it is missed.
+const RingTimeout = 45 * time.Second
+
+// The states of a call. A call starts ringing and the callee accepting or
+// declining it, the caller cancelling it or nobody answering in time ends the
+// ringing. An accepted call is ended by either party hanging up.
+const (
+	StateRinging   = "ringing"
+	StateAccepted  = "accepted"
+	StateDeclined  = "declined"
+	StateCancelled = "cancelled"
+	StateMissed    = "missed"
+	StateEnded     = "ended"
+)
+
+// The actions that move a call on. Timeout is only taken by call_timeout, or
+// when a call is found to have rung too long.
+const (
+	ActionAccept  = "accept"
+	ActionDecline = "decline"
+	ActionCancel  = "cancel"
+	ActionTimeout = "timeout"
+	ActionEnd     = "end"
+)
+
+var ErrNotParticipant = errors.New("not a participant in the call")
+var ErrInvalidAction = errors.New("call cannot do that")
+var ErrStateChanged = errors.New("call has already changed state")
+
+// Session is a call from the caller to the callee. Times are in milliseconds.
+type Session struct {
+	SessionID  string `json:"sessionId" dynamodbav:"sessionId"`
+	CallerID   string `json:"callerId" dynamodbav:"callerId"`
+	CallerName string `json:"callerName,omitempty" dynamodbav:"callerName"`
+	CalleeID   string `json:"calleeId" dynamodbav:"calleeId"`
+	CalleeName string `json:"calleeName,omitempty" dynamodbav:"calleeName"`
+	CallType   string `json:"callType" dynamodbav:"callType"`
+	State      string `json:"state" dynamodbav:"state"`
+	CreatedAt  int    `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt  int    `json:"updatedAt" dynamodbav:"updatedAt"`
+	AnsweredAt int    `json:"answeredAt,omitempty" dynamodbav:"answeredAt"`
+	EndedAt    int    `json:"endedAt,omitempty" dynamodbav:"endedAt"`
+}
+
+// HistoryEntry is the call as one party sees it. Duration is how long the
+// call lasted once answered, in seconds. A missed call is unseen until the
+// callee has looked at their missed calls.
+type HistoryEntry struct {
+	SessionID string   `json:"sessionId" dynamodbav:"sessionId"`
+	Direction string   `json:"direction" dynamodbav:"direction"`
+	OtherID   string   `json:"otherId" dynamodbav:"otherId"`
+	OtherName string   `json:"otherName,omitempty" dynamodbav:"otherName"`
+	Users     []string `json:"participants" dynamodbav:"participants"`
+	CallType  string   `json:"callType" dynamodbav:"callType"`
+	Outcome   string   `json:"outcome" dynamodbav:"outcome"`
+	CreatedAt int      `json:"createdAt" dynamodbav:"createdAt"`
+	StartedAt int      `json:"startedAt,omitempty" dynamodbav:"startedAt"`
+	EndedAt   int      `json:"endedAt,omitempty" dynamodbav:"endedAt"`
+	Duration  int      `json:"duration" dynamodbav:"duration"`
+	Unseen    bool     `json:"unseen,omitempty" dynamodbav:"unseen"`
+}
+
+// NextState works out the state the action moves the call to when taken by
+// the user. A call that has rung for longer than RingTimeout is missed
+// whatever the action.
+func NextState(session Session, userID, action string, now int) (string, error) {
+	if session.State == StateAccepted && action == ActionEnd {
+		if userID != session.CallerID && userID != session.CalleeID {
+			return "", ErrNotParticipant
+		}
+		return StateEnded, nil
+	}
+	if session.State != StateRinging {
+		return "", ErrInvalidAction
+	}
+	if now-session.CreatedAt >= int(RingTimeout/time.Millisecond) {
+		return StateMissed, nil
+	}
+	switch action {
+	case ActionAccept, ActionDecline:
+		if userID != session.CalleeID {
+			return "", ErrNotParticipant
+		}
+		if action == ActionAccept {
+			return StateAccepted, nil
+		}
+		return StateDeclined, nil
+	case ActionCancel:
+		if userID != session.CallerID {
+			return "", ErrNotParticipant
+		}
+		return StateCancelled, nil
+	}
+	return "", ErrInvalidAction
+}
+
+func Save(ftCtx awsproxy.FTContext, session Session) error {
+	item, err := attributevalue.MarshalMap(session)
+	if nil != err {
+		return err
+	}
+	item[ftdb.ResourceIDField] = &types.AttributeValueMemberS{Value: SessionPrefix + session.SessionID}
+	item[ftdb.ReferenceIDField] = &types.AttributeValueMemberS{Value: SessionPrefix + session.SessionID}
+	_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item:      item,
+	})
+	if nil != err {
+		return err
+	}
+	for _, resourceID := range []string{RingingResourceID, CalleeRingingResourceID(session.CalleeID)} {
+		_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Item: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: SessionPrefix + session.SessionID},
+				"createdAt":           &types.AttributeValueMemberN{Value: strconv.Itoa(session.CreatedAt)},
+				"calleeId":            &types.AttributeValueMemberS{Value: session.CalleeID},
+			},
+		})
+		if nil != err {
+			return err
+		}
+	}
+	return recordHistory(ftCtx, session)
+}
+
+// Load finds the call, nil if there is no such call.
+func Load(ftCtx awsproxy.FTContext, sessionID string) (*Session, error) {
+	item, err := records.LoadItem(ftCtx, SessionPrefix+sessionID, SessionPrefix+sessionID)
+	if nil != err || len(item) == 0 {
+		return nil, err
+	}
+	var session Session
+	err = attributevalue.UnmarshalMap(item, &session)
+	return &session, err
+}
+
+// ChangeState moves the call to the state as long as nobody else has moved it
+// first, notes when it was answered or ended, takes it off the ringing list
+// and updates both parties' history.
+func ChangeState(ftCtx awsproxy.FTContext, session *Session, state string, now int) error {
+	timeField := "endedAt"
+	if state == StateAccepted {
+		timeField = "answeredAt"
+	}
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: SessionPrefix + session.SessionID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: SessionPrefix + session.SessionID},
+		},
+		UpdateExpression:    aws.String("SET #state = :state, #updatedAt = :now, #time = :now"),
+		ConditionExpression: aws.String("#state = :from"),
+		ExpressionAttributeNames: map[string]string{
+			"#state":     "state",
+			"#updatedAt": "updatedAt",
+			"#time":      timeField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":state": &types.AttributeValueMemberS{Value: state},
+			":from":  &types.AttributeValueMemberS{Value: session.State},
+			":now":   &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrStateChanged
+	}
+	if nil != err {
+		return err
+	}
+	wasRinging := session.State == StateRinging
+	session.State = state
+	session.UpdatedAt = now
+	if state == StateAccepted {
+		session.AnsweredAt = now
+	} else {
+		session.EndedAt = now
+	}
+	if wasRinging {
+		err = ForgetRinging(ftCtx, session.SessionID, session.CalleeID)
+		if nil != err {
+			return err
+		}
+	}
+	return recordHistory(ftCtx, *session)
+}
+
+// ForgetRinging takes the call off the ringing lists.
+func ForgetRinging(ftCtx awsproxy.FTContext, sessionID, calleeID string) error {
+	for _, resourceID := range []string{RingingResourceID, CalleeRingingResourceID(calleeID)} {
+		err := records.DeleteItem(ftCtx, resourceID, SessionPrefix+sessionID)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyEntries makes the caller's and the callee's history of the call.
+func historyEntries(session Session) []HistoryEntry {
+	entry := HistoryEntry{
+		SessionID: session.SessionID,
+		Users:     []string{session.CallerID, session.CalleeID},
+		CallType:  session.CallType,
+		Outcome:   session.State,
+		CreatedAt: session.CreatedAt,
+		StartedAt: session.AnsweredAt,
+		EndedAt:   session.EndedAt,
+	}
+	if session.AnsweredAt > 0 && session.EndedAt > session.AnsweredAt {
+		entry.Duration = (session.EndedAt - session.AnsweredAt) / 1000
+	}
+	outgoing := entry
+	outgoing.Direction = "outgoing"
+	outgoing.OtherID = session.CalleeID
+	outgoing.OtherName = session.CalleeName
+	incoming := entry
+	incoming.Direction = "incoming"
+	incoming.OtherID = session.CallerID
+	incoming.OtherName = session.CallerName
+	incoming.Unseen = session.State == StateMissed
+	return []HistoryEntry{outgoing, incoming}
+}
+
+// HistoryReferenceID orders history by when the call was placed.
+func HistoryReferenceID(session Session) string {
+	return fmt.Sprintf("%s%013d#%s", HistoryPrefix, session.CreatedAt, session.SessionID)
+}
+
+// recordHistory writes both parties' history of the call. A call that has
+// just been missed is added to the callee's unseen missed calls, ChangeState
+// only lets one writer move the call to missed so it is added once.
+func recordHistory(ftCtx awsproxy.FTContext, session Session) error {
+	owners := []string{session.CallerID, session.CalleeID}
+	for i, entry := range historyEntries(session) {
+		item, err := attributevalue.MarshalMap(entry)
+		if nil != err {
+			return err
+		}
+		item[ftdb.ResourceIDField] = &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(owners[i])}
+		item[ftdb.ReferenceIDField] = &types.AttributeValueMemberS{Value: HistoryReferenceID(session)}
+		_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Item:      item,
+		})
+		if nil != err {
+			return err
+		}
+	}
+	if session.State == StateMissed {
+		return addMissed(ftCtx, session.CalleeID, HistoryReferenceID(session))
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+// Package channels tracks the Kinesis Video signaling channels that
+// webrtc.CreateChannel makes for each device, who owns them and when they
+// were last used, so that the ones no longer needed can be deleted.
+package channels
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesisvideo"
+	kvtypes "github.com/aws/aws-sdk-go-v2/service/kinesisvideo/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// A signaling channel is kept as F#{channelARN} under F#{channelARN} with its
+// owner, device and when it was created and last used, and as
+// F#{channelARN} under the owner's U#{userID} with the device, which lists
+// the channels of each device. The viewers the owner has allowed are kept as
+// Y#{userID} under F#{channelARN}.
+const Prefix = "F#"
+const ViewerPrefix = "Y#"
+
+// Who may view a channel, besides its owner. Anyone sharing a group with the
+// owner may view an open channel, only the allowed viewers may view a
+// restricted one. Channels from before the mode was kept have none, see
+// ViewerMode.
+const (
+	ViewersOpen       = "open"
+	ViewersRestricted = "restricted"
+)
+const viewersField = "viewers"
+
+// defaultIdleDays is how long a channel may go unused before it is deleted,
+// unless channelIdleDays is configured.
+const defaultIdleDays = 90
+
+var ErrNotOwned = errors.New("Channel belongs to another user")
+
+// Channel is a signaling channel and who it belongs to, times are in
+// milliseconds. A channel found in Kinesis Video that no device has recorded
+// has no owner.
+type Channel struct {
+	ChannelARN string `json:"channelArn"`
+	OwnerID    string `json:"ownerId"`
+	DeviceID   string `json:"deviceId"`
+	CreatedAt  int    `json:"createdAt"`
+	LastUsedAt int    `json:"lastUsedAt"`
+	Viewers    string `json:"viewers,omitempty"`
+}
+
+// Client is the part of the Kinesis Video client used to list, describe and
+// delete channels.
+type Client interface {
+	DescribeSignalingChannel(ctx context.Context, params *kinesisvideo.DescribeSignalingChannelInput, optFns ...func(*kinesisvideo.Options)) (*kinesisvideo.DescribeSignalingChannelOutput, error)
+	ListSignalingChannels(ctx context.Context, params *kinesisvideo.ListSignalingChannelsInput, optFns ...func(*kinesisvideo.Options)) (*kinesisvideo.ListSignalingChannelsOutput, error)
+	DeleteSignalingChannel(ctx context.Context, params *kinesisvideo.DeleteSignalingChannelInput, optFns ...func(*kinesisvideo.Options)) (*kinesisvideo.DeleteSignalingChannelOutput, error)
+}
+
+func NewClient(ctx context.Context) (Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if nil != err {
+		return nil, err
+	}
+	return kinesisvideo.NewFromConfig(cfg), nil
+}
+
+// Record notes that the user's device uses the channel. The first user to
+// record a channel owns it, anyone else gets ErrNotOwned.
+func Record(ftCtx awsproxy.FTContext, deviceID, channelARN string, now int) error {
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(Prefix+channelARN, Prefix+channelARN),
+		UpdateExpression:    aws.String("SET #ownerId = :owner, #deviceId = :device, #createdAt = if_not_exists(#createdAt, :now), #lastUsedAt = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(#ownerId) OR #ownerId = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#ownerId":    "ownerId",
+			"#deviceId":   "deviceId",
+			"#createdAt":  "createdAt",
+			"#lastUsedAt": "lastUsedAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":  &types.AttributeValueMemberS{Value: ftCtx.UserID},
+			":device": &types.AttributeValueMemberS{Value: deviceID},
+			":now":    &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrNotOwned
+	}
+	if nil != err {
+		return err
+	}
+	_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ftCtx.UserID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: Prefix + channelARN},
+			"deviceId":            &types.AttributeValueMemberS{Value: deviceID},
+		},
+	})
+	return err
+}
+
+// Discover starts tracking a channel found in Kinesis Video that no device
+// has recorded, as last used now so that it is kept for the idle period in
+// case a device still uses it. It returns false when the channel is already
+// tracked.
+func Discover(ftCtx awsproxy.FTContext, channelARN string, createdAt, now int) (bool, error) {
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: Prefix + channelARN},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: Prefix + channelARN},
+			"createdAt":           &types.AttributeValueMemberN{Value: strconv.Itoa(createdAt)},
+			"lastUsedAt":          &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#resId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId": ftdb.ResourceIDField,
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	return nil == err, err
+}
+
+// Touch records that the channel was used. Channels that are not tracked are
+// left alone.
+func Touch(ftCtx awsproxy.FTContext, channelARN string, now int) error {
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(Prefix+channelARN, Prefix+channelARN),
+		UpdateExpression:    aws.String("SET #lastUsedAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(#resId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId":      ftdb.ResourceIDField,
+			"#lastUsedAt": "lastUsedAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	return err
+}
+
+// Load finds the tracked channel, nil when it is not tracked.
+func Load(ftCtx awsproxy.FTContext, channelARN string) (*Channel, error) {
+	item, err := records.LoadItem(ftCtx, Prefix+channelARN, Prefix+channelARN)
+	if nil != err || len(item) == 0 {
+		return nil, err
+	}
+	channel := FromItem(item)
+	return &channel, nil
+}
+
+func FromItem(item map[string]types.AttributeValue) Channel {
+	return Channel{
+		ChannelARN: strings.TrimPrefix(records.StringAttribute(item, ftdb.ResourceIDField), Prefix),
+		OwnerID:    records.StringAttribute(item, "ownerId"),
+		DeviceID:   records.StringAttribute(item, "deviceId"),
+		CreatedAt:  records.NumberAttribute(item, "createdAt"),
+		LastUsedAt: records.NumberAttribute(item, "lastUsedAt"),
+		Viewers:    records.StringAttribute(item, viewersField),
+	}
+}
+
+// ViewerMode is who may view the channel. A channel from before the mode was
+// kept is restricted when the owner had allowed any viewers, as it was then.
+func ViewerMode(ftCtx awsproxy.FTContext, channel Channel) (string, error) {
+	if len(channel.Viewers) > 0 {
+		return channel.Viewers, nil
+	}
+	viewers, err := records.QueryPrefix(ftCtx, Prefix+channel.ChannelARN, ViewerPrefix)
+	if nil != err {
+		return "", err
+	}
+	if len(viewers) > 0 {
+		return ViewersRestricted, nil
+	}
+	return ViewersOpen, nil
+}
+
+// SetViewerMode records who may view the channel.
+func SetViewerMode(ftCtx awsproxy.FTContext, channelARN, mode string) error {
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(Prefix+channelARN, Prefix+channelARN),
+		UpdateExpression:    aws.String("SET #viewers = :mode"),
+		ConditionExpression: aws.String("attribute_exists(#resId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId":   ftdb.ResourceIDField,
+			"#viewers": viewersField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":mode": &types.AttributeValueMemberS{Value: mode},
+		},
+	})
+	return err
+}
+
+// Tracked lists every tracked channel.
+func Tracked(ftCtx awsproxy.FTContext) ([]Channel, error) {
+	channels := []Channel{}
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Scan(ftCtx.Context, &dynamodb.ScanInput{
+			TableName:        aws.String(ftdb.GetTableName()),
+			FilterExpression: aws.String("begins_with(#resId, :channel) AND #resId = #refId"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":channel": &types.AttributeValueMemberS{Value: Prefix},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			channels = append(channels, FromItem(item))
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return channels, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+// List lists every signaling channel in Kinesis Video, tracked or not, with
+// when it was created.
+func List(ctx context.Context, client Client) ([]Channel, error) {
+	channels := []Channel{}
+	var nextToken *string
+	for {
+		result, err := client.ListSignalingChannels(ctx, &kinesisvideo.ListSignalingChannelsInput{
+			MaxResults: aws.Int32(10000),
+			NextToken:  nextToken,
+		})
+		if nil != err {
+			return nil, err
+		}
+		for _, info := range result.ChannelInfoList {
+			channel := Channel{ChannelARN: aws.ToString(info.ChannelARN)}
+			if nil != info.CreationTime {
+				channel.CreatedAt = int(info.CreationTime.UTC().Unix() * 1000)
+			}
+			channels = append(channels, channel)
+		}
+		if nil == result.NextToken || len(*result.NextToken) == 0 {
+			return channels, nil
+		}
+		nextToken = result.NextToken
+	}
+}
+
+// MadeFor checks that Kinesis Video has the channel and that it was made for
+// the device, webrtc.CreateChannel names each channel after its device.
+func MadeFor(ctx context.Context, client Client, channelARN, deviceID string) (bool, error) {
+	result, err := client.DescribeSignalingChannel(ctx, &kinesisvideo.DescribeSignalingChannelInput{
+		ChannelARN: aws.String(channelARN),
+	})
+	var notFound *kvtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if nil != err {
+		return false, err
+	}
+	return nil != result.ChannelInfo && len(deviceID) > 0 && aws.ToString(result.ChannelInfo.ChannelName) == deviceID, nil
+}
+
+// Registered checks that the channel's device is still one of the devices
+// the owner has registered for pushes, removing the device drops its
+// registration.
+func Registered(owner *sharing.OnlineUser, channel Channel) bool {
+	for _, device := range owner.DeviceTokens {
+		if device.DeviceID == channel.DeviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete deletes the channel from Kinesis Video and forgets it.
+func Delete(ftCtx awsproxy.FTContext, client Client, channel Channel) error {
+	err := RemoveSignalingChannel(ftCtx.Context, client, channel.ChannelARN)
+	if nil != err {
+		return err
+	}
+	return Forget(ftCtx, channel)
+}
+
+// RemoveSignalingChannel deletes the channel from Kinesis Video, a channel
+// that is already gone counts as deleted.
+func RemoveSignalingChannel(ctx context.Context, client Client, channelARN string) error {
+	_, err := client.DeleteSignalingChannel(ctx, &kinesisvideo.DeleteSignalingChannelInput{
+		ChannelARN: aws.String(channelARN),
+	})
+	var notFound *kvtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	return err
+}
+
+// Forget removes everything kept about the channel.
+func Forget(ftCtx awsproxy.FTContext, channel Channel) error {
+	viewers, err := records.QueryPrefix(ftCtx, Prefix+channel.ChannelARN, ViewerPrefix)
+	if nil != err {
+		return err
+	}
+	for _, viewer := range viewers {
+		err = records.DeleteItem(ftCtx, Prefix+channel.ChannelARN, records.StringAttribute(viewer, ftdb.ReferenceIDField))
+		if nil != err {
+			return err
+		}
+	}
+	if len(channel.OwnerID) > 0 {
+		err := records.DeleteItem(ftCtx, ftdb.ResourceIDFromUserID(channel.OwnerID), Prefix+channel.ChannelARN)
+		if nil != err {
+			return err
+		}
+	}
+	return records.DeleteItem(ftCtx, Prefix+channel.ChannelARN, Prefix+channel.ChannelARN)
+}
+
+// FindDeviceChannels lists the user's channels for the device.
+func FindDeviceChannels(ftCtx awsproxy.FTContext, deviceID string) ([]Channel, error) {
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromUserID(ftCtx.UserID), Prefix)
+	if nil != err {
+		return nil, err
+	}
+	channels := []Channel{}
+	for _, item := range items {
+		if records.StringAttribute(item, "deviceId") != deviceID {
+			continue
+		}
+		channels = append(channels, Channel{
+			ChannelARN: strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), Prefix),
+			OwnerID:    ftCtx.UserID,
+			DeviceID:   deviceID,
+		})
+	}
+	return channels, nil
+}
+
+// IdleSince is the time in milliseconds before which a channel's last use
+// makes it idle.
+func IdleSince(now time.Time) int {
+	days, err := strconv.Atoi(os.Getenv("channelIdleDays"))
+	if nil != err || days <= 0 {
+		days = defaultIdleDays
+	}
+	return int(now.Add(-time.Duration(days)*24*time.Hour).UTC().Unix() * 1000)
+}
@@ -0,0 +1,222 @@
+// Package entitlements keeps what each user is entitled to from their store
+// purchases.
+//
+// The user's subscription, whichever store it was bought in, is kept as
+// O#entitlement under their U#{userID} and copied to the subscription state
+// of their online user, which is what the app reads. The user a subscription
+// belongs to is found from its original transaction,
+// O#transaction#{store}#{originalTransactionID} under itself, so that store
+// notifications can be applied, along with the signed date of the latest
+// notification applied. The first account to have a purchase verified
+// claims it, the purchase cannot then entitle any other account.
+package entitlements
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+const ReferenceID = "O#entitlement"
+const transactionPrefix = "O#transaction#"
+
+// The stores a purchase can come from.
+const (
+	StoreApple  = "apple"
+	StoreGoogle = "google"
+)
+
+// The online user's subscription state, set from the entitlement.
+const (
+	subscriptionStoreField     = "subscriptionStore"
+	subscriptionProductField   = "subscriptionProductId"
+	subscriptionActiveField    = "subscriptionActive"
+	subscriptionExpiresField   = "subscriptionExpiresAt"
+	subscriptionAutoRenewField = "subscriptionAutoRenew"
+)
+
+// ErrClaimed means the purchase has been verified for another account.
+var ErrClaimed = errors.New("Purchase belongs to another account")
+
+// Entitlement is what the user is entitled to from their latest verified
+// purchase. The original transaction identifies the subscription across
+// renewals, the Apple original transaction ID or the Google purchase token.
+// A purchase without an expiry does not expire. Times are in milliseconds.
+type Entitlement struct {
+	Store                 string `json:"store" dynamodbav:"store"`
+	ProductID             string `json:"productId" dynamodbav:"productId"`
+	OriginalTransactionID string `json:"originalTransactionId" dynamodbav:"originalTransactionId"`
+	Active                bool   `json:"active" dynamodbav:"active"`
+	ExpiresAt             int    `json:"expiresAt,omitempty" dynamodbav:"expiresAt"`
+	AutoRenew             bool   `json:"autoRenew" dynamodbav:"autoRenew"`
+	Revoked               bool   `json:"revoked" dynamodbav:"revoked"`
+	UpdatedAt             int    `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// Save claims the purchase for the user and records it as their entitlement,
+// failing with ErrClaimed when another account has claimed it.
+func Save(ftCtx awsproxy.FTContext, userID string, current Entitlement) error {
+	if len(current.OriginalTransactionID) > 0 {
+		err := Claim(ftCtx, userID, current.Store, current.OriginalTransactionID)
+		if nil != err {
+			return err
+		}
+	}
+	return write(ftCtx, userID, current)
+}
+
+// Record records the purchase as the user's entitlement without refusing it
+// when another account has claimed it, for purchases the store library has
+// already applied to the user. An unclaimed purchase is claimed for the user.
+func Record(ftCtx awsproxy.FTContext, userID string, current Entitlement) error {
+	if len(current.OriginalTransactionID) > 0 {
+		err := Claim(ftCtx, userID, current.Store, current.OriginalTransactionID)
+		if nil != err && ErrClaimed != err {
+			return err
+		}
+	}
+	return write(ftCtx, userID, current)
+}
+
+// write keeps the entitlement and sets the user's subscription state from it.
+func write(ftCtx awsproxy.FTContext, userID string, current Entitlement) error {
+	item, err := attributevalue.MarshalMap(current)
+	if nil != err {
+		return err
+	}
+	item[ftdb.ResourceIDField] = &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(userID)}
+	item[ftdb.ReferenceIDField] = &types.AttributeValueMemberS{Value: ReferenceID}
+	_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item:      item,
+	})
+	if nil != err {
+		return err
+	}
+	userResID := ftdb.ResourceIDFromUserID(userID)
+	_, err = ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(userResID, userResID),
+		UpdateExpression:    aws.String("SET #store = :store, #product = :product, #active = :active, #expires = :expires, #autoRenew = :autoRenew"),
+		ConditionExpression: aws.String("attribute_exists(#resId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId":     ftdb.ResourceIDField,
+			"#store":     subscriptionStoreField,
+			"#product":   subscriptionProductField,
+			"#active":    subscriptionActiveField,
+			"#expires":   subscriptionExpiresField,
+			"#autoRenew": subscriptionAutoRenewField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":store":     &types.AttributeValueMemberS{Value: current.Store},
+			":product":   &types.AttributeValueMemberS{Value: current.ProductID},
+			":active":    &types.AttributeValueMemberBOOL{Value: current.Active},
+			":expires":   &types.AttributeValueMemberN{Value: strconv.Itoa(current.ExpiresAt)},
+			":autoRenew": &types.AttributeValueMemberBOOL{Value: current.AutoRenew},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	return err
+}
+
+// Claim records the purchase as the user's, unless another account already
+// has it.
+func Claim(ftCtx awsproxy.FTContext, userID, store, originalTransactionID string) error {
+	transactionID := TransactionResourceID(store, originalTransactionID)
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(transactionID, transactionID),
+		UpdateExpression:    aws.String("SET userId = :me"),
+		ConditionExpression: aws.String("attribute_not_exists(userId) OR userId = :me"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":me": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrClaimed
+	}
+	return err
+}
+
+// Advance records signedDate, when the store signed a notification about
+// the subscription, as the latest applied. It is false when a notification
+// signed later has been applied already, the store's dates are only compared
+// with each other.
+func Advance(ftCtx awsproxy.FTContext, store, originalTransactionID string, signedDate int64) (bool, error) {
+	transactionID := TransactionResourceID(store, originalTransactionID)
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ftdb.GetTableName()),
+		Key:                 records.Key(transactionID, transactionID),
+		UpdateExpression:    aws.String("SET signedDate = :signed"),
+		ConditionExpression: aws.String("attribute_not_exists(signedDate) OR signedDate <= :signed"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":signed": &types.AttributeValueMemberN{Value: strconv.FormatInt(signedDate, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	return nil == err, err
+}
+
+// TransactionResourceID is where the subscription's user and history are
+// kept.
+func TransactionResourceID(store, originalTransactionID string) string {
+	return transactionPrefix + store + "#" + originalTransactionID
+}
+
+// FindUser finds the user a subscription belongs to, empty when it has never
+// been verified.
+func FindUser(ftCtx awsproxy.FTContext, store, originalTransactionID string) (string, error) {
+	transactionID := TransactionResourceID(store, originalTransactionID)
+	item, err := records.LoadItem(ftCtx, transactionID, transactionID)
+	if nil != err {
+		return "", err
+	}
+	return records.StringAttribute(item, "userId"), nil
+}
+
+// Load finds the user's entitlement, nil when they have never had a purchase
+// verified.
+func Load(ftCtx awsproxy.FTContext, userID string) (*Entitlement, error) {
+	item, err := records.LoadItem(ftCtx, ftdb.ResourceIDFromUserID(userID), ReferenceID)
+	if nil != err || len(item) == 0 {
+		return nil, err
+	}
+	var current Entitlement
+	err = attributevalue.UnmarshalMap(item, &current)
+	if nil != err {
+		return nil, err
+	}
+	return &current, nil
+}
+
+// NewClaimedResponse tells the user the purchase belongs to another account.
+func NewClaimedResponse(ftCtx awsproxy.FTContext) awsproxy.Response {
+	body, err := json.Marshal(map[string]string{"message": ErrClaimed.Error()})
+	if nil != err {
+		return awsproxy.HandleError(err, ftCtx.RequestLogger)
+	}
+	return awsproxy.Response{
+		StatusCode:      http.StatusConflict,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
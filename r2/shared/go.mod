@@ -0,0 +1,16 @@
+module github.com/sowens-csd/folktells-cloud-deploy/shared
+
+go 1.16
+
+require (
+	github.com/aws/aws-sdk-go-v2 v1.16.7
+	github.com/aws/aws-sdk-go-v2/config v1.15.14
+	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.9.2
+	github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi v1.10.5
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.15.5
+	github.com/aws/aws-sdk-go-v2/service/kinesisvideo v1.4.1
+	github.com/aws/aws-sdk-go-v2/service/ssm v1.27.1
+	github.com/plivo/plivo-go v7.2.0+incompatible
+	github.com/rs/zerolog v1.26.1
+	github.com/sowens-csd/folktells-server v1.7.21
+)
@@ -0,0 +1,34 @@
+// Package media reads and writes the media reference records that stand for
+// files in the media bucket, the same records community/mediaAccess signs
+// access to.
+package media
+
+import (
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// Reference is the record for a media reference, kept under
+// ftdb.ResourceIDFromUserID(reference) as
+// ftdb.ReferenceIDFromMediaReference(reference). MediaFile is its key in the
+// media bucket. The attributes are named after the fields, as mediaAccess
+// writes them.
+type Reference struct {
+	MediaFile   string
+	ContentType string
+	CreatedAt   int
+	CreatedBy   string
+}
+
+// Load reads the record for the media reference, found is false if there is
+// none.
+func Load(ftCtx awsproxy.FTContext, mediaReference string) (Reference, bool, error) {
+	var reference Reference
+	found, err := ftdb.GetItem(ftCtx, ftdb.ResourceIDFromUserID(mediaReference), ftdb.ReferenceIDFromMediaReference(mediaReference), &reference)
+	return reference, found, err
+}
+
+// Save writes the record for the media reference.
+func Save(ftCtx awsproxy.FTContext, mediaReference string, reference Reference) error {
+	return ftdb.PutItem(ftCtx, ftdb.ResourceIDFromUserID(mediaReference), ftdb.ReferenceIDFromMediaReference(mediaReference), &reference)
+}
@@ -0,0 +1,169 @@
+// Package quiet keeps alerts from waking users during their quiet hours.
+// Every lambda that pushes an alert to a user goes through Hold or SendAlert.
+package quiet
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/notification"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// A user's quiet hours are kept as Q#quiet under their U#{userID}. Alerts
+// held until the end of someone's quiet hours wait as
+// X#{deliverAt}#{alertID} under X#delayed for delayed_alerts to send.
+const SettingsReferenceID = "Q#quiet"
+const DelayedResourceID = "X#delayed"
+const DelayedPrefix = "X#"
+
+// What happened to an alert. A suppressed alert is never sent, a delayed one
+// is sent when the quiet hours end.
+const (
+	Sent       = "sent"
+	Suppressed = "suppressed"
+	Delayed    = "delayed"
+)
+
+// Settings are when the user does not want to be woken, from start to end as
+// hh:mm in their time zone, which may run past midnight. Alerts that can wait
+// are delayed to the end when delay is set and suppressed otherwise, calls
+// are always suppressed. The emergency contacts always get through.
+type Settings struct {
+	Enabled           bool     `json:"enabled" dynamodbav:"enabled"`
+	TimeZone          string   `json:"timeZone" dynamodbav:"timeZone"`
+	Start             string   `json:"start" dynamodbav:"start"`
+	End               string   `json:"end" dynamodbav:"end"`
+	Delay             bool     `json:"delay" dynamodbav:"delay"`
+	EmergencyContacts []string `json:"emergencyContacts" dynamodbav:"emergencyContacts"`
+}
+
+// DelayedAlert is an alert waiting for the recipient's quiet hours to end.
+type DelayedAlert struct {
+	RecipientID string `dynamodbav:"recipientId"`
+	SenderID    string `dynamodbav:"senderId"`
+	Title       string `dynamodbav:"title"`
+	Body        string `dynamodbav:"body"`
+	DeliverAt   int    `dynamodbav:"deliverAt"`
+}
+
+// Until reports whether the time falls in the quiet hours and, if so, when
+// they end.
+func Until(settings Settings, now time.Time) (time.Time, bool) {
+	if !settings.Enabled {
+		return now, false
+	}
+	location, err := time.LoadLocation(settings.TimeZone)
+	if nil != err {
+		return now, false
+	}
+	start, startErr := MinuteOfDay(settings.Start)
+	end, endErr := MinuteOfDay(settings.End)
+	if nil != startErr || nil != endErr || start == end {
+		return now, false
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	endToday := midnight.Add(time.Duration(end) * time.Minute)
+	if start < end {
+		return endToday, minute >= start && minute < end
+	}
+	if minute >= start {
+		return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, location).Add(time.Duration(end) * time.Minute), true
+	}
+	return endToday, minute < end
+}
+
+// MinuteOfDay parses hh:mm.
+func MinuteOfDay(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("time %s is not hh:mm", clock)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if nil != err || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("time %s is not hh:mm", clock)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if nil != err || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("time %s is not hh:mm", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+// Hold decides whether an alert from the user may go to the recipient now.
+// An alert that can wait and is to be delayed is queued here, the caller only
+// sends the alert when the outcome is Sent. The time a delayed alert will be
+// sent is returned with it.
+func Hold(ftCtx awsproxy.FTContext, recipientID, title, body string, canWait bool) (string, int, error) {
+	item, err := records.LoadItem(ftCtx, ftdb.ResourceIDFromUserID(recipientID), SettingsReferenceID)
+	if nil != err || len(item) == 0 {
+		return Sent, 0, err
+	}
+	var settings Settings
+	err = attributevalue.UnmarshalMap(item, &settings)
+	if nil != err {
+		return Sent, 0, err
+	}
+	for _, contact := range settings.EmergencyContacts {
+		if contact == ftCtx.UserID {
+			return Sent, 0, nil
+		}
+	}
+	until, quiet := Until(settings, time.Now().UTC())
+	if !quiet {
+		return Sent, 0, nil
+	}
+	if !canWait || !settings.Delay {
+		return Suppressed, 0, nil
+	}
+	alert := DelayedAlert{
+		RecipientID: recipientID,
+		SenderID:    ftCtx.UserID,
+		Title:       title,
+		Body:        body,
+		DeliverAt:   int(until.UTC().Unix() * 1000),
+	}
+	item, err = attributevalue.MarshalMap(alert)
+	if nil != err {
+		return Suppressed, 0, err
+	}
+	item[ftdb.ResourceIDField] = &types.AttributeValueMemberS{Value: DelayedResourceID}
+	item[ftdb.ReferenceIDField] = &types.AttributeValueMemberS{Value: fmt.Sprintf("%s%013d#%s", DelayedPrefix, alert.DeliverAt, ftdb.NewUUID())}
+	_, err = ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item:      item,
+	})
+	if nil != err {
+		return Suppressed, 0, err
+	}
+	return Delayed, alert.DeliverAt, nil
+}
+
+// SendAlert pushes the alert to the recipient unless Hold keeps it back. The
+// recipient is loaded when it is not given.
+func SendAlert(ftCtx awsproxy.FTContext, recipientID string, recipient *sharing.OnlineUser, title, body string, canWait bool, client *http.Client) (string, error) {
+	alert, _, err := Hold(ftCtx, recipientID, title, body, canWait)
+	if nil != err || alert != Sent {
+		return alert, err
+	}
+	if nil == recipient {
+		recipient, err = sharing.LoadOnlineUser(ftCtx, recipientID)
+		if nil != err {
+			return alert, err
+		}
+	}
+	return alert, notification.SendAlert(ftCtx, title, body, recipient, client)
+}
@@ -0,0 +1,51 @@
+package quiet
+
+import (
+	"testing"
+	"time"
+)
+
+func quietAt(t *testing.T, settings Settings, at string) (time.Time, bool) {
+	now, err := time.Parse(time.RFC3339, at)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return Until(settings, now)
+}
+
+func TestQuietHoursOvernightInTimeZone(t *testing.T) {
+	settings := Settings{Enabled: true, TimeZone: "America/Toronto", Start: "21:30", End: "07:00"}
+	until, quiet := quietAt(t, settings, "2022-06-01T07:00:00Z")
+	if !quiet || until.UTC().Format(time.RFC3339) != "2022-06-01T11:00:00Z" {
+		t.Errorf("Expected 3am in Toronto to be quiet until 7am, was %v %v", quiet, until.UTC())
+	}
+	until, quiet = quietAt(t, settings, "2022-06-02T02:00:00Z")
+	if !quiet || until.UTC().Format(time.RFC3339) != "2022-06-02T11:00:00Z" {
+		t.Errorf("Expected 10pm in Toronto to be quiet until 7am the next day, was %v %v", quiet, until.UTC())
+	}
+	if _, quiet = quietAt(t, settings, "2022-06-01T16:00:00Z"); quiet {
+		t.Errorf("Expected noon in Toronto not to be quiet")
+	}
+}
+
+func TestQuietHoursWithinDay(t *testing.T) {
+	settings := Settings{Enabled: true, TimeZone: "UTC", Start: "13:00", End: "15:00"}
+	if _, quiet := quietAt(t, settings, "2022-06-01T14:59:00Z"); !quiet {
+		t.Errorf("Expected 14:59 to be quiet")
+	}
+	if _, quiet := quietAt(t, settings, "2022-06-01T15:00:00Z"); quiet {
+		t.Errorf("Expected 15:00 not to be quiet")
+	}
+}
+
+func TestQuietHoursDisabledOrInvalid(t *testing.T) {
+	for _, settings := range []Settings{
+		{Enabled: false, TimeZone: "UTC", Start: "00:00", End: "23:59"},
+		{Enabled: true, TimeZone: "Nowhere/Special", Start: "00:00", End: "23:59"},
+		{Enabled: true, TimeZone: "UTC", Start: "25:00", End: "23:59"},
+	} {
+		if _, quiet := quietAt(t, settings, "2022-06-01T12:00:00Z"); quiet {
+			t.Errorf("Expected %+v never to be quiet", settings)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package records
+
+import (
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// IsGroupMember checks that the user is in the group.
+func IsGroupMember(ftCtx awsproxy.FTContext, groupID string) (bool, error) {
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return false, err
+	}
+	for _, userGroupID := range groups {
+		if userGroupID == groupID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SharesGroup checks that the other user is in at least one of the user's
+// groups, users only reach people they share stories with.
+func SharesGroup(ftCtx awsproxy.FTContext, otherID string) (bool, error) {
+	if otherID == ftCtx.UserID {
+		return true, nil
+	}
+	groups, err := sharing.FindGroupsForUser(ftCtx)
+	if nil != err {
+		return false, err
+	}
+	for _, groupID := range groups {
+		member, err := LoadItem(ftCtx, ftdb.ResourceIDFromGroupID(groupID), ftdb.ReferenceIDFromUserID(otherID))
+		if nil != err {
+			return false, err
+		}
+		if len(member) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
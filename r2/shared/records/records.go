@@ -0,0 +1,135 @@
+// Package records has the story table helpers the shared packages have in
+// common.
+package records
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// LoadItem reads one item, which is empty if there is none.
+func LoadItem(ftCtx awsproxy.FTContext, resourceID, referenceID string) (map[string]types.AttributeValue, error) {
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key:       Key(resourceID, referenceID),
+	})
+	if nil != err {
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+// QueryPrefix reads every item under the resource whose reference starts with
+// the prefix.
+func QueryPrefix(ftCtx awsproxy.FTContext, resourceID, prefix string) ([]map[string]types.AttributeValue, error) {
+	return queryPrefix(ftCtx, resourceID, prefix, false)
+}
+
+// QueryPrefixConsistent is QueryPrefix with strongly consistent reads, for
+// when a write made just before must be seen.
+func QueryPrefixConsistent(ftCtx awsproxy.FTContext, resourceID, prefix string) ([]map[string]types.AttributeValue, error) {
+	return queryPrefix(ftCtx, resourceID, prefix, true)
+}
+
+func queryPrefix(ftCtx awsproxy.FTContext, resourceID, prefix string, consistent bool) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+			TableName:              aws.String(ftdb.GetTableName()),
+			KeyConditionExpression: aws.String("#resId = :resId AND begins_with(#refId, :prefix)"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":resId":  &types.AttributeValueMemberS{Value: resourceID},
+				":prefix": &types.AttributeValueMemberS{Value: prefix},
+			},
+			ConsistentRead:    aws.Bool(consistent),
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			return nil, err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+func DeleteItem(ftCtx awsproxy.FTContext, resourceID, referenceID string) error {
+	_, err := ftCtx.DBSvc.DeleteItem(ftCtx.Context, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key:       Key(resourceID, referenceID),
+	})
+	return err
+}
+
+func Key(resourceID, referenceID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+		ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: referenceID},
+	}
+}
+
+func StringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func NumberAttribute(item map[string]types.AttributeValue, name string) int {
+	if value, ok := item[name].(*types.AttributeValueMemberN); ok {
+		number, err := strconv.Atoi(value.Value)
+		if nil == err {
+			return number
+		}
+	}
+	return 0
+}
+
+// TTLField is the attribute the table expires items by. DynamoDB reads it as
+// seconds since the epoch, unlike the millisecond times kept everywhere else,
+// so nothing but expiry is stored in it.
+const TTLField = "ttl"
+
+// TTLAttribute is the TTL value for an item that may be removed after the
+// time.
+func TTLAttribute(at time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(at.UTC().Unix(), 10)}
+}
+
+// batchWriteLimit is the most requests DynamoDB accepts in one batch write.
+const batchWriteLimit = 25
+
+// BatchWrite makes the writes in batches, resubmitting anything DynamoDB
+// leaves unprocessed.
+func BatchWrite(ftCtx awsproxy.FTContext, writes []types.WriteRequest) error {
+	for start := 0; start < len(writes); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(writes) {
+			end = len(writes)
+		}
+		requests := map[string][]types.WriteRequest{ftdb.GetTableName(): writes[start:end]}
+		for len(requests) > 0 {
+			result, err := ftCtx.DBSvc.BatchWriteItem(ftCtx.Context, &dynamodb.BatchWriteItemInput{
+				RequestItems: requests,
+			})
+			if nil != err {
+				return err
+			}
+			requests = result.UnprocessedItems
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Package search keeps the story search index, an inverted index in the
+// story table that new_story writes as stories are saved and the stories
+// lambda reads to answer searches.
+package search
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// Each term in a story has a posting, S#{storyID} under W#{groupID}#{term},
+// holding how often the term appears. The terms indexed for a story are kept
+// at I#{groupID} under S#{storyID} so that postings for words removed by an
+// edit, or for a story purged, can be deleted.
+const PostingResourcePrefix = "W#"
+const IndexedTermsReferencePrefix = "I#"
+
+// AuthorField is the user who first saved the story, kept on the story item
+// and on each posting. LastUpdatedBy is whoever edited it last.
+const AuthorField = "createdBy"
+
+// maxIndexedTerms caps the number of distinct terms indexed per story.
+const maxIndexedTerms = 500
+
+// stopWords are too common to be worth indexing or searching for.
+var stopWords = map[string]bool{
+	"an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "from": true, "had": true, "has": true,
+	"have": true, "he": true, "her": true, "his": true, "in": true, "is": true,
+	"it": true, "its": true, "of": true, "on": true, "or": true, "she": true,
+	"that": true, "the": true, "their": true, "there": true, "they": true,
+	"this": true, "to": true, "was": true, "we": true, "were": true, "with": true,
+}
+
+// Story is what is indexed of a story.
+type Story struct {
+	GroupID       string
+	StoryID       string
+	Content       string
+	LastUpdated   int
+	LastUpdatedBy string
+	Author        string
+}
+
+// Posting is a term's entry for one story.
+type Posting struct {
+	StoryID       string
+	Frequency     int
+	LastUpdated   int
+	LastUpdatedBy string
+	Author        string
+}
+
+// Tokenize splits markdown content into lower case search terms.
+func Tokenize(content string) []string {
+	words := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if len([]rune(word)) < 2 || stopWords[word] {
+			continue
+		}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// TermFrequencies counts each distinct term in the content, keeping at most
+// maxIndexedTerms of them in the order they first appear.
+func TermFrequencies(content string) map[string]int {
+	frequencies := map[string]int{}
+	for _, term := range Tokenize(content) {
+		if _, found := frequencies[term]; !found && len(frequencies) >= maxIndexedTerms {
+			continue
+		}
+		frequencies[term]++
+	}
+	return frequencies
+}
+
+// Index brings the postings for the story up to date with its content.
+func Index(ftCtx awsproxy.FTContext, story Story) error {
+	frequencies := TermFrequencies(story.Content)
+	previousTerms, err := indexedTerms(ftCtx, story.GroupID, story.StoryID)
+	if nil != err {
+		return err
+	}
+	var writes []types.WriteRequest
+	for _, term := range previousTerms {
+		if _, found := frequencies[term]; !found {
+			writes = append(writes, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: records.Key(postingResourceID(story.GroupID, term), storyResourceID(story.StoryID))},
+			})
+		}
+	}
+	terms := make([]string, 0, len(frequencies))
+	for term, frequency := range frequencies {
+		terms = append(terms, term)
+		writes = append(writes, types.WriteRequest{
+			PutRequest: &types.PutRequest{
+				Item: map[string]types.AttributeValue{
+					ftdb.ResourceIDField:    &types.AttributeValueMemberS{Value: postingResourceID(story.GroupID, term)},
+					ftdb.ReferenceIDField:   &types.AttributeValueMemberS{Value: storyResourceID(story.StoryID)},
+					ftdb.IDField:            &types.AttributeValueMemberS{Value: story.StoryID},
+					ftdb.LastUpdatedField:   &types.AttributeValueMemberN{Value: strconv.Itoa(story.LastUpdated)},
+					ftdb.LastUpdatedByField: &types.AttributeValueMemberS{Value: story.LastUpdatedBy},
+					AuthorField:             &types.AttributeValueMemberS{Value: story.Author},
+					"frequency":             &types.AttributeValueMemberN{Value: strconv.Itoa(frequency)},
+				},
+			},
+		})
+	}
+	termsItem := map[string]types.AttributeValue{
+		ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: storyResourceID(story.StoryID)},
+		ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: IndexedTermsReferencePrefix + story.GroupID},
+	}
+	if len(terms) > 0 {
+		termsItem["terms"] = &types.AttributeValueMemberSS{Value: terms}
+	}
+	writes = append(writes, types.WriteRequest{PutRequest: &types.PutRequest{Item: termsItem}})
+	err = records.BatchWrite(ftCtx, writes)
+	if nil != err {
+		return err
+	}
+	ftCtx.RequestLogger.Debug().Str("story", story.StoryID).Int("terms", len(terms)).Msg("story indexed")
+	return nil
+}
+
+// Unindex deletes the story's postings and its record of them.
+func Unindex(ftCtx awsproxy.FTContext, groupID, storyID string) error {
+	terms, err := indexedTerms(ftCtx, groupID, storyID)
+	if nil != err {
+		return err
+	}
+	writes := make([]types.WriteRequest, 0, len(terms)+1)
+	for _, term := range terms {
+		writes = append(writes, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{Key: records.Key(postingResourceID(groupID, term), storyResourceID(storyID))},
+		})
+	}
+	writes = append(writes, types.WriteRequest{
+		DeleteRequest: &types.DeleteRequest{Key: records.Key(storyResourceID(storyID), IndexedTermsReferencePrefix+groupID)},
+	})
+	return records.BatchWrite(ftCtx, writes)
+}
+
+// Postings reads every posting for the term in the group.
+func Postings(ftCtx awsproxy.FTContext, groupID, term string) ([]Posting, error) {
+	items, err := records.QueryPrefix(ftCtx, postingResourceID(groupID, term), storyResourceID(""))
+	if nil != err {
+		return nil, err
+	}
+	postings := make([]Posting, 0, len(items))
+	for _, item := range items {
+		postings = append(postings, Posting{
+			StoryID:       records.StringAttribute(item, ftdb.IDField),
+			Frequency:     records.NumberAttribute(item, "frequency"),
+			LastUpdated:   records.NumberAttribute(item, ftdb.LastUpdatedField),
+			LastUpdatedBy: records.StringAttribute(item, ftdb.LastUpdatedByField),
+			Author:        records.StringAttribute(item, AuthorField),
+		})
+	}
+	return postings, nil
+}
+
+func indexedTerms(ftCtx awsproxy.FTContext, groupID, storyID string) ([]string, error) {
+	item, err := records.LoadItem(ftCtx, storyResourceID(storyID), IndexedTermsReferencePrefix+groupID)
+	if nil != err {
+		return nil, err
+	}
+	if terms, ok := item["terms"].(*types.AttributeValueMemberSS); ok {
+		return terms.Value, nil
+	}
+	return nil, nil
+}
+
+func postingResourceID(groupID, term string) string {
+	return PostingResourcePrefix + groupID + "#" + term
+}
+
+func storyResourceID(storyID string) string {
+	return "S#" + storyID
+}
@@ -0,0 +1,25 @@
+package search
+
+import (
+	"testing"
+)
+
+func TestTokenizeDropsStopWordsAndShortWords(t *testing.T) {
+	terms := Tokenize("# The Lake\nWe went to a lake, it was 1962.")
+	expected := []string{"lake", "went", "lake", "1962"}
+	if len(terms) != len(expected) {
+		t.Fatalf("Expected %v, was %v", expected, terms)
+	}
+	for i, term := range expected {
+		if terms[i] != term {
+			t.Errorf("Expected %v, was %v", expected, terms)
+		}
+	}
+}
+
+func TestTermFrequenciesCountsRepeats(t *testing.T) {
+	frequencies := TermFrequencies("fishing, FISHING and the lake")
+	if frequencies["fishing"] != 2 || frequencies["lake"] != 1 || len(frequencies) != 2 {
+		t.Errorf("Unexpected frequencies %v", frequencies)
+	}
+}
@@ -0,0 +1,55 @@
+package sms
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// Each phone number that texts an assigned number is kept as a contact,
+// C#{sender} under P#{number}, with its consent to receive texts from that
+// number and whether the owner has blocked it.
+const ContactReferencePrefix = "C#"
+
+const (
+	ConsentField          = "consent"
+	ConsentUpdatedAtField = "consentUpdatedAt"
+	BlockedField          = "blocked"
+)
+
+const (
+	ConsentOptedIn  = "optedIn"
+	ConsentOptedOut = "optedOut"
+)
+
+// Contact is what is known of a phone number's wishes for texts from one
+// assigned number.
+type Contact struct {
+	Consent string
+	Blocked bool
+}
+
+// ContactFromItem reads the contact from its record.
+func ContactFromItem(item map[string]types.AttributeValue) Contact {
+	blocked, _ := item[BlockedField].(*types.AttributeValueMemberBOOL)
+	return Contact{
+		Consent: records.StringAttribute(item, ConsentField),
+		Blocked: nil != blocked && blocked.Value,
+	}
+}
+
+// LoadContact reads the contact the recipient is for the number. A recipient
+// that has never texted the number has no consent recorded.
+func LoadContact(ftCtx awsproxy.FTContext, number, recipient string) (Contact, error) {
+	item, err := records.LoadItem(ftCtx, NumberResourcePrefix+number, ContactReferencePrefix+recipient)
+	if nil != err {
+		return Contact{}, err
+	}
+	return ContactFromItem(item), nil
+}
+
+// MayText is false once the contact has texted STOP or the owner has blocked
+// them.
+func (contact Contact) MayText() bool {
+	return !contact.Blocked && contact.Consent != ConsentOptedOut
+}
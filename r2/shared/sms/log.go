@@ -0,0 +1,73 @@
+package sms
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// An outbound message is logged for the owner of the number it was sent from,
+// L#{messageUUID} under U#{userID}, from when it is queued through every
+// status Plivo reports for it.
+const LogReferencePrefix = "L#"
+
+// logRetentionDays is how long an outbound message stays in the log.
+const logRetentionDays = 90
+
+// StatusQueued is the status of a message Plivo has accepted to send.
+const StatusQueued = "queued"
+
+// StatusUpdate is one change in the status of a message.
+type StatusUpdate struct {
+	MessageID string
+	From      string
+	To        string
+	Status    string
+	ErrorCode string
+}
+
+// LogStatus adds the status to the message's history, creating the log entry
+// on the first status. Callbacks can arrive out of order so the history is
+// kept as received and the current status is worked out when it is read.
+func LogStatus(ftCtx awsproxy.FTContext, ownerID string, update StatusUpdate, now int) error {
+	entry := map[string]types.AttributeValue{
+		"status": &types.AttributeValueMemberS{Value: update.Status},
+		"at":     &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+	}
+	if len(update.ErrorCode) > 0 {
+		entry["errorCode"] = &types.AttributeValueMemberS{Value: update.ErrorCode}
+	}
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Key: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromUserID(ownerID)},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: LogReferencePrefix + update.MessageID},
+		},
+		UpdateExpression: aws.String("SET #messageId = :messageId, #from = :from, #to = :to, #createdAt = if_not_exists(#createdAt, :now), #updatedAt = :now, #history = list_append(if_not_exists(#history, :empty), :entry), #ttl = :ttl"),
+		ExpressionAttributeNames: map[string]string{
+			"#messageId": "messageId",
+			"#from":      "from",
+			"#to":        "to",
+			"#createdAt": "createdAt",
+			"#updatedAt": "updatedAt",
+			"#history":   "history",
+			"#ttl":       records.TTLField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":messageId": &types.AttributeValueMemberS{Value: update.MessageID},
+			":from":      &types.AttributeValueMemberS{Value: update.From},
+			":to":        &types.AttributeValueMemberS{Value: update.To},
+			":now":       &types.AttributeValueMemberN{Value: strconv.Itoa(now)},
+			":empty":     &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+			":entry":     &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberM{Value: entry}}},
+			":ttl":       records.TTLAttribute(time.Now().Add(logRetentionDays * 24 * time.Hour)),
+		},
+	})
+	return err
+}
@@ -0,0 +1,117 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// NumberResourcePrefix marks an assigned number, P#{number}. The number is
+// recorded under itself with its owner so that inbound texts can find the
+// owner, and under the owner's U#{userID} so the owner can find their numbers.
+const NumberResourcePrefix = "P#"
+const numberOwnerField = "ownerId"
+
+// plivoNumbersURL lists the numbers rented by the Plivo account a page at a
+// time.
+const plivoNumbersURL = "https://api.plivo.com/v1/Account/%s/Number/?limit=%d&offset=%d"
+const plivoNumbersPageSize = 20
+
+// AssignedNumber is the record of a number assigned to a user.
+type AssignedNumber struct {
+	Number     string `json:"number" dynamodbav:"number"`
+	OwnerID    string `json:"ownerId" dynamodbav:"ownerId"`
+	AssignedAt int    `json:"assignedAt" dynamodbav:"assignedAt"`
+}
+
+// ProviderNumber is a number the Plivo account rents, with the alias it was
+// given when it was bought.
+type ProviderNumber struct {
+	Number string `json:"number"`
+	Alias  string `json:"alias"`
+}
+
+type providerNumbersPage struct {
+	Meta struct {
+		Next string `json:"next"`
+	} `json:"meta"`
+	Objects []ProviderNumber `json:"objects"`
+}
+
+// RecordAssignment records the number under itself and under its owner.
+func RecordAssignment(ftCtx awsproxy.FTContext, assignment AssignedNumber) error {
+	err := ftdb.PutItem(ftCtx, NumberResourcePrefix+assignment.Number, NumberResourcePrefix+assignment.Number, assignment)
+	if nil != err {
+		return err
+	}
+	return ftdb.PutItem(ftCtx, ftdb.ResourceIDFromUserID(assignment.OwnerID), NumberResourcePrefix+assignment.Number, assignment)
+}
+
+// NumberOwner is the ID of the user the number is assigned to, empty when it
+// is not assigned.
+func NumberOwner(ftCtx awsproxy.FTContext, number string) (string, error) {
+	if len(number) == 0 {
+		return "", nil
+	}
+	item, err := records.LoadItem(ftCtx, NumberResourcePrefix+number, NumberResourcePrefix+number)
+	if nil != err {
+		return "", err
+	}
+	return records.StringAttribute(item, numberOwnerField), nil
+}
+
+// ProviderNumbers lists every number the Plivo account rents.
+func ProviderNumbers(ftCtx awsproxy.FTContext, client *http.Client) ([]ProviderNumber, error) {
+	authID, err := AuthID(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	authToken, err := AuthToken(ftCtx)
+	if nil != err {
+		return nil, err
+	}
+	var numbers []ProviderNumber
+	for offset := 0; ; offset += plivoNumbersPageSize {
+		request, err := http.NewRequestWithContext(ftCtx.Context, http.MethodGet, fmt.Sprintf(plivoNumbersURL, authID, plivoNumbersPageSize, offset), nil)
+		if nil != err {
+			return nil, err
+		}
+		request.SetBasicAuth(authID, authToken)
+		response, err := client.Do(request)
+		if nil != err {
+			return nil, err
+		}
+		var page providerNumbersPage
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Plivo number list failed with status %d", response.StatusCode)
+		}
+		if nil != err {
+			return nil, err
+		}
+		for _, number := range page.Objects {
+			number.Number = NormalizeNumber(number.Number)
+			numbers = append(numbers, number)
+		}
+		if len(page.Meta.Next) == 0 || len(page.Objects) == 0 {
+			return numbers, nil
+		}
+	}
+}
+
+// NormalizeNumber keeps only the digits, Plivo sends E.164 numbers without
+// the leading plus.
+func NormalizeNumber(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+}
@@ -0,0 +1,79 @@
+package sms
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// plivoNumberURL is the Plivo account number resource, releasing a number is
+// a DELETE on it.
+const plivoNumberURL = "https://api.plivo.com/v1/Account/%s/Number/%s/"
+
+// UserNumbers lists the numbers assigned to the user.
+func UserNumbers(ftCtx awsproxy.FTContext, userID string) ([]AssignedNumber, error) {
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromUserID(userID), NumberResourcePrefix)
+	if nil != err {
+		return nil, err
+	}
+	numbers := []AssignedNumber{}
+	err = attributevalue.UnmarshalListOfMaps(items, &numbers)
+	return numbers, err
+}
+
+// Release gives the number back to Plivo and removes everything kept for it,
+// its owner record, reply templates and senders, so that nothing carries over
+// if Plivo hands the number to someone else.
+func Release(ftCtx awsproxy.FTContext, number AssignedNumber, client *http.Client) error {
+	err := deleteProviderNumber(ftCtx, number.Number, client)
+	if nil != err {
+		return err
+	}
+	items, err := records.QueryPrefix(ftCtx, NumberResourcePrefix+number.Number, "")
+	if nil != err {
+		return err
+	}
+	for _, item := range items {
+		err = records.DeleteItem(ftCtx, NumberResourcePrefix+number.Number, records.StringAttribute(item, ftdb.ReferenceIDField))
+		if nil != err {
+			return err
+		}
+	}
+	err = records.DeleteItem(ftCtx, ftdb.ResourceIDFromUserID(number.OwnerID), NumberResourcePrefix+number.Number)
+	if nil != err {
+		return err
+	}
+	ftCtx.RequestLogger.Info().Str("number", number.Number).Str("owner", number.OwnerID).Msg("SMS number released")
+	return nil
+}
+
+// deleteProviderNumber removes the number from the Plivo account. A number
+// Plivo no longer has is already released.
+func deleteProviderNumber(ftCtx awsproxy.FTContext, number string, client *http.Client) error {
+	authID, err := AuthID(ftCtx)
+	if nil != err {
+		return err
+	}
+	authToken, err := AuthToken(ftCtx)
+	if nil != err {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ftCtx.Context, http.MethodDelete, fmt.Sprintf(plivoNumberURL, authID, number), nil)
+	if nil != err {
+		return err
+	}
+	request.SetBasicAuth(authID, authToken)
+	response, err := client.Do(request)
+	if nil != err {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Plivo release of %s failed with status %d", number, response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sowens-csd/folktells-server/awsproxy"
+)
+
+// plivoMessageURL is the Plivo account message resource, a POST to it sends
+// a text.
+const plivoMessageURL = "https://api.plivo.com/v1/Account/%s/Message/"
+
+var ErrNoConsent = errors.New("The recipient does not accept texts from this number")
+
+type outboundMessage struct {
+	Source      string `json:"src"`
+	Destination string `json:"dst"`
+	Text        string `json:"text"`
+	CallbackURL string `json:"url,omitempty"`
+	Method      string `json:"method,omitempty"`
+}
+
+type sentMessage struct {
+	MessageUUID []string `json:"message_uuid"`
+}
+
+// Send texts the recipient from the owner's assigned number and returns the
+// provider's ID for the message. Every text sent through the API goes through
+// here, so a recipient who has texted STOP to the number, or whom its owner
+// has blocked, is never sent one and ErrNoConsent is returned. The message is
+// logged for the owner as queued and Plivo reports its delivery to sms_status.
+func Send(ftCtx awsproxy.FTContext, ownerID, from, to, text string, client *http.Client) (string, error) {
+	from = NormalizeNumber(from)
+	to = NormalizeNumber(to)
+	contact, err := LoadContact(ftCtx, from, to)
+	if nil != err {
+		return "", err
+	}
+	if !contact.MayText() {
+		return "", ErrNoConsent
+	}
+	authID, err := AuthID(ftCtx)
+	if nil != err {
+		return "", err
+	}
+	authToken, err := AuthToken(ftCtx)
+	if nil != err {
+		return "", err
+	}
+	message := outboundMessage{
+		Source:      from,
+		Destination: to,
+		Text:        text,
+		CallbackURL: os.Getenv("smsStatusURL"),
+	}
+	if len(message.CallbackURL) > 0 {
+		message.Method = http.MethodPost
+	}
+	body, err := json.Marshal(message)
+	if nil != err {
+		return "", err
+	}
+	request, err := http.NewRequestWithContext(ftCtx.Context, http.MethodPost, fmt.Sprintf(plivoMessageURL, authID), bytes.NewReader(body))
+	if nil != err {
+		return "", err
+	}
+	request.SetBasicAuth(authID, authToken)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if nil != err {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("Plivo send from %s failed with status %d", from, response.StatusCode)
+	}
+	var sent sentMessage
+	err = json.NewDecoder(response.Body).Decode(&sent)
+	if nil != err {
+		return "", err
+	}
+	if len(sent.MessageUUID) == 0 {
+		return "", fmt.Errorf("Plivo send from %s returned no message ID", from)
+	}
+	update := StatusUpdate{MessageID: sent.MessageUUID[0], From: from, To: to, Status: StatusQueued}
+	err = LogStatus(ftCtx, ownerID, update, int(time.Now().UTC().Unix()*1000))
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("message", update.MessageID).Msg("queued SMS not logged")
+	}
+	return update.MessageID, nil
+}
@@ -0,0 +1,218 @@
+// Package sms has what the lambdas that deal with the SMS provider share,
+// checking the callbacks it makes and reading its credentials.
+package sms
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/plivo/plivo-go"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// Plivo signs each callback with HMAC-SHA256 of the callback URL, the sorted
+// POST parameters and a random nonce, keyed by the account auth token. During
+// auth token rotation the signature header holds one signature per token,
+// separated by commas.
+const SignatureHeader = "X-Plivo-Signature-V3"
+const NonceHeader = "X-Plivo-Signature-V3-Nonce"
+
+// nonceReferencePrefix marks a nonce that has already been accepted,
+// N#{nonce} under N#{nonce}.
+const nonceReferencePrefix = "N#"
+
+// Plivo does not sign a timestamp, but its message UUIDs are time based and
+// the UUID is signed with the rest of the request. A callback for a message
+// older than freshnessWindow is refused, which leaves time for the carrier to
+// retry delivery reports, and its nonce is remembered for longer than that.
+// Callbacks whose time cannot be told keep their nonce for
+// undatedNonceRetention instead.
+const freshnessWindow = 4 * 24 * time.Hour
+const nonceRetention = freshnessWindow + 24*time.Hour
+const undatedNonceRetention = 30 * 24 * time.Hour
+
+// clockSkew is how far ahead of our clock a message may appear to be sent.
+const clockSkew = 5 * time.Minute
+
+// uuidEpochOffset is the number of 100ns intervals between the UUID epoch,
+// 15 October 1582, and the Unix epoch.
+const uuidEpochOffset = 0x01B21DD213814000
+
+var ErrInvalidSignature = errors.New("SMS request signature is not valid")
+var ErrReplayedRequest = errors.New("SMS request has already been received")
+var ErrStaleRequest = errors.New("SMS request is too old")
+
+// VerifyRequest checks that the request was signed by the SMS provider, is
+// recent and has not been seen before. Nothing else in the request is trusted
+// until it passes. urlEnv names the environment variable holding the URL the
+// provider was configured to call.
+func VerifyRequest(ftCtx awsproxy.FTContext, request awsproxy.Request, body, urlEnv string) error {
+	signature := Header(request.Headers, SignatureHeader)
+	nonce := Header(request.Headers, NonceHeader)
+	if len(signature) == 0 || len(nonce) == 0 {
+		return ErrInvalidSignature
+	}
+	params, err := url.ParseQuery(body)
+	if nil != err {
+		return ErrInvalidSignature
+	}
+	authToken, err := AuthToken(ftCtx)
+	if nil != err {
+		return err
+	}
+	if !ValidSignature(callbackURL(request, urlEnv), params, nonce, signature, authToken) {
+		return ErrInvalidSignature
+	}
+	now := time.Now().UTC()
+	sentAt, known := MessageTime(params.Get("MessageUUID"))
+	if known && (now.Sub(sentAt) > freshnessWindow || sentAt.Sub(now) > clockSkew) {
+		return ErrStaleRequest
+	}
+	retention := nonceRetention
+	if !known {
+		retention = undatedNonceRetention
+	}
+	return recordNonce(ftCtx, nonce, now, retention)
+}
+
+// ValidSignature checks the POST callback's signature with the Plivo SDK,
+// any of the signatures in the header may match. Plivo sends each parameter
+// once.
+func ValidSignature(uri string, params url.Values, nonce, signatures, authToken string) bool {
+	postParams := make(map[string]string, len(params))
+	for name := range params {
+		postParams[name] = params.Get(name)
+	}
+	valid, err := plivo.ValidateSignatureV3(uri, nonce, http.MethodPost, signatures, authToken, postParams)
+	return nil == err && valid
+}
+
+// MessageTime is when a message was created, read from its version 1 UUID.
+// known is false for any other kind of ID.
+func MessageTime(messageID string) (sentAt time.Time, known bool) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(messageID, "-", ""))
+	if nil != err || len(raw) != 16 || raw[6]>>4 != 1 {
+		return time.Time{}, false
+	}
+	timeLow := uint64(raw[0])<<24 | uint64(raw[1])<<16 | uint64(raw[2])<<8 | uint64(raw[3])
+	timeMid := uint64(raw[4])<<8 | uint64(raw[5])
+	timeHigh := uint64(raw[6]&0x0f)<<8 | uint64(raw[7])
+	intervals := timeHigh<<48 | timeMid<<32 | timeLow
+	if intervals < uuidEpochOffset {
+		return time.Time{}, false
+	}
+	since := intervals - uuidEpochOffset
+	return time.Unix(int64(since/1e7), int64(since%1e7)*100).UTC(), true
+}
+
+// recordNonce remembers the nonce for the retention, failing if it has been
+// used before.
+func recordNonce(ftCtx awsproxy.FTContext, nonce string, now time.Time, retention time.Duration) error {
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: nonceReferencePrefix + nonce},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: nonceReferencePrefix + nonce},
+			"receivedAt":          &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix() * 1000)},
+			records.TTLField:      records.TTLAttribute(now.Add(retention)),
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#resId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#resId": ftdb.ResourceIDField,
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrReplayedRequest
+	}
+	return err
+}
+
+// parameterCacheDuration is how long a parameter read from SSM is used before
+// it is read again, so a rotated auth token is picked up without a deploy.
+const parameterCacheDuration = 15 * time.Minute
+
+type cachedParameter struct {
+	value    string
+	loadedAt time.Time
+}
+
+var parameterCache = map[string]cachedParameter{}
+var parameterCacheLock sync.Mutex
+
+// AuthToken is the provider's auth token, which signs its callbacks and
+// authenticates calls to its API.
+func AuthToken(ftCtx awsproxy.FTContext) (string, error) {
+	return Parameter(ftCtx, "plivoAuthTokenParameter", "/plivo/authToken")
+}
+
+// AuthID is the provider account the auth token belongs to.
+func AuthID(ftCtx awsproxy.FTContext) (string, error) {
+	return Parameter(ftCtx, "plivoAuthIDParameter", "/plivo/authId")
+}
+
+// Parameter reads the SSM parameter named by the environment variable, or
+// the default name when the variable is not set. Values are kept for the life
+// of the container, up to parameterCacheDuration.
+func Parameter(ftCtx awsproxy.FTContext, env, defaultName string) (string, error) {
+	name := os.Getenv(env)
+	if len(name) == 0 {
+		name = defaultName
+	}
+	parameterCacheLock.Lock()
+	defer parameterCacheLock.Unlock()
+	if cached, ok := parameterCache[name]; ok && time.Since(cached.loadedAt) < parameterCacheDuration {
+		return cached.value, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return "", err
+	}
+	result, err := ssm.NewFromConfig(cfg).GetParameter(ftCtx.Context, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: true,
+	})
+	if nil != err {
+		return "", err
+	}
+	if nil == result.Parameter || nil == result.Parameter.Value {
+		return "", fmt.Errorf("No value for parameter %s", name)
+	}
+	parameterCache[name] = cachedParameter{value: *result.Parameter.Value, loadedAt: time.Now()}
+	return *result.Parameter.Value, nil
+}
+
+// callbackURL is the URL Plivo was configured to call, which is what it
+// signs. Behind the custom domain the request path alone does not include the
+// base path, so the URL comes from configuration.
+func callbackURL(request awsproxy.Request, urlEnv string) string {
+	if configured := os.Getenv(urlEnv); len(configured) > 0 {
+		return configured
+	}
+	return "https://" + Header(request.Headers, "Host") + request.Path
+}
+
+// Header finds a header regardless of case, API Gateway passes on the case
+// the caller used.
+func Header(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package sms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testURL = "https://api.folktells.com/r2/sms/receive"
+const testToken = "authtoken"
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(testToken))
+	mac.Write([]byte(payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignatureCoversSortedPostParams(t *testing.T) {
+	params := url.Values{"To": {"15551230000"}, "From": {"15559870000"}, "Text": {"hi"}}
+	signature := sign(testURL + ".From15559870000TexthiTo15551230000.12345")
+	if !ValidSignature(testURL, params, "12345", signature, testToken) {
+		t.Errorf("Expected signature over the sorted parameters to be valid")
+	}
+}
+
+func TestSignatureCoversSortedQueryParams(t *testing.T) {
+	signature := sign(testURL + "?a=1&b=2..n")
+	if !ValidSignature(testURL+"?b=2&a=1", url.Values{}, "n", signature, testToken) {
+		t.Errorf("Expected signature over the sorted query to be valid")
+	}
+}
+
+func TestValidSignature(t *testing.T) {
+	params := url.Values{"From": {"15559870000"}, "Text": {"hello"}}
+	signature := sign(testURL + ".From15559870000Texthello.nonce")
+	if !ValidSignature(testURL, params, "nonce", signature, testToken) {
+		t.Errorf("Expected signature to be valid")
+	}
+	if !ValidSignature(testURL, params, "nonce", "old, "+signature, testToken) {
+		t.Errorf("Expected any of the rotated signatures to be valid")
+	}
+}
+
+func TestTamperedMessageIsInvalid(t *testing.T) {
+	params := url.Values{"From": {"15559870000"}, "Text": {"hello"}}
+	signature := sign(testURL + ".From15559870000Texthello.nonce")
+	params.Set("Text", "goodbye")
+	if ValidSignature(testURL, params, "nonce", signature, testToken) {
+		t.Errorf("Expected changed text to invalidate the signature")
+	}
+	params.Set("Text", "hello")
+	if ValidSignature(testURL, params, "other", signature, testToken) {
+		t.Errorf("Expected a different nonce to invalidate the signature")
+	}
+	if ValidSignature(testURL, params, "nonce", signature, "wrongtoken") {
+		t.Errorf("Expected a different auth token to invalidate the signature")
+	}
+}
+
+func TestHeaderIgnoresCase(t *testing.T) {
+	headers := map[string]string{"x-plivo-signature-v3-nonce": "abc"}
+	if Header(headers, NonceHeader) != "abc" {
+		t.Errorf("Expected header to be found")
+	}
+}
+
+func TestMessageTimeFromTimeBasedUUID(t *testing.T) {
+	sentAt, known := MessageTime("db3ce55a-7f1d-11e1-8ea7-1231380bc196")
+	expected := time.Date(2012, time.April, 5, 12, 50, 0, 0, time.UTC)
+	if !known || sentAt.Truncate(time.Minute) != expected {
+		t.Errorf("Expected %v, was %v %v", expected, sentAt, known)
+	}
+}
+
+func TestMessageTimeUnknownForOtherIDs(t *testing.T) {
+	for _, id := range []string{"", "abc", "f47ac10b-58cc-4372-a567-0e02b2c3d479"} {
+		if _, known := MessageTime(id); known {
+			t.Errorf("Expected no time for %s", id)
+		}
+	}
+}
+
+func TestOptedOutOrBlockedContactsMayNotBeTexted(t *testing.T) {
+	if !(Contact{}).MayText() || !(Contact{Consent: ConsentOptedIn}).MayText() {
+		t.Errorf("Expected new and opted in contacts to be texted")
+	}
+	if (Contact{Consent: ConsentOptedOut}).MayText() || (Contact{Consent: ConsentOptedIn, Blocked: true}).MayText() {
+		t.Errorf("Expected opted out and blocked contacts not to be texted")
+	}
+}
@@ -0,0 +1,245 @@
+// Package sockets keeps track of the websocket connections each user has
+// open, the groups they are subscribed to and the user's presence, and posts
+// to them through the API Gateway management API.
+package sockets
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/messaging"
+)
+
+// ConnectionPrefix marks an open websocket connection. Alongside messaging's
+// own record, a connection is recorded as K#{connectionID} under the user's
+// U#{userID} so a user's connections can be found, and under K#{connectionID}
+// itself so a connection can be traced back to its user. A connection
+// subscribed to a group is K#{connectionID} under G#{groupID}, with the
+// G#{groupID} under K#{connectionID} so removing it can find its
+// subscriptions.
+const ConnectionPrefix = "K#"
+
+// Connection is a websocket connection of one of the user's devices, with the
+// management API endpoint it is posted to through.
+type Connection struct {
+	UserID       string
+	ConnectionID string
+	DeviceID     string
+	Endpoint     string
+	ConnectedAt  int
+}
+
+// Record records a newly opened connection, with messaging and here. A device
+// that does not say which it is counts as its own device for each connection.
+func Record(ftCtx awsproxy.FTContext, connectionID, deviceID, domainName, stage string) error {
+	err := messaging.RecordConnection(ftCtx, connectionID)
+	if nil != err {
+		return err
+	}
+	if len(deviceID) == 0 {
+		deviceID = connectionID
+	}
+	now := strconv.Itoa(int(time.Now().UTC().Unix() * 1000))
+	for _, resourceID := range []string{ftdb.ResourceIDFromUserID(ftCtx.UserID), connectionResourceID(connectionID)} {
+		_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Item: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: resourceID},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: connectionResourceID(connectionID)},
+				"userId":              &types.AttributeValueMemberS{Value: ftCtx.UserID},
+				"connectionId":        &types.AttributeValueMemberS{Value: connectionID},
+				"deviceId":            &types.AttributeValueMemberS{Value: deviceID},
+				"domainName":          &types.AttributeValueMemberS{Value: domainName},
+				"stage":               &types.AttributeValueMemberS{Value: stage},
+				"connectedAt":         &types.AttributeValueMemberN{Value: now},
+			},
+		})
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// UserConnections lists every connection the user has open.
+func UserConnections(ftCtx awsproxy.FTContext, userID string) ([]Connection, error) {
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromUserID(userID), ConnectionPrefix)
+	if nil != err {
+		return nil, err
+	}
+	connections := make([]Connection, 0, len(items))
+	for _, item := range items {
+		connection := connectionFromItem(item)
+		connection.UserID = userID
+		connections = append(connections, connection)
+	}
+	return connections, nil
+}
+
+// GroupConnections lists the connections subscribed to the group.
+func GroupConnections(ftCtx awsproxy.FTContext, groupID string) ([]Connection, error) {
+	items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromGroupID(groupID), ConnectionPrefix)
+	if nil != err {
+		return nil, err
+	}
+	return ConnectionsFromItems(items), nil
+}
+
+// DeviceConnections picks one connection per device, the latest, as a device
+// that reconnected may still have its old connection recorded.
+func DeviceConnections(connections []Connection) []Connection {
+	latest := map[string]int{}
+	var devices []Connection
+	for _, connection := range connections {
+		index, found := latest[connection.DeviceID]
+		if !found {
+			latest[connection.DeviceID] = len(devices)
+			devices = append(devices, connection)
+		} else if connection.ConnectedAt > devices[index].ConnectedAt {
+			devices[index] = connection
+		}
+	}
+	return devices
+}
+
+// Subscribe has the group's messages delivered to the connection.
+func Subscribe(ftCtx awsproxy.FTContext, connection Connection, groupID string) error {
+	now := strconv.Itoa(int(time.Now().UTC().Unix() * 1000))
+	domainName, stage := splitEndpoint(connection.Endpoint)
+	for _, key := range [][2]string{
+		{ftdb.ResourceIDFromGroupID(groupID), connectionResourceID(connection.ConnectionID)},
+		{connectionResourceID(connection.ConnectionID), ftdb.ResourceIDFromGroupID(groupID)},
+	} {
+		_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+			TableName: aws.String(ftdb.GetTableName()),
+			Item: map[string]types.AttributeValue{
+				ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: key[0]},
+				ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: key[1]},
+				"userId":              &types.AttributeValueMemberS{Value: connection.UserID},
+				"connectionId":        &types.AttributeValueMemberS{Value: connection.ConnectionID},
+				"deviceId":            &types.AttributeValueMemberS{Value: connection.DeviceID},
+				"domainName":          &types.AttributeValueMemberS{Value: domainName},
+				"stage":               &types.AttributeValueMemberS{Value: stage},
+				"subscribedAt":        &types.AttributeValueMemberN{Value: now},
+			},
+		})
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func Unsubscribe(ftCtx awsproxy.FTContext, connectionID, groupID string) error {
+	err := records.DeleteItem(ftCtx, ftdb.ResourceIDFromGroupID(groupID), connectionResourceID(connectionID))
+	if nil != err {
+		return err
+	}
+	return records.DeleteItem(ftCtx, connectionResourceID(connectionID), ftdb.ResourceIDFromGroupID(groupID))
+}
+
+// Remove forgets a connection that has closed, whether the disconnect was
+// seen or API Gateway reported it gone. Messaging's record, ours and the
+// group subscriptions all go, the user is seen now and marked offline when
+// it was their last connection. The presence is returned with whether it
+// changed, Drop also tells the user's groups.
+func Remove(ftCtx awsproxy.FTContext, userID, connectionID string) (Presence, bool, error) {
+	err := messaging.RemoveConnection(ftCtx, userID, connectionID)
+	if nil != err {
+		return Presence{}, false, err
+	}
+	resourceID := connectionResourceID(connectionID)
+	subscriptions, err := records.QueryPrefix(ftCtx, resourceID, ftdb.ResourceIDFromGroupID(""))
+	if nil != err {
+		return Presence{}, false, err
+	}
+	for _, item := range subscriptions {
+		err = Unsubscribe(ftCtx, connectionID, strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), ftdb.ResourceIDFromGroupID("")))
+		if nil != err {
+			return Presence{}, false, err
+		}
+	}
+	err = records.DeleteItem(ftCtx, resourceID, resourceID)
+	if nil != err {
+		return Presence{}, false, err
+	}
+	err = records.DeleteItem(ftCtx, ftdb.ResourceIDFromUserID(userID), resourceID)
+	if nil != err {
+		return Presence{}, false, err
+	}
+	presence, err := LoadPresence(ftCtx, userID)
+	if nil != err {
+		return presence, false, err
+	}
+	remaining, err := records.QueryPrefixConsistent(ftCtx, ftdb.ResourceIDFromUserID(userID), ConnectionPrefix)
+	if nil != err {
+		return presence, false, err
+	}
+	return setSeen(ftCtx, presence, len(remaining) == 0)
+}
+
+// Drop removes the connection and tells the user's groups when that leaves
+// the user offline. A failure to tell them is only logged.
+func Drop(ftCtx awsproxy.FTContext, poster *Poster, userID, connectionID string) error {
+	presence, changed, err := Remove(ftCtx, userID, connectionID)
+	if nil != err || !changed {
+		return err
+	}
+	err = NotifyPresence(ftCtx, poster, presence)
+	if nil != err {
+		ftCtx.RequestLogger.Error().Err(err).Str("user", userID).Msg("presence change not sent")
+	}
+	return nil
+}
+
+// ConnectionsFromItems reads connections from their records.
+func ConnectionsFromItems(items []map[string]types.AttributeValue) []Connection {
+	connections := make([]Connection, 0, len(items))
+	for _, item := range items {
+		connections = append(connections, connectionFromItem(item))
+	}
+	return connections
+}
+
+func connectionResourceID(connectionID string) string {
+	return ConnectionPrefix + connectionID
+}
+
+func connectionFromItem(item map[string]types.AttributeValue) Connection {
+	connection := Connection{
+		UserID:       records.StringAttribute(item, "userId"),
+		ConnectionID: records.StringAttribute(item, "connectionId"),
+		DeviceID:     records.StringAttribute(item, "deviceId"),
+		Endpoint:     Endpoint(records.StringAttribute(item, "domainName"), records.StringAttribute(item, "stage")),
+		ConnectedAt:  records.NumberAttribute(item, "connectedAt"),
+	}
+	if len(connection.ConnectionID) == 0 {
+		connection.ConnectionID = strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), ConnectionPrefix)
+	}
+	if len(connection.DeviceID) == 0 {
+		connection.DeviceID = connection.ConnectionID
+	}
+	return connection
+}
+
+// Endpoint is the management API endpoint of the websocket API with the
+// domain name and stage a connection was opened through.
+func Endpoint(domainName, stage string) string {
+	return fmt.Sprintf("https://%s/%s", domainName, stage)
+}
+
+func splitEndpoint(endpoint string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(endpoint, "https://"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,111 @@
+package sockets
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	gwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// ErrGone is returned when the connection has closed without the disconnect
+// being recorded.
+var ErrGone = errors.New("connection is gone")
+
+// Poster posts to connections through the management API of the endpoint
+// each was opened on.
+type Poster struct {
+	cfg     aws.Config
+	clients map[string]*apigatewaymanagementapi.Client
+}
+
+func NewPoster(ftCtx awsproxy.FTContext) (*Poster, error) {
+	cfg, err := config.LoadDefaultConfig(ftCtx.Context)
+	if nil != err {
+		return nil, err
+	}
+	return &Poster{cfg: cfg, clients: map[string]*apigatewaymanagementapi.Client{}}, nil
+}
+
+func (p *Poster) client(endpoint string) *apigatewaymanagementapi.Client {
+	client, found := p.clients[endpoint]
+	if !found {
+		client = apigatewaymanagementapi.NewFromConfig(p.cfg, func(o *apigatewaymanagementapi.Options) {
+			o.EndpointResolver = apigatewaymanagementapi.EndpointResolverFromURL(endpoint)
+		})
+		p.clients[endpoint] = client
+	}
+	return client
+}
+
+// Post sends the data to the connection, failing with ErrGone if it has
+// closed.
+func (p *Poster) Post(ftCtx awsproxy.FTContext, connection Connection, data []byte) error {
+	_, err := p.client(connection.Endpoint).PostToConnection(ftCtx.Context, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connection.ConnectionID),
+		Data:         data,
+	})
+	var gone *gwtypes.GoneException
+	if errors.As(err, &gone) {
+		return ErrGone
+	}
+	return err
+}
+
+// Check asks API Gateway whether the connection is still open, failing with
+// ErrGone if it is not.
+func (p *Poster) Check(ftCtx awsproxy.FTContext, connection Connection) error {
+	_, err := p.client(connection.Endpoint).GetConnection(ftCtx.Context, &apigatewaymanagementapi.GetConnectionInput{
+		ConnectionId: aws.String(connection.ConnectionID),
+	})
+	var gone *gwtypes.GoneException
+	if errors.As(err, &gone) {
+		return ErrGone
+	}
+	return err
+}
+
+// Deliver posts the data to the connection, dropping the connection if it
+// has gone.
+func (p *Poster) Deliver(ftCtx awsproxy.FTContext, connection Connection, data []byte) error {
+	err := p.Post(ftCtx, connection, data)
+	if ErrGone == err {
+		if dropErr := Drop(ftCtx, p, connection.UserID, connection.ConnectionID); nil != dropErr {
+			ftCtx.RequestLogger.Error().Err(dropErr).Str("connection", connection.ConnectionID).Msg("gone connection not removed")
+		}
+	}
+	return err
+}
+
+// NotifyGroup delivers the data to the open connections of every member of
+// the group. A connection that has gone is dropped on the spot, any other
+// failure is logged and the connection skipped.
+func NotifyGroup(ftCtx awsproxy.FTContext, poster *Poster, groupID string, data []byte) error {
+	userPrefix := ftdb.ReferenceIDFromUserID("")
+	members, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromGroupID(groupID), userPrefix)
+	if nil != err {
+		return err
+	}
+	for _, member := range members {
+		memberID := strings.TrimPrefix(records.StringAttribute(member, ftdb.ReferenceIDField), userPrefix)
+		if len(memberID) == 0 {
+			continue
+		}
+		connections, err := UserConnections(ftCtx, memberID)
+		if nil != err {
+			return err
+		}
+		for _, connection := range connections {
+			err = poster.Deliver(ftCtx, connection, data)
+			if nil != err && ErrGone != err {
+				ftCtx.RequestLogger.Info().Err(err).Str("connection", connection.ConnectionID).Msg("group event not delivered")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+	"github.com/sowens-csd/folktells-server/sharing"
+)
+
+// A user's presence is kept as O#presence under their U#{userID}. They are
+// online while they have at least one open connection, and lastSeenAt is when
+// a connection was last opened or closed. Each connect adds to the record's
+// generation after recording the connection, and a disconnect only marks the
+// user offline if the generation it read before finding no connections left
+// is unchanged, so a connect that races the disconnect is not overwritten.
+const PresenceReferenceID = "O#presence"
+
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// presenceEvent is pushed to the connections of everyone who shares a group
+// with the user when they come online or go offline.
+type presenceEvent struct {
+	Action string   `json:"action"`
+	Data   Presence `json:"data"`
+}
+
+type Presence struct {
+	UserID     string `json:"userId"`
+	Status     string `json:"status"`
+	LastSeenAt int    `json:"lastSeenAt,omitempty"`
+	Generation int    `json:"-"`
+}
+
+// LoadPresence reads the user's presence, a user who has never connected is
+// offline and has not been seen.
+func LoadPresence(ftCtx awsproxy.FTContext, userID string) (Presence, error) {
+	presence := Presence{UserID: userID, Status: PresenceOffline}
+	result, err := ftCtx.DBSvc.GetItem(ftCtx.Context, &dynamodb.GetItemInput{
+		TableName:      aws.String(ftdb.GetTableName()),
+		Key:            records.Key(ftdb.ResourceIDFromUserID(userID), PresenceReferenceID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if nil != err || len(result.Item) == 0 {
+		return presence, err
+	}
+	if status := records.StringAttribute(result.Item, "status"); len(status) > 0 {
+		presence.Status = status
+	}
+	presence.LastSeenAt = records.NumberAttribute(result.Item, "lastSeenAt")
+	presence.Generation = records.NumberAttribute(result.Item, "generation")
+	return presence, nil
+}
+
+// SetOnline marks the user online once their connection is recorded and
+// reports whether they were offline before.
+func SetOnline(ftCtx awsproxy.FTContext, userID string) (Presence, bool, error) {
+	presence := Presence{
+		UserID:     userID,
+		Status:     PresenceOnline,
+		LastSeenAt: int(time.Now().UTC().Unix() * 1000),
+	}
+	result, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ftdb.GetTableName()),
+		Key:              records.Key(ftdb.ResourceIDFromUserID(userID), PresenceReferenceID),
+		UpdateExpression: aws.String("SET #status = :status, #lastSeenAt = :now ADD #generation :one"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":     "status",
+			"#lastSeenAt": "lastSeenAt",
+			"#generation": "generation",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: PresenceOnline},
+			":now":    &types.AttributeValueMemberN{Value: strconv.Itoa(presence.LastSeenAt)},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedOld,
+	})
+	if nil != err {
+		return presence, false, err
+	}
+	return presence, records.StringAttribute(result.Attributes, "status") != PresenceOnline, nil
+}
+
+// setSeen records that one of the user's connections closed. When it was
+// the last, the user is marked offline unless a connection was opened since
+// the presence was read, and whether they went offline is reported.
+func setSeen(ftCtx awsproxy.FTContext, read Presence, last bool) (Presence, bool, error) {
+	presence := read
+	presence.LastSeenAt = int(time.Now().UTC().Unix() * 1000)
+	input := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ftdb.GetTableName()),
+		Key:              records.Key(ftdb.ResourceIDFromUserID(read.UserID), PresenceReferenceID),
+		UpdateExpression: aws.String("SET #lastSeenAt = :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#lastSeenAt": "lastSeenAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.Itoa(presence.LastSeenAt)},
+		},
+	}
+	if last {
+		presence.Status = PresenceOffline
+		input.UpdateExpression = aws.String("SET #lastSeenAt = :now, #status = :status")
+		input.ConditionExpression = aws.String("attribute_not_exists(#generation) OR #generation = :generation")
+		input.ExpressionAttributeNames["#status"] = "status"
+		input.ExpressionAttributeNames["#generation"] = "generation"
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: PresenceOffline}
+		input.ExpressionAttributeValues[":generation"] = &types.AttributeValueMemberN{Value: strconv.Itoa(read.Generation)}
+	}
+	_, err := ftCtx.DBSvc.UpdateItem(ftCtx.Context, input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return read, false, nil
+	}
+	if nil != err {
+		return read, false, err
+	}
+	return presence, presence.Status != read.Status, nil
+}
+
+// NotifyPresence pushes the change to the open connections of the members of
+// the user's groups. A connection that has gone is dropped on the spot, any
+// other failure is logged and the connection skipped.
+func NotifyPresence(ftCtx awsproxy.FTContext, poster *Poster, presence Presence) error {
+	userCtx := ftCtx
+	userCtx.UserID = presence.UserID
+	groups, err := sharing.FindGroupsForUser(userCtx)
+	if nil != err {
+		return err
+	}
+	members, err := GroupMemberIDs(ftCtx, groups)
+	if nil != err {
+		return err
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(presenceEvent{Action: "presence", Data: presence})
+	if nil != err {
+		return err
+	}
+	for _, memberID := range members {
+		if memberID == presence.UserID {
+			continue
+		}
+		connections, err := UserConnections(ftCtx, memberID)
+		if nil != err {
+			return err
+		}
+		for _, connection := range connections {
+			err = poster.Deliver(ftCtx, connection, body)
+			if nil != err && ErrGone != err {
+				ftCtx.RequestLogger.Info().Err(err).Str("connection", connection.ConnectionID).Msg("presence not delivered")
+			}
+		}
+	}
+	return nil
+}
+
+// GroupMemberIDs lists everyone who is in one of the groups, each once.
+func GroupMemberIDs(ftCtx awsproxy.FTContext, groupIDs []string) ([]string, error) {
+	userPrefix := ftdb.ReferenceIDFromUserID("")
+	seen := map[string]bool{}
+	var members []string
+	for _, groupID := range groupIDs {
+		items, err := records.QueryPrefix(ftCtx, ftdb.ResourceIDFromGroupID(groupID), userPrefix)
+		if nil != err {
+			return nil, err
+		}
+		for _, item := range items {
+			memberID := strings.TrimPrefix(records.StringAttribute(item, ftdb.ReferenceIDField), userPrefix)
+			if len(memberID) > 0 && !seen[memberID] {
+				seen[memberID] = true
+				members = append(members, memberID)
+			}
+		}
+	}
+	return members, nil
+}
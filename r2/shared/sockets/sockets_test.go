@@ -0,0 +1,55 @@
+package sockets
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+func connectionItem(connectionID, deviceID, connectedAt string) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: ConnectionPrefix + connectionID},
+		"domainName":          &types.AttributeValueMemberS{Value: "ws.example.com"},
+		"stage":               &types.AttributeValueMemberS{Value: "dev"},
+		"connectedAt":         &types.AttributeValueMemberN{Value: connectedAt},
+	}
+	if len(deviceID) > 0 {
+		item["deviceId"] = &types.AttributeValueMemberS{Value: deviceID}
+	}
+	return item
+}
+
+func TestLatestConnectionPerDevice(t *testing.T) {
+	devices := DeviceConnections(ConnectionsFromItems([]map[string]types.AttributeValue{
+		connectionItem("old", "phone", "1"),
+		connectionItem("tablet1", "tablet", "2"),
+		connectionItem("new", "phone", "3"),
+	}))
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, was %d", len(devices))
+	}
+	if devices[0].DeviceID != "phone" || devices[0].ConnectionID != "new" {
+		t.Errorf("Expected phone on the new connection, was %+v", devices[0])
+	}
+	if devices[1].Endpoint != "https://ws.example.com/dev" {
+		t.Errorf("Expected the connection's endpoint, was %s", devices[1].Endpoint)
+	}
+}
+
+func TestConnectionWithoutDeviceIsItsOwnDevice(t *testing.T) {
+	devices := DeviceConnections(ConnectionsFromItems([]map[string]types.AttributeValue{
+		connectionItem("c1", "", "1"),
+		connectionItem("c2", "", "2"),
+	}))
+	if len(devices) != 2 || devices[0].DeviceID != "c1" || devices[1].DeviceID != "c2" {
+		t.Errorf("Expected one device per connection, was %+v", devices)
+	}
+}
+
+func TestEndpointSplitsIntoDomainAndStage(t *testing.T) {
+	domainName, stage := splitEndpoint(Endpoint("ws.example.com", "dev"))
+	if domainName != "ws.example.com" || stage != "dev" {
+		t.Errorf("Expected ws.example.com and dev, was %s and %s", domainName, stage)
+	}
+}
@@ -0,0 +1,145 @@
+// Package trash purges stories from the trash, now when the user asks or by
+// story_purge once their retention window has ended.
+package trash
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/records"
+	"github.com/sowens-csd/folktells-cloud-deploy/shared/search"
+	"github.com/sowens-csd/folktells-server/awsproxy"
+	"github.com/sowens-csd/folktells-server/ftdb"
+)
+
+// A deleted story is in the trash of the user that deleted it as
+// T#{groupID}#{storyID} under U#{userID}. It also waits to be purged as
+// T#{expiresAt}#{groupID}#{storyID} under T#purge, so that story_purge can
+// find the stories due without reading the whole table.
+const ReferencePrefix = "T#"
+const purgeResourceID = "T#purge"
+
+// Entry is a story waiting in a user's trash, ExpiresAt is when it is purged
+// in milliseconds.
+type Entry struct {
+	UserID    string
+	GroupID   string
+	StoryID   string
+	ExpiresAt int
+}
+
+func ReferenceID(groupID, storyID string) string {
+	return fmt.Sprintf("%s%s#%s", ReferencePrefix, groupID, storyID)
+}
+
+// Schedule queues the story to be purged when it expires.
+func Schedule(ftCtx awsproxy.FTContext, entry Entry) error {
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:  &types.AttributeValueMemberS{Value: purgeResourceID},
+			ftdb.ReferenceIDField: &types.AttributeValueMemberS{Value: purgeReferenceID(entry)},
+			"userId":              &types.AttributeValueMemberS{Value: entry.UserID},
+			"groupId":             &types.AttributeValueMemberS{Value: entry.GroupID},
+			"storyId":             &types.AttributeValueMemberS{Value: entry.StoryID},
+			"expiresAt":           &types.AttributeValueMemberN{Value: strconv.Itoa(entry.ExpiresAt)},
+		},
+	})
+	return err
+}
+
+// Unschedule takes a story restored from the trash out of the purge queue.
+func Unschedule(ftCtx awsproxy.FTContext, entry Entry) error {
+	return records.DeleteItem(ftCtx, purgeResourceID, purgeReferenceID(entry))
+}
+
+// Due lists the stories whose retention window ended by now.
+func Due(ftCtx awsproxy.FTContext, now int) ([]Entry, error) {
+	var entries []Entry
+	var startKey map[string]types.AttributeValue
+	for {
+		result, err := ftCtx.DBSvc.Query(ftCtx.Context, &dynamodb.QueryInput{
+			TableName:              aws.String(ftdb.GetTableName()),
+			KeyConditionExpression: aws.String("#resId = :resId AND #refId < :due"),
+			ExpressionAttributeNames: map[string]string{
+				"#resId": ftdb.ResourceIDField,
+				"#refId": ftdb.ReferenceIDField,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":resId": &types.AttributeValueMemberS{Value: purgeResourceID},
+				":due":   &types.AttributeValueMemberS{Value: fmt.Sprintf("%s%013d", ReferencePrefix, now+1)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if nil != err {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			entries = append(entries, Entry{
+				UserID:    records.StringAttribute(item, "userId"),
+				GroupID:   records.StringAttribute(item, "groupId"),
+				StoryID:   records.StringAttribute(item, "storyId"),
+				ExpiresAt: records.NumberAttribute(item, "expiresAt"),
+			})
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return entries, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+// Purge deletes the story, its search postings, its revisions and the trash
+// entry, leaving a tombstone in the group so that clients which have not
+// synced since the delete still remove it.
+func Purge(ftCtx awsproxy.FTContext, entry Entry) error {
+	_, err := ftCtx.DBSvc.PutItem(ftCtx.Context, &dynamodb.PutItemInput{
+		TableName: aws.String(ftdb.GetTableName()),
+		Item: map[string]types.AttributeValue{
+			ftdb.ResourceIDField:    &types.AttributeValueMemberS{Value: ftdb.ResourceIDFromGroupID(entry.GroupID)},
+			ftdb.ReferenceIDField:   &types.AttributeValueMemberS{Value: "D#" + entry.StoryID},
+			ftdb.IDField:            &types.AttributeValueMemberS{Value: entry.StoryID},
+			ftdb.LastUpdatedField:   &types.AttributeValueMemberN{Value: strconv.Itoa(int(time.Now().UTC().Unix() * 1000))},
+			ftdb.LastUpdatedByField: &types.AttributeValueMemberS{Value: entry.UserID},
+		},
+	})
+	if nil != err {
+		return err
+	}
+	err = records.DeleteItem(ftCtx, ftdb.ResourceIDFromGroupID(entry.GroupID), "S#"+entry.StoryID)
+	if nil != err {
+		return err
+	}
+	err = search.Unindex(ftCtx, entry.GroupID, entry.StoryID)
+	if nil != err {
+		return err
+	}
+	revisions, err := records.QueryPrefix(ftCtx, "S#"+entry.StoryID, "R#")
+	if nil != err {
+		return err
+	}
+	for _, revision := range revisions {
+		// Revisions of the story in its other groups stay with it there.
+		if groupID := records.StringAttribute(revision, "groupId"); len(groupID) > 0 && groupID != entry.GroupID {
+			continue
+		}
+		err = records.DeleteItem(ftCtx, "S#"+entry.StoryID, records.StringAttribute(revision, ftdb.ReferenceIDField))
+		if nil != err {
+			return err
+		}
+	}
+	err = records.DeleteItem(ftCtx, ftdb.ResourceIDFromUserID(entry.UserID), ReferenceID(entry.GroupID, entry.StoryID))
+	if nil != err {
+		return err
+	}
+	ftCtx.RequestLogger.Info().Str("group", entry.GroupID).Str("story", entry.StoryID).Msg("story purged")
+	return Unschedule(ftCtx, entry)
+}
+
+func purgeReferenceID(entry Entry) string {
+	return fmt.Sprintf("%s%013d#%s#%s", ReferencePrefix, entry.ExpiresAt, entry.GroupID, entry.StoryID)
+}
@@ -0,0 +1,13 @@
+package trash
+
+import (
+	"testing"
+)
+
+func TestPurgeQueueSortsByExpiry(t *testing.T) {
+	sooner := purgeReferenceID(Entry{GroupID: "g2", StoryID: "s2", ExpiresAt: 999})
+	later := purgeReferenceID(Entry{GroupID: "g1", StoryID: "s1", ExpiresAt: 1583440478299})
+	if sooner >= later {
+		t.Errorf("Expected %s to sort before %s", sooner, later)
+	}
+}
@@ -0,0 +1,3 @@
+# Turns on DynamoDB expiry of story table items by their ttl attribute, in
+# seconds since the epoch. Run once per stage, e.g. ./ttl.sh dev sls-deployr2
+aws dynamodb update-time-to-live --table-name $1-story --time-to-live-specification "Enabled=true,AttributeName=ttl" --aws-profile $2